@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend selects how PinnedMap operations that can be done either with a native BPF syscall or
+// by running bpftool (such as creating, iterating and deleting from maps) are carried out.
+type Backend int
+
+const (
+	// BackendAuto, the default, uses the native syscall where possible and falls back to
+	// bpftool if the syscall isn't available or fails.
+	BackendAuto Backend = iota
+	// BackendNative only uses native syscalls.  Operations fail rather than fall back.
+	BackendNative
+	// BackendBPFTool only uses bpftool.  Operations that bpftool can't do, such as IterPage,
+	// GetBatch and Compact, return an error.
+	BackendBPFTool
+)
+
+func (be Backend) String() string {
+	switch be {
+	case BackendAuto:
+		return "auto"
+	case BackendNative:
+		return "native"
+	case BackendBPFTool:
+		return "bpftool"
+	}
+	return "unknown"
+}
+
+func (c *MapContext) backend() Backend {
+	if c == nil {
+		return BackendAuto
+	}
+	return c.Backend
+}
+
+// runDualPath runs native or bpftool, or both, according to the context's backend.  In auto mode,
+// bpftool is only tried if native fails with an error for which retry returns true.
+func (c *MapContext) runDualPath(op, mapName string, native, bpftool func() error, retry func(error) bool) error {
+	switch c.backend() {
+	case BackendBPFTool:
+		return bpftool()
+	case BackendNative:
+		if !SyscallSupport() {
+			return errors.Errorf("%s of map %s requires native syscalls, which aren't supported", op, mapName)
+		}
+		return native()
+	}
+	if !SyscallSupport() {
+		return bpftool()
+	}
+	err := native()
+	if err == nil || !retry(err) {
+		return err
+	}
+	logrus.WithError(err).WithFields(logrus.Fields{"op": op, "name": mapName}).Warn(
+		"Native BPF syscall failed, falling back to bpftool")
+	return bpftool()
+}
+
+// nativeOnly returns an error if the context's backend is bpftool, for operations that have no
+// bpftool equivalent, so that they don't silently bypass the chosen backend.
+func (c *MapContext) nativeOnly(op, mapName string) error {
+	if c.backend() == BackendBPFTool {
+		return errors.Errorf("%s of map %s requires native syscalls, but the backend is bpftool", op, mapName)
+	}
+	return nil
+}
+
+// iterNative implements Iter by walking the keys with BPF_MAP_GET_NEXT_KEY and looking up each
+// one.  Entries that are deleted during the walk are skipped.
+func (b *PinnedMap) iterNative(f MapIter) error {
+	if b.perCPU {
+		return errors.Errorf("native iteration of per-CPU map %s is not supported", b.versionedName())
+	}
+	var keys [][]byte
+	err := b.withFD(func(fd MapFD) (err error) {
+		keys, err = mapKeys(fd, b.KeySize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v, err := b.getUncached(k)
+		if IsNotExists(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f(k, v)
+	}
+	return nil
+}
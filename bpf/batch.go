@@ -0,0 +1,335 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultMaxBatchBytes = 1 << 20
+	initialBatchBytes    = 4096
+)
+
+// batchLookupFunc has the signature of LookupMapBatch, minus the map FD and sizes, to allow
+// batch iteration to be tested without a kernel.
+type batchLookupFunc func(inBatch []byte, count int) (keys, values []byte, n int, next []byte, err error)
+
+// batchSizer chooses how many entries to request in each batch lookup.  It starts with a
+// buffer of roughly initialBatchBytes, so that tiny maps and maps with large values don't
+// allocate much, then doubles the count each time a batch comes back full, so that big maps
+// with small values don't need a syscall for every few entries.  The buffer never exceeds
+// maxBytes (unless a single entry is bigger than that) or the size of the whole map.
+type batchSizer struct {
+	count    int
+	maxCount int
+}
+
+func newBatchSizer(keySize, valueSize, maxEntries, maxBytes int) *batchSizer {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBatchBytes
+	}
+	entrySize := keySize + valueSize
+	maxCount := maxBytes / entrySize
+	if maxCount > maxEntries {
+		maxCount = maxEntries
+	}
+	if maxCount < 1 {
+		maxCount = 1
+	}
+	count := initialBatchBytes / entrySize
+	if count > maxCount {
+		count = maxCount
+	}
+	if count < 1 {
+		count = 1
+	}
+	return &batchSizer{count: count, maxCount: maxCount}
+}
+
+// grow doubles the batch size, up to the cap.  It returns false if the batch size was already
+// at the cap.
+func (s *batchSizer) grow() bool {
+	if s.count >= s.maxCount {
+		return false
+	}
+	s.count *= 2
+	if s.count > s.maxCount {
+		s.count = s.maxCount
+	}
+	return true
+}
+
+// observe records that a lookup returned n entries.  A full batch suggests that there are
+// more entries to come so the next batch is made bigger.
+func (s *batchSizer) observe(n int) {
+	if n >= s.count {
+		s.grow()
+	}
+}
+
+// IterBatch iterates over the map using BPF_MAP_LOOKUP_BATCH, which needs far fewer syscalls
+// than looking entries up one at a time.  It requires kernel v5.6+.  The size of each batch
+// adapts to the map's value size and to how full the batches are; MapContext.MaxBatchBytes caps
+// the buffer size.  As with Iter, the entries seen are not a consistent snapshot if the map is
+// being modified concurrently.
+func (b *PinnedMap) IterBatch(f MapIter) error {
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	if b.perCPU {
+		return errors.Errorf("batch iteration of per-CPU map %s is not supported", b.versionedName())
+	}
+	if err := b.context.nativeOnly("batch iteration", b.versionedName()); err != nil {
+		return err
+	}
+	maxBytes := 0
+	if b.context != nil {
+		maxBytes = b.context.MaxBatchBytes
+	}
+	sizer := newBatchSizer(b.KeySize, b.ValueSize, b.MaxEntries, maxBytes)
+	lookup := func(inBatch []byte, count int) (keys, values []byte, n int, outBatch []byte, err error) {
+		err = b.withFD(func(fd MapFD) (err error) {
+			keys, values, n, outBatch, err = LookupMapBatch(fd, inBatch, b.KeySize, b.ValueSize, count)
+			return err
+		})
+		return
+	}
+	if err := iterBatch(lookup, b.KeySize, b.ValueSize, sizer, f); err != nil {
+		return errors.WithMessagef(err, "batch lookup in map %s", b.versionedName())
+	}
+	return nil
+}
+
+func iterBatch(lookup batchLookupFunc, keySize, valueSize int, sizer *batchSizer, f MapIter) error {
+	var token []byte
+	started := false
+	for !started || token != nil {
+		keys, values, n, next, err := lookup(token, sizer.count)
+		if err == unix.ENOSPC && n == 0 {
+			// A hash bucket held more entries than the batch, retry with a bigger one.
+			if sizer.grow() {
+				continue
+			}
+			return errors.Wrap(err, "hash bucket too big for the maximum batch size")
+		}
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			f(keys[i*keySize:(i+1)*keySize], values[i*valueSize:(i+1)*valueSize])
+		}
+		sizer.observe(n)
+		started = true
+		token = next
+	}
+	return nil
+}
+
+// errNotSupp is the kernel's internal ENOTSUPP, which leaks out of some BPF map operations that
+// a map type doesn't implement.
+const errNotSupp = unix.Errno(524)
+
+// isBatchUnsupported returns true if err from a batch operation means that the kernel (EINVAL,
+// from kernels that predate the command) or the map type doesn't support it.
+func isBatchUnsupported(err error) bool {
+	return err == unix.EINVAL || err == unix.EOPNOTSUPP || err == errNotSupp
+}
+
+// UpdateBatch writes the given entries, using BPF_MAP_UPDATE_BATCH if the kernel and map type
+// support it and one update per entry if not.  The order in which the entries are written isn't
+// defined so, if keys contains duplicates, it isn't defined which value is stored.  If the write
+// fails part-way through, some of the entries may have been written.  All sizes are checked before
+// anything is written.  If the context's OnMutate hook or history is enabled, the entries are
+// written one at a time so that each of them is seen.  On a frozen map, the error's cause is
+// ErrMapFrozen.
+func (b *PinnedMap) UpdateBatch(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.Errorf("got %d keys but %d values", len(keys), len(values))
+	}
+	for i := range keys {
+		if len(keys[i]) != b.KeySize || len(values[i]) != b.ValueSize {
+			return errors.Errorf("entry %d has wrong size (key %d, value %d), expected %d and %d",
+				i, len(keys[i]), len(values[i]), b.KeySize, b.ValueSize)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if b.perCPU {
+		return errors.Errorf("batch update of per-CPU map %s is not supported", b.versionedName())
+	}
+	if b.writesObserved() {
+		return b.updateEach(keys, values)
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.frozen) != 0 {
+		return b.frozenErr()
+	}
+
+	packedKeys := make([]byte, 0, len(keys)*b.KeySize)
+	packedValues := make([]byte, 0, len(values)*b.ValueSize)
+	for i := range keys {
+		packedKeys = append(packedKeys, keys[i]...)
+		packedValues = append(packedValues, values[i]...)
+	}
+
+	b.swapLock.RLock()
+	n, err := UpdateMapBatch(b.fd, packedKeys, packedValues, len(keys))
+	b.swapLock.RUnlock()
+	for _, k := range keys {
+		b.InvalidateCache(k)
+	}
+	if n == 0 && isBatchUnsupported(err) {
+		logrus.WithError(err).WithField("name", b.versionedName()).Debug(
+			"Batch update not supported, falling back to one update per entry")
+		return b.updateEach(keys, values)
+	}
+	if err != nil {
+		return errors.WithMessagef(b.checkFrozen(b.checkMapFull(err)),
+			"batch update of map %s failed after %d of %d entries", b.versionedName(), n, len(keys))
+	}
+	return nil
+}
+
+func (b *PinnedMap) updateEach(keys, values [][]byte) error {
+	for i := range keys {
+		if err := b.Update(keys[i], values[i]); err != nil {
+			return errors.WithMessagef(err, "failed to update entry %d", i)
+		}
+	}
+	return nil
+}
+
+const (
+	// deleteBatchChunkSize is the number of keys that DeleteAsync deletes with each batch.
+	deleteBatchChunkSize = 1024
+	// maxAsyncDeletes is the number of DeleteAsync calls, across all maps, that may be deleting
+	// at once; further calls wait for one of them to finish.
+	maxAsyncDeletes = 4
+)
+
+// asyncDeleteSlots is a semaphore that limits the number of running DeleteAsync calls.
+var asyncDeleteSlots = make(chan struct{}, maxAsyncDeletes)
+
+// DeleteAsync deletes the given keys on a background goroutine, so that the caller isn't blocked
+// while a large set of entries is expired.  Keys that don't exist are ignored.  The keys are
+// deleted in chunks, using BPF_MAP_DELETE_BATCH if the kernel and map type support it and one
+// delete per key if not.  To avoid flooding the kernel, only a few calls to DeleteAsync, across
+// all maps, do their deletions at once; the others queue.
+//
+// The returned channel receives exactly one value, nil or the first error (after which the
+// remaining keys are not deleted), and is then closed.  The channel is buffered so the caller can
+// wait on it or ignore it; either way, the goroutine exits once the deletions are done.  The
+// caller must not modify keys, or the slices in it, until then.
+func (b *PinnedMap) DeleteAsync(keys [][]byte) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+		asyncDeleteSlots <- struct{}{}
+		defer func() {
+			<-asyncDeleteSlots
+		}()
+
+		var err error
+		for start := 0; start < len(keys) && err == nil; start += deleteBatchChunkSize {
+			end := start + deleteBatchChunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			err = b.deleteBatch(keys[start:end])
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("name", b.versionedName()).Warn("Asynchronous delete failed")
+		}
+		result <- err
+	}()
+	return result
+}
+
+// deleteBatch deletes the given keys, ignoring any that don't exist, with BPF_MAP_DELETE_BATCH if
+// possible, falling back to one delete per key.  Like Delete, it fails with ErrMapFrozen on a
+// frozen map and, if the context's OnMutate hook or history is enabled, deletes one key at a time
+// so that each delete is seen.
+func (b *PinnedMap) deleteBatch(keys [][]byte) error {
+	for i, k := range keys {
+		if len(k) != b.KeySize {
+			return errors.Errorf("key %d has wrong size (%d), expected %d", i, len(k), b.KeySize)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if b.writesObserved() || b.context.backend() == BackendBPFTool {
+		// Delete fires the hook, records the history and honours the backend.
+		return b.deleteEach(keys)
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.frozen) != 0 {
+		return b.frozenErr()
+	}
+	defer func() {
+		for _, k := range keys {
+			b.InvalidateCache(k)
+		}
+	}()
+
+	packed := make([]byte, 0, len(keys)*b.KeySize)
+	for _, k := range keys {
+		packed = append(packed, k...)
+	}
+	deleted := 0
+	for deleted < len(keys) {
+		b.swapLock.RLock()
+		n, err := DeleteMapBatch(b.fd, packed[deleted*b.KeySize:], len(keys)-deleted)
+		b.swapLock.RUnlock()
+		if isBatchUnsupported(err) {
+			// The count isn't updated if the command itself isn't supported, so start again from
+			// the first key of this attempt; deleting a key twice is harmless.
+			logrus.WithError(err).WithField("name", b.versionedName()).Debug(
+				"Batch delete not supported, falling back to one delete per key")
+			return b.deleteEach(keys[deleted:])
+		}
+		deleted += n
+		if err == unix.ENOENT {
+			// The kernel stopped at a key that doesn't exist; skip it.
+			deleted++
+			continue
+		}
+		if err != nil {
+			return errors.WithMessagef(b.checkFrozen(err),
+				"batch delete from map %s failed after %d of %d keys", b.versionedName(), deleted, len(keys))
+		}
+		break
+	}
+	return nil
+}
+
+func (b *PinnedMap) deleteEach(keys [][]byte) error {
+	for i, k := range keys {
+		if err := b.Delete(k); err != nil && err != ErrKeyNotExist {
+			return errors.WithMessagef(err, "failed to delete key %d", i)
+		}
+	}
+	return nil
+}
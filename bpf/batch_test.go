@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeBatchMap emulates BPF_MAP_LOOKUP_BATCH over n entries.  The token is the index of the
+// next entry.  If bucketSize is set, batches must hold at least that many entries or the
+// lookup fails with ENOSPC, like a hash map bucket.
+type fakeBatchMap struct {
+	n, keySize, valueSize, bucketSize int
+	calls                             int
+}
+
+func (m *fakeBatchMap) lookup(inBatch []byte, count int) ([]byte, []byte, int, []byte, error) {
+	m.calls++
+	if count < m.bucketSize {
+		return nil, nil, 0, nil, unix.ENOSPC
+	}
+	start := 0
+	if inBatch != nil {
+		start = int(binary.LittleEndian.Uint32(inBatch))
+	}
+	keys := make([]byte, m.keySize*count)
+	values := make([]byte, m.valueSize*count)
+	n := 0
+	for i := start; i < m.n && n < count; i++ {
+		binary.LittleEndian.PutUint32(keys[n*m.keySize:], uint32(i))
+		values[n*m.valueSize] = byte(i)
+		n++
+	}
+	if start+n >= m.n {
+		return keys, values, n, nil, nil
+	}
+	next := make([]byte, 4)
+	binary.LittleEndian.PutUint32(next, uint32(start+n))
+	return keys, values, n, next, nil
+}
+
+func TestBatchSizer(t *testing.T) {
+	// Small values start with a page-sized buffer and grow to the cap.
+	s := newBatchSizer(4, 4, 1000000, 4096*4)
+	if s.count != 512 || s.maxCount != 2048 {
+		t.Fatalf("unexpected sizer %+v", *s)
+	}
+	s.observe(100)
+	if s.count != 512 {
+		t.Errorf("a partial batch shouldn't grow the buffer, got %d", s.count)
+	}
+	for i := 0; i < 5; i++ {
+		s.observe(s.count)
+	}
+	if s.count != 2048 {
+		t.Errorf("expected full batches to grow the buffer to the cap, got %d", s.count)
+	}
+
+	// Huge values still get at least one entry; small maps never exceed their size.
+	if s := newBatchSizer(4, 1<<21, 100, 0); s.count != 1 || s.maxCount != 1 {
+		t.Errorf("unexpected sizer for huge values %+v", *s)
+	}
+	if s := newBatchSizer(4, 4, 10, 0); s.count != 10 || s.maxCount != 10 {
+		t.Errorf("unexpected sizer for a small map %+v", *s)
+	}
+}
+
+func TestIterBatch(t *testing.T) {
+	m := &fakeBatchMap{n: 1000, keySize: 4, valueSize: 8, bucketSize: 600}
+	seen := map[uint32]bool{}
+	err := iterBatch(m.lookup, 4, 8, newBatchSizer(4, 8, 1000, 0), func(k, v []byte) {
+		i := binary.LittleEndian.Uint32(k)
+		if v[0] != byte(i) {
+			t.Errorf("unexpected value for key %d: %v", i, v)
+		}
+		seen[i] = true
+	})
+	if err != nil {
+		t.Fatalf("iterBatch failed: %v", err)
+	}
+	if len(seen) != 1000 {
+		t.Errorf("expected 1000 entries, saw %d", len(seen))
+	}
+
+	// A bucket that can never fit in a batch is an error rather than an infinite loop.
+	m = &fakeBatchMap{n: 10, keySize: 4, valueSize: 8, bucketSize: 20}
+	err = iterBatch(m.lookup, 4, 8, newBatchSizer(4, 8, 16, 0), func(k, v []byte) {})
+	if err == nil {
+		t.Error("expected an error for an oversized bucket")
+	}
+}
+
+// BenchmarkIterBatch compares the adaptive batch size against a fixed 256-entry batch across
+// value sizes.  The adaptive sizer allocates less for small maps and large values and makes
+// fewer lookups for large maps with small values.
+func BenchmarkIterBatch(b *testing.B) {
+	for _, entries := range []int{100, 100000} {
+		for _, valueSize := range []int{8, 256, 4096} {
+			for _, adaptive := range []bool{false, true} {
+				name := fmt.Sprintf("entries=%d/value=%d/adaptive=%v", entries, valueSize, adaptive)
+				b.Run(name, func(b *testing.B) {
+					m := &fakeBatchMap{n: entries, keySize: 4, valueSize: valueSize}
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						sizer := &batchSizer{count: 256, maxCount: 256}
+						if adaptive {
+							sizer = newBatchSizer(4, valueSize, entries, 0)
+						}
+						if err := iterBatch(m.lookup, 4, valueSize, sizer, func(k, v []byte) {}); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(m.calls)/float64(b.N), "lookups/op")
+				})
+			}
+		}
+	}
+}
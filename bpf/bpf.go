@@ -285,7 +285,7 @@ func isBPF(path string) (bool, error) {
 	bpffsMagicNumber := uint32(0xCAFE4A11)
 
 	var fsdata unix.Statfs_t
-	if err := unix.Statfs(path, &fsdata); err != nil {
+	if err := statfs(path, &fsdata); err != nil {
 		return false, fmt.Errorf("%s is not mounted", path)
 	}
 
@@ -296,14 +296,15 @@ func isCgroupV2(path string) (bool, error) {
 	cgroup2MagicNumber := uint32(0x63677270)
 
 	var fsdata unix.Statfs_t
-	if err := unix.Statfs(path, &fsdata); err != nil {
+	if err := statfs(path, &fsdata); err != nil {
 		return false, fmt.Errorf("%s is not mounted", path)
 	}
 
 	return uint32(fsdata.Type) == cgroup2MagicNumber, nil
 }
 
-func mountBPFfs(path string) error {
+// mountBPFfs is a var so that tests can mock it.
+var mountBPFfs = func(path string) error {
 	return syscall.Mount(path, path, "bpf", 0, "")
 }
 
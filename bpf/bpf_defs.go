@@ -45,9 +45,20 @@ type ProgResult struct {
 }
 
 type MapInfo struct {
-	Type      int
-	KeySize   int
-	ValueSize int
+	ID         int
+	Type       int
+	KeySize    int
+	ValueSize  int
+	MaxEntries int
+	// Name is the map's name as stored by the kernel, which truncates names to
+	// BPF_OBJ_NAME_LEN-1 characters.  It is empty if the map has no name or the name couldn't be
+	// read.
+	Name string
+	// Flags are the flags that the map was created with (BPF_F_*).
+	Flags uint32
+	// Frozen is true if the map has been frozen with BPF_MAP_FREEZE.  The kernel's map info
+	// doesn't include it so it is read from fdinfo.
+	Frozen bool
 }
 
 const ObjectDir = "/usr/lib/calico/bpf"
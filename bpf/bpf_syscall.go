@@ -20,6 +20,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/bpf/asm"
@@ -52,6 +53,11 @@ import (
 //    attr->open_flags = flags;
 // }
 //
+// // bpf_attr_setup_map_freeze sets up the bpf_attr union for use with BPF_MAP_FREEZE.
+// void bpf_attr_setup_map_freeze(union bpf_attr *attr, __u32 map_fd) {
+//    attr->map_fd = map_fd;
+// }
+//
 // // bpf_attr_setup_obj_pin sets up the bpf_attr union for use with BPF_OBJ_PIN.
 // // A C function makes this easier because unions aren't easy to access from Go.
 // void bpf_attr_setup_obj_pin(union bpf_attr *attr, char *path, __u32 fd, __u32 flags) {
@@ -60,6 +66,20 @@ import (
 //    attr->file_flags = flags;
 // }
 //
+// // bpf_attr_setup_map_create sets up the bpf_attr union for use with BPF_MAP_CREATE.
+// // A C function makes this easier because unions aren't easy to access from Go.
+// void bpf_attr_setup_map_create(union bpf_attr *attr, __u32 map_type, __u32 key_size,
+//                                __u32 value_size, __u32 max_entries, __u32 flags,
+//                                char *name, __u32 inner_map_fd) {
+//    attr->map_type = map_type;
+//    attr->key_size = key_size;
+//    attr->value_size = value_size;
+//    attr->max_entries = max_entries;
+//    attr->map_flags = flags;
+//    attr->inner_map_fd = inner_map_fd;
+//    strncpy(attr->map_name, name, BPF_OBJ_NAME_LEN - 1);
+// }
+//
 // // bpf_attr_setup_map_elem sets up the bpf_attr union for use with BPF_MAP_GET|UPDATE|DELETE_ELEM.
 // // A C function makes this easier because unions aren't easy to access from Go.
 // void bpf_attr_setup_map_elem(union bpf_attr *attr, __u32 map_fd, void *pointer_to_key, void *pointer_to_value, __u64 flags) {
@@ -106,6 +126,23 @@ import (
 //    attr->info.info = (__u64)(unsigned long)info;
 // }
 //
+// // bpf_attr_setup_map_batch sets up the bpf_attr union for use with
+// // BPF_MAP_LOOKUP|UPDATE|DELETE_BATCH.
+// // A C function makes this easier because unions aren't easy to access from Go.
+// void bpf_attr_setup_map_batch(union bpf_attr *attr, __u32 map_fd, void *in_batch,
+//                               void *out_batch, void *keys, void *values, __u32 count) {
+//    attr->batch.map_fd = map_fd;
+//    attr->batch.in_batch = (__u64)(unsigned long)in_batch;
+//    attr->batch.out_batch = (__u64)(unsigned long)out_batch;
+//    attr->batch.keys = (__u64)(unsigned long)keys;
+//    attr->batch.values = (__u64)(unsigned long)values;
+//    attr->batch.count = count;
+// }
+//
+// __u32 bpf_attr_batch_count(union bpf_attr *attr) {
+//    return attr->batch.count;
+// }
+//
 // __u32 bpf_attr_prog_run_retval(union bpf_attr *attr) {
 //    return attr->test.retval;
 // }
@@ -242,6 +279,59 @@ func PinBPFProgram(fd ProgFD, filename string) error {
 	return nil
 }
 
+// CreateMap creates a map with the given parameters using the BPF_MAP_CREATE syscall.  The map is
+// not pinned, see PinBPFMap.  If the parameters include an inner map, a template inner map is
+// created and then closed once the outer map exists.
+func CreateMap(params MapParameters) (MapFD, error) {
+	log.Debugf("CreateMap(%v)", params.versionedName())
+	mapType, ok := MapTypeID(params.Type)
+	if !ok {
+		return 0, errors.Errorf("unknown map type %q", params.Type)
+	}
+	increaseLockedMemoryQuota()
+
+	var innerFD MapFD
+	if params.InnerMap != nil {
+		var err error
+		innerFD, err = CreateMap(*params.InnerMap)
+		if err != nil {
+			return 0, errors.WithMessage(err, "failed to create inner map template")
+		}
+		defer innerFD.Close()
+	}
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	cName := C.CString(params.versionedName())
+	defer C.free(unsafe.Pointer(cName))
+
+	C.bpf_attr_setup_map_create(bpfAttr, C.uint(mapType), C.uint(params.KeySize), C.uint(params.ValueSize),
+		C.uint(params.MaxEntries), C.uint(params.Flags), cName, C.uint(innerFD))
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_CREATE, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return MapFD(fd), nil
+}
+
+func PinBPFMap(fd MapFD, filename string) error {
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	cFilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cFilename))
+
+	C.bpf_attr_setup_obj_pin(bpfAttr, cFilename, C.uint(fd), 0)
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_OBJ_PIN, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
 func UpdateMapEntry(mapFD MapFD, k, v []byte) error {
 	log.Debugf("UpdateMapEntry(%v, %v, %v)", mapFD, k, v)
 
@@ -250,6 +340,36 @@ func UpdateMapEntry(mapFD MapFD, k, v []byte) error {
 		return err
 	}
 
+	return updateMapEntry(mapFD, k, v, unix.BPF_ANY)
+}
+
+// UpdateMapEntryWithFlags updates an entry in a map, passing the given flags (for example,
+// unix.BPF_EXIST or unix.BPF_NOEXIST) to the kernel.
+func UpdateMapEntryWithFlags(mapFD MapFD, k, v []byte, flags int) error {
+	log.Debugf("UpdateMapEntryWithFlags(%v, %v, %v, %v)", mapFD, k, v, flags)
+
+	err := checkMapIfDebug(mapFD, len(k), len(v))
+	if err != nil {
+		return err
+	}
+
+	return updateMapEntry(mapFD, k, v, flags)
+}
+
+// UpdatePerCPUMapEntry updates an entry in a per-CPU map.  v must contain one value of valueSize
+// bytes for each possible CPU, each starting at a multiple of valueSize rounded up to 8 bytes.
+func UpdatePerCPUMapEntry(mapFD MapFD, k, v []byte, valueSize int) error {
+	log.Debugf("UpdatePerCPUMapEntry(%v, %v, %v, %v)", mapFD, k, v, valueSize)
+
+	err := checkMapIfDebug(mapFD, len(k), valueSize)
+	if err != nil {
+		return err
+	}
+
+	return updateMapEntry(mapFD, k, v, unix.BPF_ANY)
+}
+
+func updateMapEntry(mapFD MapFD, k, v []byte, flags int) error {
 	bpfAttr := C.bpf_attr_alloc()
 	defer C.free(unsafe.Pointer(bpfAttr))
 
@@ -258,9 +378,9 @@ func UpdateMapEntry(mapFD MapFD, k, v []byte) error {
 	cV := C.CBytes(v)
 	defer C.free(cV)
 
-	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cV, unix.BPF_ANY)
+	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cV, C.ulonglong(flags))
 
-	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_UPDATE_ELEM, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	_, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(bpfAttr), C.sizeof_union_bpf_attr)
 
 	if errno != 0 {
 		return errno
@@ -276,6 +396,30 @@ func GetMapEntry(mapFD MapFD, k []byte, valueSize int) ([]byte, error) {
 		return nil, err
 	}
 
+	return getMapEntry(mapFD, k, valueSize)
+}
+
+// GetPerCPUMapEntry looks up an entry in a per-CPU map.  It returns a buffer containing the
+// values for all possible CPUs.  The kernel aligns each CPU's value to 8 bytes so the buffer is
+// numCPUs * (valueSize rounded up to 8) bytes in total.
+func GetPerCPUMapEntry(mapFD MapFD, k []byte, valueSize, numCPUs int) ([]byte, error) {
+	log.Debugf("GetPerCPUMapEntry(%v, %v, %v, %v)", mapFD, k, valueSize, numCPUs)
+
+	err := checkMapIfDebug(mapFD, len(k), valueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return getMapEntry(mapFD, k, perCPUValueStride(valueSize)*numCPUs)
+}
+
+func getMapEntry(mapFD MapFD, k []byte, valueSize int) ([]byte, error) {
+	return getMapEntryWithFlags(mapFD, k, valueSize, unix.BPF_ANY)
+}
+
+// getMapEntryWithFlags looks up an entry, passing the given lookup flags (for example,
+// BPF_F_LOCK).
+func getMapEntryWithFlags(mapFD MapFD, k []byte, valueSize int, flags int) ([]byte, error) {
 	bpfAttr := C.bpf_attr_alloc()
 	defer C.free(unsafe.Pointer(bpfAttr))
 
@@ -286,9 +430,9 @@ func GetMapEntry(mapFD MapFD, k []byte, valueSize int) ([]byte, error) {
 	cV := C.malloc(C.size_t(valueSize))
 	defer C.free(cV)
 
-	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cV, unix.BPF_ANY)
+	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cV, C.ulonglong(flags))
 
-	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_LOOKUP_ELEM, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	_, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(bpfAttr), C.sizeof_union_bpf_attr)
 
 	v := C.GoBytes(cV, C.int(valueSize))
 
@@ -298,6 +442,143 @@ func GetMapEntry(mapFD MapFD, k []byte, valueSize int) ([]byte, error) {
 	return v, nil
 }
 
+// GetMapNextKey returns the key that follows k in the map, or the first key if k is nil.  It
+// returns an ENOENT error once there are no more keys.
+func GetMapNextKey(mapFD MapFD, k []byte, keySize int) ([]byte, error) {
+	log.Debugf("GetMapNextKey(%v, %v, %v)", mapFD, k, keySize)
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	var cK unsafe.Pointer
+	if k != nil {
+		cK = C.CBytes(k)
+		defer C.free(cK)
+	}
+	cNext := C.malloc(C.size_t(keySize))
+	defer C.free(cNext)
+
+	// The next_key field shares its position in the union with the value field.
+	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cNext, 0)
+
+	_, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(bpfAttr), C.sizeof_union_bpf_attr)
+
+	if errno != 0 {
+		return nil, errno
+	}
+	return C.GoBytes(cNext, C.int(keySize)), nil
+}
+
+// LookupMapBatch reads up to count entries from the map with BPF_MAP_LOOKUP_BATCH, starting from
+// the position given by inBatch, which should be nil for the start of the map.  The keys and
+// values are returned packed back to back.  next is the token to pass as inBatch to continue;
+// it is nil once the end of the map has been reached, in which case the final batch may still
+// contain entries.  For hash maps, ENOSPC means that count was too small to hold a whole bucket.
+func LookupMapBatch(mapFD MapFD, inBatch []byte, keySize, valueSize, count int) (keys, values []byte, n int, next []byte, err error) {
+	log.Debugf("LookupMapBatch(%v, %v, %v, %v, %v)", mapFD, inBatch, keySize, valueSize, count)
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	var cIn unsafe.Pointer
+	if inBatch != nil {
+		cIn = C.CBytes(inBatch)
+		defer C.free(cIn)
+	}
+	// Hash maps use a 32-bit bucket index as the batch token, other maps use a key.
+	tokenSize := keySize
+	if tokenSize < 4 {
+		tokenSize = 4
+	}
+	cOut := C.malloc(C.size_t(tokenSize))
+	defer C.free(cOut)
+	cKeys := C.malloc(C.size_t(keySize * count))
+	defer C.free(cKeys)
+	cValues := C.malloc(C.size_t(valueSize * count))
+	defer C.free(cValues)
+
+	C.bpf_attr_setup_map_batch(bpfAttr, C.uint(mapFD), cIn, cOut, cKeys, cValues, C.uint(count))
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, C.BPF_MAP_LOOKUP_BATCH, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+
+	if errno != 0 && errno != unix.ENOENT {
+		return nil, nil, 0, nil, errno
+	}
+	n = int(C.bpf_attr_batch_count(bpfAttr))
+	keys = C.GoBytes(cKeys, C.int(keySize*n))
+	values = C.GoBytes(cValues, C.int(valueSize*n))
+	if errno == 0 {
+		next = C.GoBytes(cOut, C.int(tokenSize))
+	}
+	return keys, values, n, next, nil
+}
+
+// UpdateMapBatch writes count entries to the map with BPF_MAP_UPDATE_BATCH.  keys and values
+// hold the keys and values packed back to back.  It returns the number of entries that were
+// written, which is less than count if there was an error.  It requires kernel v5.6+.
+func UpdateMapBatch(mapFD MapFD, keys, values []byte, count int) (int, error) {
+	log.Debugf("UpdateMapBatch(%v, %v, %v, %v)", mapFD, keys, values, count)
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	cKeys := C.CBytes(keys)
+	defer C.free(cKeys)
+	cValues := C.CBytes(values)
+	defer C.free(cValues)
+
+	C.bpf_attr_setup_map_batch(bpfAttr, C.uint(mapFD), nil, nil, cKeys, cValues, C.uint(count))
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, C.BPF_MAP_UPDATE_BATCH, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+
+	n := int(C.bpf_attr_batch_count(bpfAttr))
+	if errno != 0 {
+		return n, errno
+	}
+	return n, nil
+}
+
+// DeleteMapBatch deletes count keys, packed back to back in keys, from the map with
+// BPF_MAP_DELETE_BATCH.  It returns the number of keys that were deleted; the kernel stops at the
+// first key that fails so, for example, if the error is ENOENT, the key at that index didn't
+// exist.  It requires kernel v5.6+.
+func DeleteMapBatch(mapFD MapFD, keys []byte, count int) (int, error) {
+	log.Debugf("DeleteMapBatch(%v, %v, %v)", mapFD, keys, count)
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	cKeys := C.CBytes(keys)
+	defer C.free(cKeys)
+
+	C.bpf_attr_setup_map_batch(bpfAttr, C.uint(mapFD), nil, nil, cKeys, nil, C.uint(count))
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, C.BPF_MAP_DELETE_BATCH, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+
+	n := int(C.bpf_attr_batch_count(bpfAttr))
+	if errno != 0 {
+		return n, errno
+	}
+	return n, nil
+}
+
+// FreezeMap makes the map read-only from userspace with BPF_MAP_FREEZE; BPF programs can still
+// write to it.  Freezing can't be undone.  It requires kernel v5.2+.
+func FreezeMap(mapFD MapFD) error {
+	log.Debugf("FreezeMap(%v)", mapFD)
+
+	bpfAttr := C.bpf_attr_alloc()
+	defer C.free(unsafe.Pointer(bpfAttr))
+
+	C.bpf_attr_setup_map_freeze(bpfAttr, C.uint(mapFD))
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, C.BPF_MAP_FREEZE, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func checkMapIfDebug(mapFD MapFD, keySize, valueSize int) error {
 	if log.GetLevel() >= log.DebugLevel {
 		mapInfo, err := GetMapInfo(mapFD)
@@ -329,14 +610,27 @@ func GetMapInfo(fd MapFD) (*MapInfo, error) {
 		return nil, errno
 	}
 	return &MapInfo{
-		Type:      int(bpfMapInfo._type),
-		KeySize:   int(bpfMapInfo.key_size),
-		ValueSize: int(bpfMapInfo.value_size),
+		ID:         int(bpfMapInfo.id),
+		Type:       int(bpfMapInfo._type),
+		KeySize:    int(bpfMapInfo.key_size),
+		ValueSize:  int(bpfMapInfo.value_size),
+		MaxEntries: int(bpfMapInfo.max_entries),
+		Name:       C.GoString(&bpfMapInfo.name[0]),
+		Flags:      uint32(bpfMapInfo.map_flags),
 	}, nil
 }
 
 func DeleteMapEntry(mapFD MapFD, k []byte, valueSize int) error {
-	log.Debugf("GetMapEntry(%v, %v, %v)", mapFD, k, valueSize)
+	err := deleteMapEntry(mapFD, k, valueSize)
+	if err != nil && !IsNotExists(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteMapEntry is like DeleteMapEntry but it returns ENOENT if the key wasn't in the map.
+func deleteMapEntry(mapFD MapFD, k []byte, valueSize int) error {
+	log.Debugf("DeleteMapEntry(%v, %v, %v)", mapFD, k, valueSize)
 
 	err := checkMapIfDebug(mapFD, len(k), valueSize)
 	if err != nil {
@@ -350,14 +644,13 @@ func DeleteMapEntry(mapFD MapFD, k []byte, valueSize int) error {
 	// intermediate struct.
 	cK := C.CBytes(k)
 	defer C.free(cK)
-	cV := C.malloc(C.size_t(valueSize))
-	defer C.free(cV)
 
-	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, cV, unix.BPF_ANY)
+	// The kernel rejects BPF_MAP_DELETE_ELEM with EINVAL if the value field is set.
+	C.bpf_attr_setup_map_elem(bpfAttr, C.uint(mapFD), cK, nil, unix.BPF_ANY)
 
-	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_DELETE_ELEM, uintptr(unsafe.Pointer(bpfAttr)), C.sizeof_union_bpf_attr)
+	_, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(bpfAttr), C.sizeof_union_bpf_attr)
 
-	if errno != 0 && !IsNotExists(errno) {
+	if errno != 0 {
 		return errno
 	}
 	return nil
@@ -48,10 +48,54 @@ func UpdateMapEntry(mapFD MapFD, k, v []byte) error {
 	panic("BPF syscall stub")
 }
 
+func UpdateMapEntryWithFlags(mapFD MapFD, k, v []byte, flags int) error {
+	panic("BPF syscall stub")
+}
+
+func UpdatePerCPUMapEntry(mapFD MapFD, k, v []byte, valueSize int) error {
+	panic("BPF syscall stub")
+}
+
 func GetMapEntry(mapFD MapFD, k []byte, valueSize int) ([]byte, error) {
 	panic("BPF syscall stub")
 }
 
+func getMapEntryWithFlags(mapFD MapFD, k []byte, valueSize int, flags int) ([]byte, error) {
+	panic("BPF syscall stub")
+}
+
+func GetPerCPUMapEntry(mapFD MapFD, k []byte, valueSize, numCPUs int) ([]byte, error) {
+	panic("BPF syscall stub")
+}
+
+func CreateMap(params MapParameters) (MapFD, error) {
+	panic("BPF syscall stub")
+}
+
+func PinBPFMap(fd MapFD, filename string) error {
+	panic("BPF syscall stub")
+}
+
+func GetMapNextKey(mapFD MapFD, k []byte, keySize int) ([]byte, error) {
+	panic("BPF syscall stub")
+}
+
+func LookupMapBatch(mapFD MapFD, inBatch []byte, keySize, valueSize, count int) (keys, values []byte, n int, next []byte, err error) {
+	panic("BPF syscall stub")
+}
+
+func UpdateMapBatch(mapFD MapFD, keys, values []byte, count int) (int, error) {
+	panic("BPF syscall stub")
+}
+
+func DeleteMapBatch(mapFD MapFD, keys []byte, count int) (int, error) {
+	panic("BPF syscall stub")
+}
+
+func FreezeMap(mapFD MapFD) error {
+	panic("BPF syscall stub")
+}
+
 func GetMapInfo(fd MapFD) (*MapInfo, error) {
 	panic("BPF syscall stub")
 }
@@ -59,3 +103,7 @@ func GetMapInfo(fd MapFD) (*MapInfo, error) {
 func DeleteMapEntry(mapFD MapFD, k []byte, valueSize int) error {
 	panic("BPF syscall stub")
 }
+
+func deleteMapEntry(mapFD MapFD, k []byte, valueSize int) error {
+	panic("BPF syscall stub")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// statfs is a var so that tests can fake the filesystem type.
+var statfs = unix.Statfs
+
+// bpffsRoot returns the context's BPFFSRoot, defaulting to /sys/fs/bpf.
+func (c *MapContext) bpffsRoot() string {
+	if c == nil || c.BPFFSRoot == "" {
+		return defaultBPFfsPath
+	}
+	return filepath.Clean(c.BPFFSRoot)
+}
+
+// MaybeMountBPFfs is like the package-level MaybeMountBPFfs, but uses the context's BPFFSRoot.
+// Unlike the default root, a custom root has no fallback: if something other than a BPF
+// filesystem is mounted there, it returns an error.
+func (c *MapContext) MaybeMountBPFfs() (string, error) {
+	root := c.bpffsRoot()
+	if root == defaultBPFfsPath {
+		return MaybeMountBPFfs()
+	}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+	mnt, err := isMount(root)
+	if err != nil {
+		return "", err
+	}
+	if !mnt {
+		if err := mountBPFfs(root); err != nil {
+			return "", err
+		}
+	}
+	fsBPF, err := isBPF(root)
+	if err != nil {
+		return "", err
+	}
+	if !fsBPF {
+		return "", fmt.Errorf("%s is not a BPF filesystem", root)
+	}
+	return root, nil
+}
+
+// rebasePinPath moves path, if it is under /sys/fs/bpf, to the same place under the context's
+// BPFFSRoot.  Other paths are returned unchanged.
+func (c *MapContext) rebasePinPath(path string) string {
+	root := c.bpffsRoot()
+	if root == defaultBPFfsPath || path == "" {
+		return path
+	}
+	rel, err := filepath.Rel(defaultBPFfsPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join(root, rel)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// mockBPFFS makes statfs report fsType for every path and records the paths that get mounted.
+// The returned function restores the real implementations.
+func mockBPFFS(fsType int64, mounted *[]string) func() {
+	origStatfs, origMount := statfs, mountBPFfs
+	statfs = func(path string, buf *unix.Statfs_t) error {
+		buf.Type = fsType
+		return nil
+	}
+	mountBPFfs = func(path string) error {
+		*mounted = append(*mounted, path)
+		return nil
+	}
+	return func() {
+		statfs, mountBPFfs = origStatfs, origMount
+	}
+}
+
+func TestBPFFSRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpffs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "bpf")
+
+	var mounted []string
+	restore := mockBPFFS(0xCAFE4A11, &mounted)
+	defer restore()
+
+	c := &MapContext{BPFFSRoot: root}
+	got, err := c.MaybeMountBPFfs()
+	if err != nil || got != root {
+		t.Fatalf("MaybeMountBPFfs() = %q, %v; expected %q", got, err, root)
+	}
+	if len(mounted) != 1 || mounted[0] != root {
+		t.Errorf("expected %s to be mounted, got %v", root, mounted)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("expected root to be created: %v", err)
+	}
+
+	m := c.newPinnedMap(c.withPrefixes(MapParameters{
+		Filename: "/sys/fs/bpf/tc/globals/cali_foo",
+		Name:     "cali_foo",
+	}))
+	if expected := filepath.Join(root, "tc/globals/cali_foo"); m.Filename != expected {
+		t.Errorf("expected pin path %s, got %s", expected, m.Filename)
+	}
+	other := c.withPrefixes(MapParameters{Filename: "/sys/fs/bpfx/cali_foo", Name: "cali_foo"})
+	if other.Filename != "/sys/fs/bpfx/cali_foo" {
+		t.Errorf("expected path outside /sys/fs/bpf to be unchanged, got %s", other.Filename)
+	}
+
+	// Only the default root is used when BPFFSRoot isn't set.
+	if p := (&MapContext{}).rebasePinPath("/sys/fs/bpf/tc/globals/cali_foo"); p != "/sys/fs/bpf/tc/globals/cali_foo" {
+		t.Errorf("expected default pin path, got %s", p)
+	}
+}
+
+func TestBPFFSRootNotBPF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpffs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mounted []string
+	restore := mockBPFFS(0x01021994 /* tmpfs */, &mounted)
+	defer restore()
+
+	c := &MapContext{BPFFSRoot: dir}
+	if _, err := c.MaybeMountBPFfs(); err == nil {
+		t.Error("expected an error for a root that isn't a BPF filesystem")
+	}
+}
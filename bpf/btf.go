@@ -0,0 +1,399 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal decoder for BTF (BPF Type Format) blobs, sufficient to pretty-print map values made
+// up of integers, enums, arrays and (nested) structs and unions, without needing the kernel or
+// bpftool to have the BTF.  See Documentation/bpf/btf.rst in the kernel for the format.
+
+const (
+	btfMagic = 0xeb9f
+
+	btfKindInt       = 1
+	btfKindPtr       = 2
+	btfKindArray     = 3
+	btfKindStruct    = 4
+	btfKindUnion     = 5
+	btfKindEnum      = 6
+	btfKindFwd       = 7
+	btfKindTypedef   = 8
+	btfKindVolatile  = 9
+	btfKindConst     = 10
+	btfKindRestrict  = 11
+	btfKindFunc      = 12
+	btfKindFuncProto = 13
+	btfKindVar       = 14
+	btfKindDatasec   = 15
+	btfKindFloat     = 16
+	btfKindDeclTag   = 17
+	btfKindTypeTag   = 18
+	btfKindEnum64    = 19
+
+	btfIntSigned = 1 << 0
+	btfIntBool   = 1 << 2
+)
+
+type btfType struct {
+	name string
+	kind int
+	// size is the size in bytes for ints, structs, unions and enums; for the other kinds it is
+	// the ID of the referenced type.
+	size uint32
+
+	intEncoding uint8
+	intBits     uint32
+
+	arrayElem   uint32
+	arrayLength uint32
+
+	members  []btfMember
+	enumVals []btfEnumVal
+	secVars  []btfSecVar
+}
+
+type btfMember struct {
+	name         string
+	typeID       uint32
+	bitOffset    uint32
+	bitfieldSize uint32
+}
+
+type btfSecVar struct {
+	typeID uint32
+	offset uint32
+	size   uint32
+}
+
+type btfEnumVal struct {
+	name  string
+	value int64
+}
+
+type btfSpec struct {
+	// types is indexed by type ID; ID 0 is void.
+	types []btfType
+}
+
+func parseBTF(data []byte) (*btfSpec, error) {
+	var bo binary.ByteOrder = binary.LittleEndian
+	if len(data) < 24 {
+		return nil, errors.New("BTF blob too short for header")
+	}
+	if binary.BigEndian.Uint16(data) == btfMagic {
+		bo = binary.BigEndian
+	} else if binary.LittleEndian.Uint16(data) != btfMagic {
+		return nil, errors.New("bad BTF magic")
+	}
+	hdrLen := bo.Uint32(data[4:])
+	typeOff, typeLen := bo.Uint32(data[8:]), bo.Uint32(data[12:])
+	strOff, strLen := bo.Uint32(data[16:]), bo.Uint32(data[20:])
+	if uint64(hdrLen)+uint64(typeOff)+uint64(typeLen) > uint64(len(data)) ||
+		uint64(hdrLen)+uint64(strOff)+uint64(strLen) > uint64(len(data)) {
+		return nil, errors.New("BTF sections overrun blob")
+	}
+	typeData := data[hdrLen+typeOff : hdrLen+typeOff+typeLen]
+	strs := data[hdrLen+strOff : hdrLen+strOff+strLen]
+	str := func(off uint32) (string, error) {
+		if off >= uint32(len(strs)) {
+			return "", errors.Errorf("BTF string offset %d out of range", off)
+		}
+		end := bytes.IndexByte(strs[off:], 0)
+		if end < 0 {
+			return "", errors.New("unterminated BTF string")
+		}
+		return string(strs[off : off+uint32(end)]), nil
+	}
+
+	spec := &btfSpec{types: []btfType{{}}}
+	for len(typeData) > 0 {
+		if len(typeData) < 12 {
+			return nil, errors.New("truncated BTF type")
+		}
+		info := bo.Uint32(typeData[4:])
+		vlen := int(info & 0xffff)
+		kindFlag := info&(1<<31) != 0
+		t := btfType{kind: int(info>>24) & 0x1f, size: bo.Uint32(typeData[8:])}
+		var err error
+		if t.name, err = str(bo.Uint32(typeData)); err != nil {
+			return nil, err
+		}
+		typeData = typeData[12:]
+
+		var extraLen int
+		switch t.kind {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			extraLen = 4
+		case btfKindArray:
+			extraLen = 12
+		case btfKindStruct, btfKindUnion, btfKindDatasec, btfKindEnum64:
+			extraLen = 12 * vlen
+		case btfKindEnum, btfKindFuncProto:
+			extraLen = 8 * vlen
+		case btfKindPtr, btfKindFwd, btfKindTypedef, btfKindVolatile, btfKindConst,
+			btfKindRestrict, btfKindFunc, btfKindFloat, btfKindTypeTag:
+		default:
+			return nil, errors.Errorf("unknown BTF kind %d", t.kind)
+		}
+		if len(typeData) < extraLen {
+			return nil, errors.New("truncated BTF type")
+		}
+		extra := typeData[:extraLen]
+		typeData = typeData[extraLen:]
+
+		switch t.kind {
+		case btfKindInt:
+			v := bo.Uint32(extra)
+			t.intEncoding = uint8(v >> 24 & 0xf)
+			t.intBits = v & 0xff
+			if v>>16&0xff != 0 {
+				return nil, errors.Errorf("unsupported BTF int %q with non-zero offset", t.name)
+			}
+		case btfKindArray:
+			t.arrayElem = bo.Uint32(extra)
+			t.arrayLength = bo.Uint32(extra[8:])
+		case btfKindStruct, btfKindUnion:
+			for i := 0; i < vlen; i++ {
+				m := btfMember{typeID: bo.Uint32(extra[12*i+4:])}
+				if m.name, err = str(bo.Uint32(extra[12*i:])); err != nil {
+					return nil, err
+				}
+				offset := bo.Uint32(extra[12*i+8:])
+				if kindFlag {
+					m.bitOffset = offset & 0xffffff
+					m.bitfieldSize = offset >> 24
+				} else {
+					m.bitOffset = offset
+				}
+				t.members = append(t.members, m)
+			}
+		case btfKindEnum:
+			for i := 0; i < vlen; i++ {
+				ev := btfEnumVal{value: int64(int32(bo.Uint32(extra[8*i+4:])))}
+				if ev.name, err = str(bo.Uint32(extra[8*i:])); err != nil {
+					return nil, err
+				}
+				t.enumVals = append(t.enumVals, ev)
+			}
+		case btfKindDatasec:
+			for i := 0; i < vlen; i++ {
+				t.secVars = append(t.secVars, btfSecVar{
+					typeID: bo.Uint32(extra[12*i:]),
+					offset: bo.Uint32(extra[12*i+4:]),
+					size:   bo.Uint32(extra[12*i+8:]),
+				})
+			}
+		}
+		spec.types = append(spec.types, t)
+	}
+	return spec, nil
+}
+
+func (s *btfSpec) typeByID(id uint32) (*btfType, error) {
+	if id == 0 || id >= uint32(len(s.types)) {
+		return nil, errors.Errorf("BTF type ID %d out of range", id)
+	}
+	return &s.types[id], nil
+}
+
+// typeByName returns the ID of the struct, union or typedef with the given name.
+func (s *btfSpec) typeByName(name string) (uint32, error) {
+	for id, t := range s.types {
+		if t.name != name {
+			continue
+		}
+		switch t.kind {
+		case btfKindStruct, btfKindUnion, btfKindTypedef, btfKindInt, btfKindEnum:
+			return uint32(id), nil
+		}
+	}
+	return 0, errors.Errorf("BTF type %q not found", name)
+}
+
+// resolve skips over typedefs and type modifiers.
+func (s *btfSpec) resolve(id uint32) (*btfType, error) {
+	for i := 0; i < 32; i++ {
+		t, err := s.typeByID(id)
+		if err != nil {
+			return nil, err
+		}
+		switch t.kind {
+		case btfKindTypedef, btfKindVolatile, btfKindConst, btfKindRestrict, btfKindTypeTag:
+			id = t.size
+		default:
+			return t, nil
+		}
+	}
+	return nil, errors.New("BTF typedef chain too long")
+}
+
+func (s *btfSpec) typeSize(id uint32) (uint32, error) {
+	t, err := s.resolve(id)
+	if err != nil {
+		return 0, err
+	}
+	switch t.kind {
+	case btfKindInt, btfKindStruct, btfKindUnion, btfKindEnum, btfKindFloat:
+		return t.size, nil
+	case btfKindPtr:
+		return 8, nil
+	case btfKindArray:
+		elemSize, err := s.typeSize(t.arrayElem)
+		return elemSize * t.arrayLength, err
+	}
+	return 0, errors.Errorf("can't size BTF kind %d", t.kind)
+}
+
+// format decodes data according to the given type.
+func (s *btfSpec) format(id uint32, data []byte) (string, error) {
+	var sb strings.Builder
+	err := s.formatInto(&sb, id, data)
+	return sb.String(), err
+}
+
+func (s *btfSpec) formatInto(sb *strings.Builder, id uint32, data []byte) error {
+	t, err := s.resolve(id)
+	if err != nil {
+		return err
+	}
+	size, err := s.typeSize(id)
+	if err != nil {
+		return err
+	}
+	if uint32(len(data)) < size {
+		return errors.Errorf("value too short (%d bytes) for BTF type of size %d", len(data), size)
+	}
+
+	switch t.kind {
+	case btfKindInt:
+		v := decodeUintHost(data[:t.size])
+		switch {
+		case t.intEncoding&btfIntBool != 0:
+			sb.WriteString(fmt.Sprint(v != 0))
+		case t.intEncoding&btfIntSigned != 0:
+			shift := 64 - 8*t.size
+			sb.WriteString(fmt.Sprint(int64(v<<shift) >> shift))
+		default:
+			sb.WriteString(fmt.Sprint(v))
+		}
+	case btfKindEnum:
+		shift := 64 - 8*t.size
+		v := int64(decodeUintHost(data[:t.size])<<shift) >> shift
+		for _, ev := range t.enumVals {
+			if ev.value == v {
+				sb.WriteString(ev.name)
+				return nil
+			}
+		}
+		sb.WriteString(fmt.Sprint(v))
+	case btfKindPtr:
+		sb.WriteString(fmt.Sprintf("%#x", decodeUintHost(data[:8])))
+	case btfKindArray:
+		elemSize, err := s.typeSize(t.arrayElem)
+		if err != nil {
+			return err
+		}
+		sb.WriteString("[")
+		for i := uint32(0); i < t.arrayLength; i++ {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			if err := s.formatInto(sb, t.arrayElem, data[i*elemSize:]); err != nil {
+				return err
+			}
+		}
+		sb.WriteString("]")
+	case btfKindStruct, btfKindUnion:
+		sb.WriteString("{")
+		for i, m := range t.members {
+			if m.bitfieldSize != 0 || m.bitOffset%8 != 0 {
+				return errors.Errorf("BTF bitfield %q not supported", m.name)
+			}
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if m.name != "" {
+				sb.WriteString(m.name)
+				sb.WriteString(": ")
+			}
+			if err := s.formatInto(sb, m.typeID, data[m.bitOffset/8:]); err != nil {
+				return err
+			}
+		}
+		sb.WriteString("}")
+	default:
+		return errors.Errorf("can't format BTF kind %d", t.kind)
+	}
+	return nil
+}
+
+// decodeUintHost decodes a host-order unsigned integer of 1, 2, 4 or 8 bytes.
+func decodeUintHost(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(nativeEndian.Uint16(b))
+	case 4:
+		return uint64(nativeEndian.Uint32(b))
+	default:
+		return nativeEndian.Uint64(b)
+	}
+}
+
+// SetValueBTF sets the BTF type used by GetPretty to decode the map's values.  btf is a raw BTF
+// blob (for example, the .BTF section of our BPF object file) and typeName is the name of the
+// value's type within it.
+func (b *PinnedMap) SetValueBTF(btf []byte, typeName string) error {
+	spec, err := parseBTF(btf)
+	if err != nil {
+		return err
+	}
+	id, err := spec.typeByName(typeName)
+	if err != nil {
+		return err
+	}
+	size, err := spec.typeSize(id)
+	if err != nil {
+		return err
+	}
+	if int(size) != b.ValueSize {
+		return errors.Errorf("BTF type %q has size %d but map %s has value size %d",
+			typeName, size, b.versionedName(), b.ValueSize)
+	}
+	b.valueBTF = spec
+	b.valueBTFTypeID = id
+	return nil
+}
+
+// GetPretty looks up k and returns its value decoded according to the type set by SetValueBTF.
+func (b *PinnedMap) GetPretty(k []byte) (string, error) {
+	if b.valueBTF == nil {
+		return "", errors.Errorf("no value BTF set for map %s", b.versionedName())
+	}
+	v, err := b.Get(k)
+	if err != nil {
+		return "", err
+	}
+	return b.valueBTF.format(b.valueBTFTypeID, v)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// btfBuilder assembles a BTF blob for tests.
+type btfBuilder struct {
+	types   bytes.Buffer
+	strings bytes.Buffer
+}
+
+func newBTFBuilder() *btfBuilder {
+	b := &btfBuilder{}
+	b.strings.WriteByte(0)
+	return b
+}
+
+func (b *btfBuilder) str(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := uint32(b.strings.Len())
+	b.strings.WriteString(s)
+	b.strings.WriteByte(0)
+	return off
+}
+
+func (b *btfBuilder) u32(vs ...uint32) {
+	for _, v := range vs {
+		b.types.Write(KeyUint32Host(v))
+	}
+}
+
+func (b *btfBuilder) typ(name string, kind, vlen int, sizeOrType uint32) {
+	b.u32(b.str(name), uint32(kind)<<24|uint32(vlen), sizeOrType)
+}
+
+func (b *btfBuilder) blob() []byte {
+	var out bytes.Buffer
+	out.Write(KeyUint16Host(btfMagic))
+	out.Write([]byte{1, 0})
+	hdr := []uint32{24, 0, uint32(b.types.Len()), uint32(b.types.Len()), uint32(b.strings.Len())}
+	for _, v := range hdr {
+		out.Write(KeyUint32Host(v))
+	}
+	out.Write(b.types.Bytes())
+	out.Write(b.strings.Bytes())
+	return out.Bytes()
+}
+
+// testValueBTF describes
+//
+//	enum state { IDLE, BUSY };
+//	struct cali_test_val { __u32 a; short b[2]; enum state c; };
+//	typedef struct cali_test_val cali_test_val_t;
+func testValueBTF() []byte {
+	b := newBTFBuilder()
+	b.typ("__u32", btfKindInt, 0, 4) // 1
+	b.u32(32)
+	b.typ("short", btfKindInt, 0, 2) // 2
+	b.u32(btfIntSigned<<24 | 16)
+	b.typ("", btfKindArray, 0, 0) // 3
+	b.u32(2, 1, 2)
+	b.typ("state", btfKindEnum, 2, 4) // 4
+	b.u32(b.str("IDLE"), 0, b.str("BUSY"), 1)
+	b.typ("cali_test_val", btfKindStruct, 3, 12) // 5
+	b.u32(b.str("a"), 1, 0, b.str("b"), 3, 32, b.str("c"), 4, 64)
+	b.typ("cali_test_val_t", btfKindTypedef, 0, 5) // 6
+	return b.blob()
+}
+
+func TestBTFFormat(t *testing.T) {
+	spec, err := parseBTF(testValueBTF())
+	if err != nil {
+		t.Fatalf("Failed to parse BTF: %v", err)
+	}
+	for _, name := range []string{"cali_test_val", "cali_test_val_t"} {
+		id, err := spec.typeByName(name)
+		if err != nil {
+			t.Fatalf("Failed to find %s: %v", name, err)
+		}
+		v := append(append(KeyUint32Host(7), append(KeyUint16Host(0xffff), KeyUint16Host(2)...)...),
+			KeyUint32Host(1)...)
+		s, err := spec.format(id, v)
+		if err != nil {
+			t.Fatalf("Failed to format value: %v", err)
+		}
+		if expected := "{a: 7, b: [-1 2], c: BUSY}"; s != expected {
+			t.Errorf("Got %q, expected %q", s, expected)
+		}
+		if _, err := spec.format(id, v[:8]); err == nil {
+			t.Error("Expected an error for a short value")
+		}
+	}
+}
+
+func TestSetValueBTF(t *testing.T) {
+	m := (&MapContext{}).newPinnedMap(MapParameters{Name: "cali_test", ValueSize: 12})
+	if err := m.SetValueBTF(testValueBTF(), "cali_test_val"); err != nil {
+		t.Errorf("SetValueBTF failed: %v", err)
+	}
+	if err := m.SetValueBTF(testValueBTF(), "missing"); err == nil {
+		t.Error("Expected an error for a missing type")
+	}
+	m.ValueSize = 16
+	if err := m.SetValueBTF(testValueBTF(), "cali_test_val"); err == nil {
+		t.Error("Expected an error for a type of the wrong size")
+	}
+	if err := m.SetValueBTF([]byte{1, 2, 3}, "cali_test_val"); err == nil {
+		t.Error("Expected an error for a bad blob")
+	}
+}
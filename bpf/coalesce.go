@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingWrites holds coalesced updates that haven't been written to the kernel yet.  Only the
+// latest value for each key is kept.
+type pendingWrites struct {
+	lock   sync.Mutex
+	values map[string][]byte
+}
+
+// UpdateCoalesced records an update to be written by the next Flush, replacing any pending
+// update of the same key.  This saves syscalls for keys that are updated repeatedly between
+// flushes.  Pending writes aren't visible to Get, Iter or BPF programs until they are flushed.
+// Per-CPU maps aren't supported, since Flush writes with Update.
+func (b *PinnedMap) UpdateCoalesced(k, v []byte) error {
+	if b.perCPU {
+		return errors.Errorf("coalesced updates of per-CPU map %s are not supported", b.versionedName())
+	}
+	if len(k) != b.KeySize {
+		return errors.Errorf("key has wrong size (%d), expected %d", len(k), b.KeySize)
+	}
+	if len(v) != b.ValueSize {
+		return errors.Errorf("value has wrong size (%d), expected %d", len(v), b.ValueSize)
+	}
+	b.pending.lock.Lock()
+	defer b.pending.lock.Unlock()
+	if b.pending.values == nil {
+		b.pending.values = map[string][]byte{}
+	}
+	b.pending.values[string(k)] = append([]byte(nil), v...)
+	return nil
+}
+
+// Flush writes all pending coalesced updates to the map.  Updates that fail stay pending, to be
+// retried by the next Flush, and the first error is returned.
+func (b *PinnedMap) Flush() error {
+	b.pending.lock.Lock()
+	values := b.pending.values
+	b.pending.values = nil
+	b.pending.lock.Unlock()
+
+	var firstErr error
+	for k, v := range values {
+		err := b.Update([]byte(k), v)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errors.WithMessagef(err, "failed to flush update to map %s", b.versionedName())
+		}
+		b.pending.lock.Lock()
+		if b.pending.values == nil {
+			b.pending.values = map[string][]byte{}
+		}
+		if _, ok := b.pending.values[k]; !ok {
+			// Don't clobber a newer update that arrived while we were flushing.
+			b.pending.values[k] = v
+		}
+		b.pending.lock.Unlock()
+	}
+	return firstErr
+}
+
+// FlushAll flushes the pending coalesced updates of every map created through the context.  It
+// carries on past failures and returns the first error.
+func (c *MapContext) FlushAll() error {
+	maps := c.mapList()
+
+	var firstErr error
+	for _, m := range maps {
+		if err := m.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// StartAutoFlush starts a background goroutine that calls FlushAll every interval, for callers
+// that use UpdateCoalesced but don't want to flush explicitly.  Flush errors are logged.
+//
+// The goroutine runs until the returned stop function is called.  stop does a final FlushAll,
+// so no pending writes are left behind, and only returns once the goroutine has exited.  It is
+// safe to call stop more than once.  Callers must call stop to avoid leaking the goroutine.  If
+// interval isn't positive, it returns an error and doesn't start the goroutine.
+func (c *MapContext) StartAutoFlush(interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("invalid auto-flush interval %v", interval)
+	}
+	stopC := make(chan struct{})
+	doneC := make(chan struct{})
+	flush := func() {
+		if err := c.FlushAll(); err != nil {
+			logrus.WithError(err).Warn("Failed to flush coalesced map writes")
+		}
+	}
+	go func() {
+		defer close(doneC)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-stopC:
+				flush()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopC)
+		})
+		<-doneC
+	}, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Compact replaces the map with a freshly created copy that contains only its live entries.
+// After heavy churn, a hash map created with BPF_F_NO_PREALLOC can be left holding memory for
+// far more elements than it contains; rehashing into a new map releases it.
+//
+// The new map is pinned under a temporary name, filled and then renamed over the old pin, so the
+// pin always refers to a complete map.  While Compact runs, it blocks every operation on this
+// PinnedMap that uses the map's file descriptor (except through MapFD, which hands it out
+// unprotected).  It can't block other processes or BPF programs: their writes to the old map
+// during the copy are lost and BPF programs that are already loaded keep using the old map until
+// they are reloaded.  The read cache is cleared and, since the new map isn't frozen, so is the
+// frozen state.  Per-CPU and map-in-map types are not supported.
+func (b *PinnedMap) Compact() error {
+	if b.perCPU || b.InnerMap != nil {
+		return errors.Errorf("compacting map %s of type %s is not supported", b.versionedName(), b.Type)
+	}
+	if err := b.context.nativeOnly("compaction", b.versionedName()); err != nil {
+		return err
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+
+	b.rmwLock.Lock()
+	defer b.rmwLock.Unlock()
+	b.swapLock.Lock()
+	defer b.swapLock.Unlock()
+
+	memlockBefore := b.memlock()
+
+	newFD, err := CreateMap(b.MapParameters)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create replacement map")
+	}
+	tmpFilename := tempPinFilename(b.versionedFilename())
+	if err := PinBPFMap(newFD, tmpFilename); err != nil {
+		_ = newFD.Close()
+		return errors.WithMessage(err, "failed to pin replacement map")
+	}
+	abandon := func(err error) error {
+		_ = os.Remove(tmpFilename)
+		_ = newFD.Close()
+		return err
+	}
+
+	var copied int
+	var k []byte
+	for {
+		next, err := GetMapNextKey(b.fd, k, b.KeySize)
+		if IsNotExists(err) {
+			break
+		}
+		if err != nil {
+			return abandon(errors.WithMessage(err, "failed to list keys of map"))
+		}
+		k = next
+		v, err := GetMapEntry(b.fd, k, b.ValueSize)
+		if IsNotExists(err) {
+			continue
+		}
+		if err != nil {
+			return abandon(errors.WithMessage(err, "failed to read entry"))
+		}
+		if err := UpdateMapEntry(newFD, k, v); err != nil {
+			return abandon(errors.WithMessage(err, "failed to copy entry"))
+		}
+		copied++
+	}
+
+	if err := os.Rename(tmpFilename, b.versionedFilename()); err != nil {
+		return abandon(errors.WithMessage(err, "failed to replace map pin"))
+	}
+	if err := b.fd.Close(); err != nil {
+		logrus.WithError(err).WithField("name", b.versionedName()).Warn("Failed to close old map")
+	}
+	b.fd = newFD
+	// Values cached from, and the frozen state of, the old map don't apply to the new one.
+	atomic.StoreInt32(&b.frozen, 0)
+	if b.readCache != nil {
+		b.readCache.clear()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":          b.versionedName(),
+		"entries":       copied,
+		"memlockBefore": memlockBefore,
+		"memlockAfter":  b.memlock(),
+	}).Info("Compacted map.")
+	return nil
+}
+
+// memlock returns the memlock value that the kernel reports in fdinfo, or "" if it isn't
+// available.
+func (b *PinnedMap) memlock() string {
+	fdInfo, err := readFDInfo(fdInfoPath(b.fd))
+	if err != nil {
+		return ""
+	}
+	return fdInfo["memlock"]
+}
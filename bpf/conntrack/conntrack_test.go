@@ -69,6 +69,36 @@ func tcpEntry(created time.Duration, lastSeen time.Duration, legA conntrack.Leg,
 	return e
 }
 
+var _ = Describe("BPF Conntrack Key", func() {
+	It("should round trip through AsBytes and ParseKey", func() {
+		for _, k := range []conntrack.Key{tcpKey, udpKey, icmpKey} {
+			parsed, err := conntrack.ParseKey(k.AsBytes())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(k))
+			Expect(parsed.Proto()).To(Equal(k.Proto()))
+			Expect(parsed.AddrA().Equal(ip1)).To(BeTrue())
+			Expect(parsed.PortA()).To(Equal(uint16(1234)))
+			Expect(parsed.AddrB().Equal(ip2)).To(BeTrue())
+			Expect(parsed.PortB()).To(Equal(uint16(3456)))
+		}
+	})
+
+	It("should use the layout expected by the BPF program", func() {
+		Expect(tcpKey.AsBytes()).To(Equal([]byte{
+			6, 0, 0, 0, // protocol
+			10, 0, 0, 1, // addr_a
+			10, 0, 0, 2, // addr_b
+			0xd2, 0x04, // port_a
+			0x80, 0x0d, // port_b
+		}))
+	})
+
+	It("should reject keys of the wrong size", func() {
+		_, err := conntrack.ParseKey(tcpKey.AsBytes()[:12])
+		Expect(err).To(HaveOccurred())
+	})
+})
+
 var _ = Describe("BPF Conntrack LivenessCalculator", func() {
 	var lc *conntrack.LivenessScanner
 	var ctMap *mock.Map
@@ -26,10 +26,12 @@ import (
 )
 
 // struct calico_ct_key {
-//   uint32_t protocol;
-//   __be32 addr_a, addr_b; // NBO
-//   uint16_t port_a, port_b; // HBO
+//   uint32_t protocol;       // 0
+//   __be32 addr_a, addr_b;   // 4, 8 NBO
+//   uint16_t port_a, port_b; // 12, 14 HBO
 // };
+//
+// Keys should always be built with NewKey (or ParseKey) so that the layout is only encoded here.
 const conntrackKeySize = 16
 const conntrackValueSize = 64
 
@@ -64,6 +66,17 @@ func (k Key) String() string {
 		k.Proto(), k.AddrA(), k.PortA(), k.AddrB(), k.PortB())
 }
 
+// ParseKey is the inverse of Key.AsBytes().  It returns an error if b isn't the size of a key in
+// the conntrack map.
+func ParseKey(b []byte) (Key, error) {
+	var k Key
+	if len(b) != MapParams.KeySize {
+		return k, fmt.Errorf("conntrack key has wrong size (%d), expected %d", len(b), MapParams.KeySize)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
 func NewKey(proto uint8, ipA net.IP, portA uint16, ipB net.IP, portB uint16) Key {
 	var k Key
 	binary.LittleEndian.PutUint32(k[:4], uint32(proto))
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+type ColumnFormat int
+
+const (
+	// ColumnHex renders the field as hex digits.
+	ColumnHex ColumnFormat = iota
+	// ColumnUint renders a 1, 2, 4 or 8 byte host-order field as an unsigned integer.
+	ColumnUint
+	// ColumnUintBE renders a 1, 2, 4 or 8 byte network-order field as an unsigned integer.
+	ColumnUintBE
+	// ColumnIP renders a 4 or 16 byte field as an IP address.
+	ColumnIP
+)
+
+// ColumnSpec describes how to render one field of a key or value as a CSV column.
+type ColumnSpec struct {
+	Name   string
+	Offset int
+	Length int
+	Format ColumnFormat
+}
+
+func (c ColumnSpec) validate() error {
+	if c.Offset < 0 || c.Length <= 0 {
+		return errors.Errorf("column %q has invalid offset %d or length %d", c.Name, c.Offset, c.Length)
+	}
+	switch c.Format {
+	case ColumnHex:
+	case ColumnUint, ColumnUintBE:
+		if c.Length != 1 && c.Length != 2 && c.Length != 4 && c.Length != 8 {
+			return errors.Errorf("column %q has invalid length %d for an integer", c.Name, c.Length)
+		}
+	case ColumnIP:
+		if c.Length != net.IPv4len && c.Length != net.IPv6len {
+			return errors.Errorf("column %q has invalid length %d for an IP", c.Name, c.Length)
+		}
+	default:
+		return errors.Errorf("column %q has unknown format %d", c.Name, c.Format)
+	}
+	return nil
+}
+
+func (c ColumnSpec) format(b []byte) (string, error) {
+	if c.Offset+c.Length > len(b) {
+		return "", errors.Errorf("column %q (offset %d, length %d) doesn't fit in %d bytes",
+			c.Name, c.Offset, c.Length, len(b))
+	}
+	field := b[c.Offset : c.Offset+c.Length]
+	switch c.Format {
+	case ColumnUint:
+		return fmt.Sprint(decodeUintHost(field)), nil
+	case ColumnUintBE:
+		var v uint64
+		for _, x := range field {
+			v = v<<8 | uint64(x)
+		}
+		return fmt.Sprint(v), nil
+	case ColumnIP:
+		return net.IP(field).String(), nil
+	}
+	return hex.EncodeToString(field), nil
+}
+
+func formatColumns(row []string, cols []ColumnSpec, b []byte) ([]string, error) {
+	for _, c := range cols {
+		s, err := c.format(b)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, s)
+	}
+	return row, nil
+}
+
+// DumpCSV writes the contents of the map to w as CSV, with a header row of column names and then
+// one row per entry, in iteration order.  Each row has the columns described by keyCols followed
+// by those described by valCols.
+func DumpCSV(m Map, w io.Writer, keyCols, valCols []ColumnSpec) error {
+	allCols := append(append([]ColumnSpec(nil), keyCols...), valCols...)
+	header := make([]string, 0, len(allCols))
+	for _, c := range allCols {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		header = append(header, c.Name)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	var writeErr error
+	err := m.Iter(func(k, v []byte) {
+		if writeErr != nil {
+			return
+		}
+		row, err := formatColumns(make([]string, 0, len(header)), keyCols, k)
+		if err == nil {
+			row, err = formatColumns(row, valCols, v)
+		}
+		if err != nil {
+			writeErr = err
+			return
+		}
+		writeErr = cw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/projectcalico/felix/bpf"
+	"github.com/projectcalico/felix/bpf/mock"
+)
+
+func TestDumpCSV(t *testing.T) {
+	// Key is an IPv4 address followed by a host-order port; value is a network-order counter.
+	m := mock.NewMockMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+		Type:       "hash",
+		KeySize:    6,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	})
+	k := append(bpf.IPKey(net.ParseIP("10.0.0.1")), bpf.KeyUint16Host(8080)...)
+	_ = m.Update(k, []byte{0, 0, 1, 0})
+
+	keyCols := []bpf.ColumnSpec{
+		{Name: "ip", Offset: 0, Length: 4, Format: bpf.ColumnIP},
+		{Name: "port", Offset: 4, Length: 2, Format: bpf.ColumnUint},
+	}
+	valCols := []bpf.ColumnSpec{
+		{Name: "count", Offset: 0, Length: 4, Format: bpf.ColumnUintBE},
+		{Name: "raw", Offset: 0, Length: 4, Format: bpf.ColumnHex},
+	}
+	var buf bytes.Buffer
+	if err := bpf.DumpCSV(m, &buf, keyCols, valCols); err != nil {
+		t.Fatalf("DumpCSV failed: %v", err)
+	}
+	expected := "ip,port,count,raw\n10.0.0.1,8080,256,00000100\n"
+	if buf.String() != expected {
+		t.Errorf("Got %q, expected %q", buf.String(), expected)
+	}
+
+	badCols := []bpf.ColumnSpec{{Name: "ip", Offset: 4, Length: 4, Format: bpf.ColumnIP}}
+	if err := bpf.DumpCSV(m, &bytes.Buffer{}, badCols, nil); err == nil {
+		t.Error("Expected an error for a column that doesn't fit in the key")
+	}
+	badCols = []bpf.ColumnSpec{{Name: "n", Offset: 0, Length: 3, Format: bpf.ColumnUint}}
+	if err := bpf.DumpCSV(m, &bytes.Buffer{}, badCols, nil); err == nil {
+		t.Error("Expected an error for a 3-byte integer column")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import "sync"
+
+// ValueDecoder decodes a raw map value into a Go value.
+type ValueDecoder func(v []byte) (interface{}, error)
+
+// DecoderRegistry maps map names to the decoders for their values, so that everything that
+// interprets map values (CLI tools, metrics, logging) shares one definition of each layout.
+// It is safe for concurrent use.
+type DecoderRegistry struct {
+	lock     sync.RWMutex
+	decoders map[string]ValueDecoder
+}
+
+// NewDecoderRegistry returns an empty registry.
+func NewDecoderRegistry() *DecoderRegistry {
+	return &DecoderRegistry{
+		decoders: map[string]ValueDecoder{},
+	}
+}
+
+// DefaultDecoders is the registry used by GetDecoded for maps whose MapContext doesn't have its
+// own registry.
+var DefaultDecoders = NewDecoderRegistry()
+
+// Register sets the decoder for the map with the given name (as returned by GetName), replacing
+// any existing decoder.
+func (r *DecoderRegistry) Register(mapName string, decoder ValueDecoder) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.decoders[mapName] = decoder
+}
+
+// Lookup returns the decoder for the map with the given name, if there is one.
+func (r *DecoderRegistry) Lookup(mapName string) (ValueDecoder, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	d, ok := r.decoders[mapName]
+	return d, ok
+}
+
+// Decode decodes v using the decoder for the map with the given name.  If there is no decoder
+// for the map, v is returned as-is, as a []byte.
+func (r *DecoderRegistry) Decode(mapName string, v []byte) (interface{}, error) {
+	d, ok := r.Lookup(mapName)
+	if !ok {
+		return v, nil
+	}
+	return d(v)
+}
+
+func (c *MapContext) decoders() *DecoderRegistry {
+	if c == nil || c.Decoders == nil {
+		return DefaultDecoders
+	}
+	return c.Decoders
+}
+
+// GetDecoded looks up k and returns its value decoded by the decoder registered for the map's
+// name, or the raw value, as a []byte, if no decoder is registered.
+func (b *PinnedMap) GetDecoded(k []byte) (interface{}, error) {
+	v, err := b.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return b.context.decoders().Decode(b.versionedName(), v)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/projectcalico/felix/bpf"
+)
+
+func TestDecoderRegistry(t *testing.T) {
+	r := bpf.NewDecoderRegistry()
+	r.Register("cali_test", func(v []byte) (interface{}, error) {
+		if len(v) != 4 {
+			return nil, errors.New("bad length")
+		}
+		return binary.LittleEndian.Uint32(v), nil
+	})
+
+	decoded, err := r.Decode("cali_test", []byte{1, 1, 0, 0})
+	if err != nil || decoded != uint32(257) {
+		t.Errorf("Unexpected decoded value: %v, %v", decoded, err)
+	}
+	if _, err := r.Decode("cali_test", []byte{1}); err == nil {
+		t.Error("Expected decoder's error to be returned")
+	}
+
+	raw, err := r.Decode("cali_other", []byte{1, 2})
+	if b, ok := raw.([]byte); err != nil || !ok || len(b) != 2 {
+		t.Errorf("Expected raw bytes for a map without a decoder, got %v, %v", raw, err)
+	}
+	if _, ok := r.Lookup("cali_other"); ok {
+		t.Error("Unexpected decoder for cali_other")
+	}
+}
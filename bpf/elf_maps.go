@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"debug/elf"
+
+	"github.com/pkg/errors"
+)
+
+// legacyMapDefSize is the size of the common prefix of the legacy map definition structs (struct
+// bpf_map_def and our struct bpf_map_def_extended): type, key_size, value_size, max_entries and
+// map_flags, each a __u32.
+const legacyMapDefSize = 20
+
+// MapDefsFromELF returns the parameters of the maps declared by the BPF object file at path,
+// keyed on map name, so that our MapParameters can be checked against the object that we ship.
+// Both legacy map definitions, in the "maps" section, and BTF-defined maps, in the ".maps"
+// section, are supported.  Filename is set to the default pin path for the map's name; Version
+// is not set because the object doesn't record it.
+func MapDefsFromELF(path string) (map[string]MapParameters, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defs := map[string]MapParameters{}
+	if sec := f.Section("maps"); sec != nil {
+		if err := legacyMapDefs(f, sec, defs); err != nil {
+			return nil, errors.WithMessagef(err, "failed to read maps section of %s", path)
+		}
+	}
+	if f.Section(".maps") != nil {
+		btfSec := f.Section(".BTF")
+		if btfSec == nil {
+			return nil, errors.Errorf("%s has a .maps section but no BTF", path)
+		}
+		data, err := btfSec.Data()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read BTF from %s", path)
+		}
+		spec, err := parseBTF(data)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse BTF from %s", path)
+		}
+		if err := spec.mapDefs(defs); err != nil {
+			return nil, errors.WithMessagef(err, "failed to read .maps section of %s", path)
+		}
+	}
+	return defs, nil
+}
+
+// legacyMapDefs adds the map definitions in the legacy maps section to defs.  Each map is a
+// symbol in the section, pointing at its definition.
+func legacyMapDefs(f *elf.File, sec *elf.Section, defs map[string]MapParameters) error {
+	data, err := sec.Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if int(sym.Section) >= len(f.Sections) || f.Sections[sym.Section] != sec ||
+			elf.ST_TYPE(sym.Info) == elf.STT_SECTION || sym.Name == "" {
+			continue
+		}
+		if sym.Value+legacyMapDefSize > uint64(len(data)) {
+			return errors.Errorf("definition of map %s overruns the section", sym.Name)
+		}
+		def := data[sym.Value:]
+		bo := f.ByteOrder
+		mp := MapParameters{
+			Filename:   defaultPinPath(sym.Name),
+			KeySize:    int(bo.Uint32(def[4:])),
+			ValueSize:  int(bo.Uint32(def[8:])),
+			MaxEntries: int(bo.Uint32(def[12:])),
+			Name:       sym.Name,
+			Flags:      int(bo.Uint32(def[16:])),
+		}
+		if mp.Type = MapTypeName(bo.Uint32(def)); mp.Type == "" {
+			return errors.Errorf("map %s has unknown type %d", sym.Name, bo.Uint32(def))
+		}
+		defs[sym.Name] = mp
+	}
+	return nil
+}
+
+// mapDefs adds the maps declared in the BTF's .maps section to defs.  Each map is a variable
+// whose type is an anonymous struct.  libbpf's __uint(name, val) macro declares a member that
+// points to an array of length val and __type(name, T) declares a member that points to a T.
+func (s *btfSpec) mapDefs(defs map[string]MapParameters) error {
+	for _, sec := range s.types {
+		if sec.kind != btfKindDatasec || sec.name != ".maps" {
+			continue
+		}
+		for _, sv := range sec.secVars {
+			v, err := s.typeByID(sv.typeID)
+			if err != nil {
+				return err
+			}
+			if v.kind != btfKindVar {
+				return errors.Errorf("unexpected BTF kind %d in .maps section", v.kind)
+			}
+			mp, err := s.mapDef(v)
+			if err != nil {
+				return errors.WithMessagef(err, "map %s", v.name)
+			}
+			defs[v.name] = mp
+		}
+	}
+	return nil
+}
+
+func (s *btfSpec) mapDef(v *btfType) (MapParameters, error) {
+	mp := MapParameters{
+		Filename: defaultPinPath(v.name),
+		Name:     v.name,
+	}
+	def, err := s.resolve(v.size)
+	if err != nil {
+		return mp, err
+	}
+	if def.kind != btfKindStruct {
+		return mp, errors.Errorf("definition has BTF kind %d, expected a struct", def.kind)
+	}
+	for _, m := range def.members {
+		var dest *int
+		var size bool
+		switch m.name {
+		case "type":
+			typeID, err := s.uintAttr(m.typeID)
+			if err != nil {
+				return mp, err
+			}
+			if mp.Type = MapTypeName(typeID); mp.Type == "" {
+				return mp, errors.Errorf("unknown map type %d", typeID)
+			}
+			continue
+		case "key_size":
+			dest = &mp.KeySize
+		case "value_size":
+			dest = &mp.ValueSize
+		case "max_entries":
+			dest = &mp.MaxEntries
+		case "map_flags":
+			dest = &mp.Flags
+		case "key":
+			dest, size = &mp.KeySize, true
+		case "value":
+			dest, size = &mp.ValueSize, true
+		default:
+			continue
+		}
+		n, err := s.uintAttr(m.typeID)
+		if size {
+			n, err = s.pointeeSize(m.typeID)
+		}
+		if err != nil {
+			return mp, errors.WithMessagef(err, "member %s", m.name)
+		}
+		*dest = int(n)
+	}
+	if mp.Type == "" {
+		return mp, errors.New("no map type")
+	}
+	return mp, nil
+}
+
+// uintAttr decodes a member declared with __uint(), which is a pointer to an array whose length
+// is the value.
+func (s *btfSpec) uintAttr(id uint32) (uint32, error) {
+	ptr, err := s.resolve(id)
+	if err != nil {
+		return 0, err
+	}
+	if ptr.kind != btfKindPtr {
+		return 0, errors.Errorf("expected a pointer, got BTF kind %d", ptr.kind)
+	}
+	arr, err := s.resolve(ptr.size)
+	if err != nil {
+		return 0, err
+	}
+	if arr.kind != btfKindArray {
+		return 0, errors.Errorf("expected a pointer to an array, got BTF kind %d", arr.kind)
+	}
+	return arr.arrayLength, nil
+}
+
+// pointeeSize returns the size of the type pointed to by a member declared with __type().
+func (s *btfSpec) pointeeSize(id uint32) (uint32, error) {
+	ptr, err := s.resolve(id)
+	if err != nil {
+		return 0, err
+	}
+	if ptr.kind != btfKindPtr {
+		return 0, errors.Errorf("expected a pointer, got BTF kind %d", ptr.kind)
+	}
+	return s.typeSize(ptr.size)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testELFSection struct {
+	name string
+	typ  elf.SectionType
+	data []byte
+	link uint32
+}
+
+// writeTestELF writes a minimal little-endian ELF64 relocatable object with the given sections,
+// plus a symbol table with one symbol for each of syms, in section 1, to dir and returns its path.
+func writeTestELF(t *testing.T, dir string, sections []testELFSection, syms map[string]uint64) string {
+	var strtab bytes.Buffer
+	strtab.WriteByte(0)
+	var symtab bytes.Buffer
+	_ = binary.Write(&symtab, binary.LittleEndian, elf.Sym64{})
+	for name, value := range syms {
+		_ = binary.Write(&symtab, binary.LittleEndian, elf.Sym64{
+			Name:  uint32(strtab.Len()),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+			Shndx: 1,
+			Value: value,
+		})
+		strtab.WriteString(name)
+		strtab.WriteByte(0)
+	}
+	symtabIdx := uint32(len(sections) + 1)
+	sections = append(sections,
+		testELFSection{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab.Bytes(), link: symtabIdx + 1},
+		testELFSection{name: ".strtab", typ: elf.SHT_STRTAB, data: strtab.Bytes()},
+		testELFSection{name: ".shstrtab", typ: elf.SHT_STRTAB},
+	)
+	var shstrtab bytes.Buffer
+	shstrtab.WriteByte(0)
+	nameOffs := make([]uint32, len(sections))
+	for i, s := range sections {
+		nameOffs[i] = uint32(shstrtab.Len())
+		shstrtab.WriteString(s.name)
+		shstrtab.WriteByte(0)
+	}
+	sections[len(sections)-1].data = shstrtab.Bytes()
+
+	var body bytes.Buffer
+	shdrs := []elf.Section64{{}}
+	offset := uint64(64)
+	for i, s := range sections {
+		shdr := elf.Section64{
+			Name:      nameOffs[i],
+			Type:      uint32(s.typ),
+			Off:       offset,
+			Size:      uint64(len(s.data)),
+			Link:      s.link,
+			Addralign: 1,
+		}
+		if s.typ == elf.SHT_SYMTAB {
+			shdr.Info = 1
+			shdr.Entsize = 24
+		}
+		shdrs = append(shdrs, shdr)
+		body.Write(s.data)
+		offset += uint64(len(s.data))
+	}
+
+	var out bytes.Buffer
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_BPF),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     offset,
+		Ehsize:    64,
+		Shentsize: 64,
+		Shnum:     uint16(len(shdrs)),
+		Shstrndx:  uint16(len(shdrs) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	_ = binary.Write(&out, binary.LittleEndian, hdr)
+	out.Write(body.Bytes())
+	_ = binary.Write(&out, binary.LittleEndian, shdrs)
+
+	path := filepath.Join(dir, "test.o")
+	if err := ioutil.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMapDefsFromELFLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	le := func(vs ...uint32) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			binary.LittleEndian.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	// Two struct bpf_map_def_extended, as emitted for our tc programs.
+	maps := append(le(9, 16, 24, 512000, 0, 0, 2, 0, 0), le(3, 4, 4, 8, 0, 1, 1, 0, 0)...)
+	path := writeTestELF(t, dir, []testELFSection{{name: "maps", typ: elf.SHT_PROGBITS, data: maps}},
+		map[string]uint64{"cali_v4_ct": 0, "cali_jump": 36})
+
+	defs, err := MapDefsFromELF(path)
+	if err != nil {
+		t.Fatalf("MapDefsFromELF failed: %v", err)
+	}
+	expected := map[string]MapParameters{
+		"cali_v4_ct": {
+			Filename:   "/sys/fs/bpf/tc/globals/cali_v4_ct",
+			Type:       "lru_hash",
+			KeySize:    16,
+			ValueSize:  24,
+			MaxEntries: 512000,
+			Name:       "cali_v4_ct",
+		},
+		"cali_jump": {
+			Filename:   "/sys/fs/bpf/tc/globals/cali_jump",
+			Type:       "prog_array",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 8,
+			Name:       "cali_jump",
+		},
+	}
+	if !reflect.DeepEqual(defs, expected) {
+		t.Errorf("Unexpected map definitions: %+v", defs)
+	}
+
+	// A symbol that points past the end of the section is an error.
+	path = writeTestELF(t, dir, []testELFSection{{name: "maps", typ: elf.SHT_PROGBITS, data: maps}},
+		map[string]uint64{"cali_bad": 60})
+	if _, err := MapDefsFromELF(path); err == nil {
+		t.Error("Expected an error for a truncated map definition")
+	}
+}
+
+// testMapsBTF describes
+//
+//	struct {
+//	    __uint(type, BPF_MAP_TYPE_HASH);
+//	    __type(key, __u32);
+//	    __type(value, __u64);
+//	    __uint(max_entries, 1024);
+//	    __uint(map_flags, BPF_F_NO_PREALLOC);
+//	} cali_btf_map SEC(".maps");
+func testMapsBTF() []byte {
+	b := newBTFBuilder()
+	b.typ("__u32", btfKindInt, 0, 4) // 1
+	b.u32(32)
+	b.typ("__u64", btfKindInt, 0, 8) // 2
+	b.u32(64)
+	b.typ("", btfKindArray, 0, 0) // 3: int[1]
+	b.u32(1, 1, 1)
+	b.typ("", btfKindPtr, 0, 3)   // 4
+	b.typ("", btfKindArray, 0, 0) // 5: int[1024]
+	b.u32(1, 1, 1024)
+	b.typ("", btfKindPtr, 0, 5)     // 6
+	b.typ("", btfKindPtr, 0, 1)     // 7: __u32 *
+	b.typ("", btfKindPtr, 0, 2)     // 8: __u64 *
+	b.typ("", btfKindStruct, 5, 40) // 9
+	b.u32(b.str("type"), 4, 0, b.str("key"), 7, 64, b.str("value"), 8, 128,
+		b.str("max_entries"), 6, 192, b.str("map_flags"), 4, 256)
+	b.typ("cali_btf_map", btfKindVar, 0, 9) // 10
+	b.u32(1)
+	b.typ(".maps", btfKindDatasec, 1, 40) // 11
+	b.u32(10, 0, 40)
+	return b.blob()
+}
+
+func TestMapDefsFromELFBTF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTestELF(t, dir, []testELFSection{
+		{name: ".maps", typ: elf.SHT_PROGBITS, data: make([]byte, 40)},
+		{name: ".BTF", typ: elf.SHT_PROGBITS, data: testMapsBTF()},
+	}, nil)
+
+	defs, err := MapDefsFromELF(path)
+	if err != nil {
+		t.Fatalf("MapDefsFromELF failed: %v", err)
+	}
+	expected := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_btf_map",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1024,
+		Name:       "cali_btf_map",
+		Flags:      1,
+	}
+	if len(defs) != 1 || !reflect.DeepEqual(defs["cali_btf_map"], expected) {
+		t.Errorf("Unexpected map definitions: %+v", defs)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// getNoFileLimit, setNoFileLimit and countOpenFDs are vars so that tests can mock them.
+var (
+	getNoFileLimit = func(rlim *unix.Rlimit) error {
+		return unix.Getrlimit(unix.RLIMIT_NOFILE, rlim)
+	}
+	setNoFileLimit = func(rlim *unix.Rlimit) error {
+		return unix.Setrlimit(unix.RLIMIT_NOFILE, rlim)
+	}
+	countOpenFDs = func() (int, error) {
+		dir, err := os.Open("/proc/self/fd")
+		if err != nil {
+			return 0, err
+		}
+		defer dir.Close()
+		names, err := dir.Readdirnames(-1)
+		if err != nil {
+			return 0, err
+		}
+		// Don't count the FD that we're using to read the directory.
+		return len(names) - 1, nil
+	}
+)
+
+// CheckFDBudget checks that the process can open another needed file descriptors without hitting
+// RLIMIT_NOFILE, so that creating a batch of maps doesn't fail part way through with EMFILE.  If
+// the soft limit is too low but the hard limit is high enough, it raises the soft limit to the
+// hard limit; otherwise it returns an error.
+func CheckFDBudget(needed int) error {
+	open, err := countOpenFDs()
+	if err != nil {
+		return errors.WithMessage(err, "failed to count open file descriptors")
+	}
+	var rlim unix.Rlimit
+	if err := getNoFileLimit(&rlim); err != nil {
+		return errors.WithMessage(err, "failed to read RLIMIT_NOFILE")
+	}
+	required := uint64(open) + uint64(needed)
+	if required <= rlim.Cur {
+		return nil
+	}
+	if required > rlim.Max {
+		return errors.Errorf("need %d more file descriptors but %d of the hard limit of %d are already open",
+			needed, open, rlim.Max)
+	}
+	logrus.WithFields(logrus.Fields{
+		"open":      open,
+		"needed":    needed,
+		"softLimit": rlim.Cur,
+		"hardLimit": rlim.Max,
+	}).Info("Raising RLIMIT_NOFILE soft limit to make room for BPF maps")
+	rlim.Cur = rlim.Max
+	if err := setNoFileLimit(&rlim); err != nil {
+		return errors.WithMessage(err, "failed to raise RLIMIT_NOFILE")
+	}
+	return nil
+}
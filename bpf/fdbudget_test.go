@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckFDBudget(t *testing.T) {
+	var raised *unix.Rlimit
+	mock := func(open int, cur, max uint64) func() {
+		origGet, origSet, origCount := getNoFileLimit, setNoFileLimit, countOpenFDs
+		raised = nil
+		getNoFileLimit = func(rlim *unix.Rlimit) error {
+			rlim.Cur, rlim.Max = cur, max
+			return nil
+		}
+		setNoFileLimit = func(rlim *unix.Rlimit) error {
+			raised = &unix.Rlimit{Cur: rlim.Cur, Max: rlim.Max}
+			return nil
+		}
+		countOpenFDs = func() (int, error) {
+			return open, nil
+		}
+		return func() {
+			getNoFileLimit, setNoFileLimit, countOpenFDs = origGet, origSet, origCount
+		}
+	}
+
+	// Fits within the soft limit.
+	restore := mock(100, 1024, 4096)
+	if err := CheckFDBudget(900); err != nil || raised != nil {
+		t.Errorf("Expected no error and no change of limit, got %v, %v", err, raised)
+	}
+	restore()
+
+	// Needs the soft limit to be raised.
+	restore = mock(100, 1024, 4096)
+	if err := CheckFDBudget(1000); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if raised == nil || raised.Cur != 4096 || raised.Max != 4096 {
+		t.Errorf("Expected the soft limit to be raised to the hard limit, got %v", raised)
+	}
+	restore()
+
+	// Doesn't fit even in the hard limit.
+	restore = mock(100, 1024, 4096)
+	if err := CheckFDBudget(4000); err == nil || raised != nil {
+		t.Errorf("Expected an error and no change of limit, got %v, %v", err, raised)
+	}
+	restore()
+}
+
+func TestEnsureMapsFDBudget(t *testing.T) {
+	origGet := getNoFileLimit
+	defer func() { getNoFileLimit = origGet }()
+	getNoFileLimit = func(rlim *unix.Rlimit) error {
+		rlim.Cur, rlim.Max = 1, 1
+		return nil
+	}
+
+	maps, err := EnsureMaps(&MapContext{CheckFDs: true}, []MapParameters{
+		{Filename: "/sys/fs/bpf/tc/globals/cali_test", Type: "hash", KeySize: 4, ValueSize: 4, MaxEntries: 1, Name: "cali_test"},
+	})
+	if err == nil || maps != nil {
+		t.Errorf("Expected EnsureMaps to fail before creating anything, got %v, %v", maps, err)
+	}
+}
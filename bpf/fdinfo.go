@@ -0,0 +1,188 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// FDInfo returns the contents of /proc/self/fdinfo for the map's file descriptor as key/value
+// pairs.  For BPF maps, the kernel includes map_type, key_size, value_size, max_entries and
+// map_flags, among others.  Reading fdinfo doesn't require any BPF privileges.
+func (b *PinnedMap) FDInfo() (map[string]string, error) {
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	return readFDInfo(fdInfoPath(b.fd))
+}
+
+// FDInfoFields holds the most commonly-used diagnostic fields from a map's fdinfo.  Older
+// kernels omit some of them; the Has* flags record which ones the kernel reported.
+type FDInfoFields struct {
+	// Memlock is the number of bytes charged to the memlock limit for the map.
+	Memlock    uint64
+	HasMemlock bool
+	// MapFlags are the flags that the map was created with (BPF_F_*).
+	MapFlags    uint32
+	HasMapFlags bool
+	// Frozen is true if the map has been frozen with BPF_MAP_FREEZE.
+	Frozen    bool
+	HasFrozen bool
+}
+
+// RawFDInfo returns the memlock, map_flags and frozen fields from the map's fdinfo.
+func (b *PinnedMap) RawFDInfo() (*FDInfoFields, error) {
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	return b.rawFDInfo()
+}
+
+func (b *PinnedMap) rawFDInfo() (*FDInfoFields, error) {
+	fdInfo, err := readFDInfo(fdInfoPath(b.fd))
+	if err != nil {
+		return nil, err
+	}
+	return parseFDInfoFields(fdInfo)
+}
+
+func parseFDInfoFields(fields map[string]string) (*FDInfoFields, error) {
+	var info FDInfoFields
+	if v, ok := fields["memlock"]; ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse fdinfo field memlock=%q", v)
+		}
+		info.Memlock, info.HasMemlock = n, true
+	}
+	if v, ok := fields["map_flags"]; ok {
+		// The kernel prints map_flags in hex, with a 0x prefix.
+		n, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse fdinfo field map_flags=%q", v)
+		}
+		info.MapFlags, info.HasMapFlags = uint32(n), true
+	}
+	if v, ok := fields["frozen"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse fdinfo field frozen=%q", v)
+		}
+		info.Frozen, info.HasFrozen = n != 0, true
+	}
+	return &info, nil
+}
+
+func fdInfoPath(fd MapFD) string {
+	return fmt.Sprintf("/proc/self/fdinfo/%d", fd)
+}
+
+// GetInfo returns the kernel's view of the map's metadata.  If the BPF_OBJ_GET_INFO_BY_FD
+// syscall fails, the information is read from fdinfo instead.  Frozen is always read from
+// fdinfo; if that fails, it is left false.
+func (b *PinnedMap) GetInfo() (*MapInfo, error) {
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	return b.getInfo()
+}
+
+// getInfo is GetInfo without the lazy creation, for use while the map is being opened, when
+// lazyLock may already be held.
+func (b *PinnedMap) getInfo() (*MapInfo, error) {
+	info, err := GetMapInfo(b.fd)
+	if err == nil {
+		if fields, err := b.rawFDInfo(); err == nil {
+			info.Frozen = fields.Frozen
+		} else {
+			logrus.WithError(err).WithField("name", b.versionedName()).Debug(
+				"Failed to read fdinfo, assuming map isn't frozen")
+		}
+		return info, nil
+	}
+	logrus.WithError(err).WithField("name", b.versionedName()).Debug(
+		"Failed to get map info by FD, falling back to fdinfo")
+	fdInfo, fdInfoErr := readFDInfo(fdInfoPath(b.fd))
+	if fdInfoErr != nil {
+		return nil, err
+	}
+	return mapInfoFromFDInfo(fdInfo)
+}
+
+func readFDInfo(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFDInfo(f)
+}
+
+// parseFDInfo parses the "key:\tvalue" lines of an fdinfo file.  Lines without a colon are
+// ignored.
+func parseFDInfo(r io.Reader) (map[string]string, error) {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read fdinfo")
+	}
+	return fields, nil
+}
+
+func mapInfoFromFDInfo(fields map[string]string) (*MapInfo, error) {
+	if _, ok := fields["map_type"]; !ok {
+		return nil, errors.New("fdinfo doesn't describe a BPF map")
+	}
+	var info MapInfo
+	for name, dest := range map[string]*int{
+		"map_id":      &info.ID,
+		"map_type":    &info.Type,
+		"key_size":    &info.KeySize,
+		"value_size":  &info.ValueSize,
+		"max_entries": &info.MaxEntries,
+	} {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse fdinfo field %s=%q", name, v)
+		}
+		*dest = n
+	}
+	fdInfoFields, err := parseFDInfoFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	info.Flags = fdInfoFields.MapFlags
+	info.Frozen = fdInfoFields.Frozen
+	return &info, nil
+}
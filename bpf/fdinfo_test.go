@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMapFDInfo = `pos:	0
+flags:	02000002
+mnt_id:	14
+map_type:	1
+key_size:	16
+value_size:	8
+max_entries:	512000
+map_flags:	0x1
+memlock:	45064192
+map_id:	27
+frozen:	0
+`
+
+func TestReadFDInfo(t *testing.T) {
+	f, err := ioutil.TempFile("", "fdinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testMapFDInfo); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fields, err := readFDInfo(f.Name())
+	if err != nil {
+		t.Fatalf("failed to read fdinfo: %v", err)
+	}
+	if fields["map_flags"] != "0x1" || fields["memlock"] != "45064192" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+
+	info, err := mapInfoFromFDInfo(fields)
+	if err != nil {
+		t.Fatalf("failed to convert fdinfo: %v", err)
+	}
+	expected := MapInfo{ID: 27, Type: 1, KeySize: 16, ValueSize: 8, MaxEntries: 512000, Flags: 1}
+	if !reflect.DeepEqual(*info, expected) {
+		t.Errorf("mapInfoFromFDInfo() = %+v, expected %+v", *info, expected)
+	}
+
+	fields["frozen"] = "1"
+	info, err = mapInfoFromFDInfo(fields)
+	if err != nil || !info.Frozen {
+		t.Errorf("expected a frozen map, got %+v, %v", info, err)
+	}
+}
+
+func TestFDInfoMissingFields(t *testing.T) {
+	// Older kernels omit some fields; non-map FDs have none of them.
+	info, err := mapInfoFromFDInfo(map[string]string{"map_type": "2", "key_size": "4"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (MapInfo{Type: 2, KeySize: 4}); *info != expected {
+		t.Errorf("mapInfoFromFDInfo() = %+v, expected %+v", *info, expected)
+	}
+
+	if _, err := mapInfoFromFDInfo(map[string]string{"pos": "0", "flags": "02"}); err == nil {
+		t.Error("expected an error for a non-map fdinfo")
+	}
+	if _, err := mapInfoFromFDInfo(map[string]string{"map_type": "x"}); err == nil {
+		t.Error("expected an error for a malformed field")
+	}
+}
+
+func TestParseFDInfoFields(t *testing.T) {
+	fields, err := parseFDInfo(strings.NewReader(testMapFDInfo))
+	if err != nil {
+		t.Fatalf("failed to parse fdinfo: %v", err)
+	}
+	info, err := parseFDInfoFields(fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := FDInfoFields{
+		Memlock: 45064192, HasMemlock: true,
+		MapFlags: 1, HasMapFlags: true,
+		Frozen: false, HasFrozen: true,
+	}
+	if *info != expected {
+		t.Errorf("parseFDInfoFields() = %+v, expected %+v", *info, expected)
+	}
+
+	// Older kernels don't report frozen (or, before that, memlock).
+	info, err = parseFDInfoFields(map[string]string{"map_type": "1", "map_flags": "0x400"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (FDInfoFields{MapFlags: 0x400, HasMapFlags: true}); *info != expected {
+		t.Errorf("parseFDInfoFields() = %+v, expected %+v", *info, expected)
+	}
+
+	info, err = parseFDInfoFields(map[string]string{"frozen": "1"})
+	if err != nil || !info.Frozen || !info.HasFrozen {
+		t.Errorf("expected a frozen map, got %+v, %v", info, err)
+	}
+
+	if _, err := parseFDInfoFields(map[string]string{"memlock": "lots"}); err == nil {
+		t.Error("expected an error for a malformed field")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FDMap is a Map that operates directly on a map file descriptor that was opened elsewhere, for
+// example by a program that loads its own BPF objects.  It has no pin, so it never uses bpftool
+// and never creates, pins or repins anything; all operations are native syscalls.  The caller
+// owns the file descriptor and must keep it open while the FDMap is in use.
+type FDMap struct {
+	params MapParameters
+	fd     MapFD
+}
+
+// NewFDMap returns a Map for the map with the given file descriptor.  params describes the map;
+// its Filename is ignored.  Per-CPU maps are not supported.
+func NewFDMap(fd MapFD, params MapParameters) Map {
+	return &FDMap{params: params, fd: fd}
+}
+
+func (m *FDMap) GetName() string {
+	return m.params.versionedName()
+}
+
+// EnsureExists checks that the file descriptor refers to a map with the expected type and sizes.
+func (m *FDMap) EnsureExists() error {
+	if strings.Contains(m.params.Type, "percpu") {
+		return errors.Errorf("map %s is a per-CPU map, which FDMap doesn't support", m.GetName())
+	}
+	info, err := GetMapInfo(m.fd)
+	if err != nil {
+		return errors.WithMessagef(err, "FD %d of map %s is not a valid map", m.fd, m.GetName())
+	}
+	if actual := MapTypeName(uint32(info.Type)); actual != m.params.Type {
+		return errors.Errorf("map %s (FD %d) is of type %s, expected %s", m.GetName(), m.fd, actual, m.params.Type)
+	}
+	if info.KeySize != m.params.KeySize || info.ValueSize != m.params.ValueSize {
+		return errors.Errorf("map %s (FD %d) has key size %d and value size %d, expected %d and %d",
+			m.GetName(), m.fd, info.KeySize, info.ValueSize, m.params.KeySize, m.params.ValueSize)
+	}
+	return nil
+}
+
+func (m *FDMap) MapFD() MapFD {
+	return m.fd
+}
+
+// Path returns "" since the map isn't (necessarily) pinned.
+func (m *FDMap) Path() string {
+	return ""
+}
+
+// Iter calls f for each entry in the map.  Entries that are deleted during the iteration are
+// skipped.
+func (m *FDMap) Iter(f MapIter) error {
+	keys, err := mapKeys(m.fd, m.params.KeySize)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v, err := GetMapEntry(m.fd, k, m.params.ValueSize)
+		if IsNotExists(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f(k, v)
+	}
+	return nil
+}
+
+func (m *FDMap) Update(k, v []byte) error {
+	err := UpdateMapEntry(m.fd, k, v)
+	if isMapFullErr(err) {
+		return errors.WithMessage(ErrMapFull, fmt.Sprintf("map %s (%v)", m.GetName(), err))
+	}
+	return err
+}
+
+// UpdateBatch writes the entries one at a time, in order.
+func (m *FDMap) UpdateBatch(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.Errorf("got %d keys but %d values", len(keys), len(values))
+	}
+	for i := range keys {
+		if err := m.Update(keys[i], values[i]); err != nil {
+			return errors.WithMessagef(err, "failed to update entry %d", i)
+		}
+	}
+	return nil
+}
+
+func (m *FDMap) Get(k []byte) ([]byte, error) {
+	return GetMapEntry(m.fd, k, m.params.ValueSize)
+}
+
+// Delete deletes the entry for k, returning ErrKeyNotExist if there wasn't one.
+func (m *FDMap) Delete(k []byte) error {
+	err := deleteMapEntry(m.fd, k, m.params.ValueSize)
+	if IsNotExists(err) {
+		return ErrKeyNotExist
+	}
+	return err
+}
+
+func (m *FDMap) SupportsDelete() bool {
+	return MapTypeSupportsDelete(m.params.Type)
+}
+
+// AssertType checks the type of the map, as reported by the kernel, against expected.
+func (m *FDMap) AssertType(expected string) error {
+	info, err := GetMapInfo(m.fd)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get map type")
+	}
+	return assertMapType(m.GetName(), info, expected)
+}
+
+// ID returns the kernel's ID for the map, which identifies it across file descriptors and pins;
+// see PinnedMap.SameAs.
+func (m *FDMap) ID() (int, error) {
+	info, err := GetMapInfo(m.fd)
+	if err != nil {
+		return 0, err
+	}
+	return info.ID, nil
+}
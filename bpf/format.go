@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// KeyFormatter and ValueFormatter render a map key or value as a human-readable string, for
+// example for logging dumps in support bundles.
+type KeyFormatter func(k []byte) string
+type ValueFormatter func(v []byte) string
+
+// FormatHex renders b as hex digits.  It is the default formatter for keys and values.
+func FormatHex(b []byte) string {
+	return hex.EncodeToString(b)
+}
+
+// FormatIP renders a 4 or 16 byte field as an IP address and anything else as hex.
+func FormatIP(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return FormatHex(b)
+	}
+	return net.IP(b).String()
+}
+
+// FormatIPPort renders a 6 or 18 byte field, made up of an IP address followed by a
+// network-order port (the layout of IPKey followed by PortKey), as "ip:port", and anything else
+// as hex.
+func FormatIPPort(b []byte) string {
+	if len(b) != net.IPv4len+2 && len(b) != net.IPv6len+2 {
+		return FormatHex(b)
+	}
+	ipLen := len(b) - 2
+	port := uint16(b[ipLen])<<8 | uint16(b[ipLen+1])
+	return net.JoinHostPort(net.IP(b[:ipLen]).String(), fmt.Sprint(port))
+}
+
+// FormatFields returns a formatter that renders the given fields, in the same way as DumpCSV
+// renders columns, as space-separated "name=value" pairs.  Fields that are invalid or that
+// don't fit in the data are rendered as "name=?".
+func FormatFields(fields ...ColumnSpec) func(b []byte) string {
+	return func(b []byte) string {
+		parts := make([]string, 0, len(fields))
+		for _, f := range fields {
+			s := "?"
+			if f.validate() == nil {
+				if formatted, err := f.format(b); err == nil {
+					s = formatted
+				}
+			}
+			parts = append(parts, f.Name+"="+s)
+		}
+		return strings.Join(parts, " ")
+	}
+}
+
+// FormatEntry renders a key/value pair as "key: value".  A nil formatter means FormatHex.
+func FormatEntry(k, v []byte, kf KeyFormatter, vf ValueFormatter) string {
+	if kf == nil {
+		kf = FormatHex
+	}
+	if vf == nil {
+		vf = FormatHex
+	}
+	return kf(k) + ": " + vf(v)
+}
+
+// FormatMapCmdOutput parses the output of the command returned by DumpMapCmd and writes one line
+// per entry to w, rendered with FormatEntry.
+func FormatMapCmdOutput(output []byte, w io.Writer, kf KeyFormatter, vf ValueFormatter) error {
+	var writeErr error
+	err := IterMapCmdOutput(output, func(k, v []byte) {
+		if writeErr != nil {
+			return
+		}
+		_, writeErr = fmt.Fprintln(w, FormatEntry(k, v, kf, vf))
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
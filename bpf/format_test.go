@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatHexAndIP(t *testing.T) {
+	for _, tc := range []struct {
+		f        func([]byte) string
+		in       []byte
+		expected string
+	}{
+		{FormatHex, []byte{0x0a, 0xff, 0x00}, "0aff00"},
+		{FormatHex, nil, ""},
+		{FormatIP, []byte{10, 0, 0, 1}, "10.0.0.1"},
+		{FormatIP, []byte{0xfd, 0, 15: 1}, "fd00::1"},
+		{FormatIP, []byte{10, 0, 0}, "0a0000"},
+		{FormatIPPort, []byte{10, 0, 0, 1, 0x1f, 0x90}, "10.0.0.1:8080"},
+		{FormatIPPort, []byte{0xfd, 0, 15: 1, 16: 0, 17: 53}, "[fd00::1]:53"},
+		{FormatFields(
+			ColumnSpec{Name: "ip", Offset: 0, Length: 4, Format: ColumnIP},
+			ColumnSpec{Name: "port", Offset: 4, Length: 2, Format: ColumnUintBE},
+			ColumnSpec{Name: "extra", Offset: 6, Length: 4, Format: ColumnHex},
+		), []byte{10, 0, 0, 1, 0, 80}, "ip=10.0.0.1 port=80 extra=?"},
+	} {
+		if s := tc.f(tc.in); s != tc.expected {
+			t.Errorf("Formatting %v gave %q, expected %q", tc.in, s, tc.expected)
+		}
+	}
+}
+
+func TestFormatMapCmdOutput(t *testing.T) {
+	const dump = `[{
+        "key": ["0x0a","0x00","0x00","0x01"],
+        "value": ["0x01","0x02"]
+    }
+]`
+	var buf bytes.Buffer
+	if err := FormatMapCmdOutput([]byte(dump), &buf, FormatIP, nil); err != nil {
+		t.Fatalf("FormatMapCmdOutput failed: %v", err)
+	}
+	if buf.String() != "10.0.0.1: 0102\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
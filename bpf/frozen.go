@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ErrMapFrozen is the cause of the error returned by Update when the map has been frozen with
+// BPF_MAP_FREEZE, so it can't be written from userspace.  Use errors.Cause() to check for it.
+var ErrMapFrozen = errors.New("map is frozen")
+
+// Freeze makes the map read-only from userspace with BPF_MAP_FREEZE; BPF programs can still write
+// to it.  Freezing can't be undone.  It requires kernel v5.2+.
+func (b *PinnedMap) Freeze() error {
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
+	if err := FreezeMap(b.fd); err != nil {
+		return errors.WithMessagef(err, "failed to freeze map %s", b.versionedName())
+	}
+	atomic.StoreInt32(&b.frozen, 1)
+	return nil
+}
+
+// IsFrozen returns true if the map has been frozen with BPF_MAP_FREEZE, by us or by anyone else.
+// It reads the map's fdinfo; kernels that don't report the frozen state don't support freezing.
+func (b *PinnedMap) IsFrozen() (bool, error) {
+	if atomic.LoadInt32(&b.frozen) != 0 {
+		return true, nil
+	}
+	fields, err := b.RawFDInfo()
+	if err != nil {
+		return false, errors.WithMessagef(err, "failed to read frozen state of map %s", b.versionedName())
+	}
+	if fields.Frozen {
+		// Freezing is permanent, so remember it to save reading fdinfo again.
+		atomic.StoreInt32(&b.frozen, 1)
+	}
+	return fields.Frozen, nil
+}
+
+// checkFrozen converts err, from a write to the map, into an error with cause ErrMapFrozen if the
+// write failed because the map is frozen.  The kernel reports that with EPERM, which can also mean
+// a lack of privileges, so the map's frozen state is checked before converting it.
+func (b *PinnedMap) checkFrozen(err error) error {
+	if err != unix.EPERM {
+		return err
+	}
+	if frozen, _ := b.IsFrozen(); !frozen {
+		return err
+	}
+	return b.frozenErr()
+}
+
+func (b *PinnedMap) frozenErr() error {
+	return errors.WithMessage(ErrMapFrozen, fmt.Sprintf("map %s", b.versionedName()))
+}
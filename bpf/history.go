@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OpRecord is an entry in a MapContext's operation history.
+type OpRecord struct {
+	Time time.Time
+	// Map is the versioned name of the map.
+	Map string
+	// Op is "update", "delete" or "iter".
+	Op string
+	// KeyHash is the FNV-1a hash of the key, so that operations on the same key can be matched
+	// up without keeping the keys themselves; it is zero for iterations.
+	KeyHash uint64
+	// Err is the error returned by the operation, if any.
+	Err error
+}
+
+// opHistory is a ring buffer of the most recent operations on a MapContext's maps.
+type opHistory struct {
+	// enabled is non-zero if records is non-empty; accessed atomically so that recording is
+	// cheap while the history is off.
+	enabled int32
+
+	lock    sync.Mutex
+	records []OpRecord
+	next    int
+	full    bool
+}
+
+// SetHistorySize enables recording of the last n Update, Delete and Iter operations on the
+// context's maps, for debugging unexpected map state; see DumpHistory.  n <= 0 disables the
+// history, which is the default.  Changing the size discards the existing history.
+func (c *MapContext) SetHistorySize(n int) {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if n <= 0 {
+		h.records = nil
+		atomic.StoreInt32(&h.enabled, 0)
+	} else {
+		h.records = make([]OpRecord, n)
+		atomic.StoreInt32(&h.enabled, 1)
+	}
+	h.next = 0
+	h.full = false
+}
+
+// DumpHistory returns the recorded operations, oldest first.  It returns nil if the history
+// isn't enabled.
+func (c *MapContext) DumpHistory() []OpRecord {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.records) == 0 {
+		return nil
+	}
+	if !h.full {
+		return append([]OpRecord(nil), h.records[:h.next]...)
+	}
+	out := make([]OpRecord, 0, len(h.records))
+	out = append(out, h.records[h.next:]...)
+	return append(out, h.records[:h.next]...)
+}
+
+// recordOp adds an operation to the history, if it is enabled.  key may be nil.
+func (c *MapContext) recordOp(mapName, op string, key []byte, err error) {
+	if c == nil || atomic.LoadInt32(&c.history.enabled) == 0 {
+		return
+	}
+	var keyHash uint64
+	if key != nil {
+		hash := fnv.New64a()
+		_, _ = hash.Write(key)
+		keyHash = hash.Sum64()
+	}
+	rec := OpRecord{
+		Time:    time.Now(),
+		Map:     mapName,
+		Op:      op,
+		KeyHash: keyHash,
+		Err:     err,
+	}
+
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.records) == 0 {
+		// Disabled since we checked.
+		return
+	}
+	h.records[h.next] = rec
+	h.next++
+	if h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	c := &MapContext{}
+	c.recordOp("cali_test", "update", []byte{1}, nil)
+	if h := c.DumpHistory(); h != nil {
+		t.Fatalf("Expected no history by default, got %v", h)
+	}
+
+	c.SetHistorySize(3)
+	failed := errors.New("failed")
+	c.recordOp("cali_test", "update", []byte{1}, nil)
+	c.recordOp("cali_test", "iter", nil, nil)
+	c.recordOp("cali_test", "delete", []byte{1}, failed)
+	h := c.DumpHistory()
+	if len(h) != 3 || h[0].Op != "update" || h[1].Op != "iter" || h[2].Op != "delete" {
+		t.Fatalf("Unexpected history: %v", h)
+	}
+	if h[0].KeyHash == 0 || h[0].KeyHash != h[2].KeyHash || h[1].KeyHash != 0 {
+		t.Errorf("Unexpected key hashes: %v", h)
+	}
+	if h[2].Err != failed || h[0].Map != "cali_test" || h[0].Time.IsZero() {
+		t.Errorf("Unexpected record: %v", h[2])
+	}
+
+	// Once full, the oldest records are dropped.
+	c.recordOp("cali_test", "update", []byte{2}, nil)
+	h = c.DumpHistory()
+	if len(h) != 3 || h[0].Op != "iter" || h[2].Op != "update" || h[2].KeyHash == h[1].KeyHash {
+		t.Errorf("Unexpected history after wrapping: %v", h)
+	}
+
+	c.SetHistorySize(0)
+	c.recordOp("cali_test", "update", []byte{1}, nil)
+	if h := c.DumpHistory(); h != nil {
+		t.Errorf("Expected no history once disabled, got %v", h)
+	}
+}
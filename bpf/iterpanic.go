@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIterCallbackPanic is the cause of the error returned by Iter when its callback panicked and
+// the context's RecoverIterPanics is set.  Use errors.Cause() to check for it.
+var ErrIterCallbackPanic = errors.New("iteration callback panicked")
+
+// callbackPanic wraps a value that an iteration callback panicked with, so that Iter can tell
+// panics from the callback apart from panics in its own code, which it doesn't recover.
+type callbackPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// guardIterCallback returns a MapIter that calls f, wrapping any panic in a callbackPanic.
+func guardIterCallback(f MapIter) MapIter {
+	return func(k, v []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(callbackPanic{value: r, stack: debug.Stack()})
+			}
+		}()
+		f(k, v)
+	}
+}
+
+// iterPanicError converts r, a non-nil value recovered by Iter, into an error.  It also returns
+// the value to re-panic with: the original value if r came from the callback and
+// RecoverIterPanics isn't set, r itself if it didn't come from the callback, or nil if Iter
+// should return the error instead of panicking.
+func (c *MapContext) iterPanicError(mapName string, r interface{}) (repanic interface{}, err error) {
+	cbPanic, ok := r.(callbackPanic)
+	if !ok {
+		return r, errors.Errorf("iteration of map %s panicked: %v", mapName, r)
+	}
+	err = errors.WithMessage(ErrIterCallbackPanic,
+		fmt.Sprintf("map %s: %v\n%s", mapName, cbPanic.value, cbPanic.stack))
+	if c == nil || !c.RecoverIterPanics {
+		return cbPanic.value, err
+	}
+	return nil, err
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIterPanicError(t *testing.T) {
+	var recovered interface{}
+	func() {
+		defer func() {
+			recovered = recover()
+		}()
+		guardIterCallback(func(k, v []byte) {
+			panic("boom")
+		})(nil, nil)
+	}()
+	if _, ok := recovered.(callbackPanic); !ok {
+		t.Fatalf("Expected the callback's panic to be wrapped, got %v", recovered)
+	}
+
+	// By default, the callback's original value is re-raised.
+	repanic, err := (&MapContext{}).iterPanicError("cali_test", recovered)
+	if repanic != "boom" || errors.Cause(err) != ErrIterCallbackPanic {
+		t.Errorf("Expected to re-panic with the original value, got %v, %v", repanic, err)
+	}
+
+	// With RecoverIterPanics, it becomes an error.
+	repanic, err = (&MapContext{RecoverIterPanics: true}).iterPanicError("cali_test", recovered)
+	if repanic != nil || errors.Cause(err) != ErrIterCallbackPanic || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected an error and no panic, got %v, %v", repanic, err)
+	}
+
+	// Panics that didn't come from the callback are always re-raised.
+	repanic, _ = (&MapContext{RecoverIterPanics: true}).iterPanicError("cali_test", "internal")
+	if repanic != "internal" {
+		t.Errorf("Expected to re-panic with an internal panic, got %v", repanic)
+	}
+}
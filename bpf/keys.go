@@ -0,0 +1,162 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Helpers for encoding integer key fields with an explicit byte order.
+//
+// Our BPF programs use IP addresses as raw, network-order bytes but convert ports (and other
+// integers) to host order before using them in map keys, see conntrack.NewKey for an example.
+// A field encoded in the wrong order results in a lookup miss rather than an error, so key
+// construction should always go through one of these helpers.
+
+// KeyUint32BE encodes v in network (big-endian) byte order.
+func KeyUint32BE(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// KeyUint16BE encodes v in network (big-endian) byte order.
+func KeyUint16BE(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// KeyUint32Host encodes v in host byte order.
+func KeyUint32Host(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+// KeyUint16Host encodes v in host byte order.
+func KeyUint16Host(v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return b
+}
+
+// DecodeKeyUint32BE decodes the network-order uint32 at the start of b.
+func DecodeKeyUint32BE(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+// DecodeKeyUint16BE decodes the network-order uint16 at the start of b.
+func DecodeKeyUint16BE(b []byte) uint16 {
+	return binary.BigEndian.Uint16(b)
+}
+
+// DecodeKeyUint32Host decodes the host-order uint32 at the start of b.
+func DecodeKeyUint32Host(b []byte) uint32 {
+	return nativeEndian.Uint32(b)
+}
+
+// DecodeKeyUint16Host decodes the host-order uint16 at the start of b.
+func DecodeKeyUint16Host(b []byte) uint16 {
+	return nativeEndian.Uint16(b)
+}
+
+// IPKey returns ip as a network-order key field: 4 bytes for an IPv4 address and 16 bytes for an
+// IPv6 address.  It returns nil if ip is invalid.  To build a whole key that is checked against
+// the map, use MapParameters.IPKey.
+func IPKey(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return append([]byte(nil), v4...)
+	}
+	if len(ip) == net.IPv6len {
+		return append([]byte(nil), ip...)
+	}
+	return nil
+}
+
+// PortKey returns port as a network-order key field.  Note that our own BPF programs use
+// host-order ports (see KeyUint16Host); this is for maps that are keyed on the port as it appears
+// on the wire.
+func PortKey(port uint16) []byte {
+	return KeyUint16BE(port)
+}
+
+// DecodeIPKey is the inverse of IPKey.
+func DecodeIPKey(b []byte) (net.IP, error) {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, errors.Errorf("IP key field has invalid length %d", len(b))
+	}
+	return net.IP(append([]byte(nil), b...)), nil
+}
+
+// DecodePortKey is the inverse of PortKey.
+func DecodePortKey(b []byte) (uint16, error) {
+	if len(b) != 2 {
+		return 0, errors.Errorf("port key field has invalid length %d", len(b))
+	}
+	return DecodeKeyUint16BE(b), nil
+}
+
+// IPKey returns ip as a network-order key for the map, which must be keyed on the address alone.
+// It returns an error if ip is invalid or doesn't match the map's key size (for example, an IPv6
+// address for an IPv4 map).
+func (mp *MapParameters) IPKey(ip net.IP) ([]byte, error) {
+	k := IPKey(ip)
+	if k == nil {
+		return nil, errors.Errorf("invalid IP %v for map %s", ip, mp.versionedName())
+	}
+	if err := mp.CheckKey(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// PortKey returns port as a network-order key for the map, which must be keyed on the port
+// alone.  It returns an error if the map's key size isn't 2.
+func (mp *MapParameters) PortKey(port uint16) ([]byte, error) {
+	k := PortKey(port)
+	if err := mp.CheckKey(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// DecodeIPKey is the inverse of MapParameters.IPKey.
+func (mp *MapParameters) DecodeIPKey(k []byte) (net.IP, error) {
+	if err := mp.CheckKey(k); err != nil {
+		return nil, err
+	}
+	return DecodeIPKey(k)
+}
+
+// DecodePortKey is the inverse of MapParameters.PortKey.
+func (mp *MapParameters) DecodePortKey(k []byte) (uint16, error) {
+	if err := mp.CheckKey(k); err != nil {
+		return 0, err
+	}
+	return DecodePortKey(k)
+}
+
+// CheckKey returns an error if k isn't the right size to be a key in the map.
+func (mp *MapParameters) CheckKey(k []byte) error {
+	if len(k) != mp.KeySize {
+		return errors.Errorf("key has wrong size (%d) for map %s, expected %d",
+			len(k), mp.versionedName(), mp.KeySize)
+	}
+	return nil
+}
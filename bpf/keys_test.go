@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestKeyByteOrderHelpers(t *testing.T) {
+	if b := KeyUint32BE(0x0a000001); !bytes.Equal(b, []byte{10, 0, 0, 1}) {
+		t.Errorf("KeyUint32BE = %v", b)
+	}
+	if b := KeyUint16BE(8080); !bytes.Equal(b, []byte{0x1f, 0x90}) {
+		t.Errorf("KeyUint16BE = %v", b)
+	}
+	if v := DecodeKeyUint32BE(KeyUint32BE(0xdeadbeef)); v != 0xdeadbeef {
+		t.Errorf("DecodeKeyUint32BE round trip = %x", v)
+	}
+	if v := DecodeKeyUint16BE(KeyUint16BE(443)); v != 443 {
+		t.Errorf("DecodeKeyUint16BE round trip = %d", v)
+	}
+
+	hostOrder := make([]byte, 4)
+	nativeEndian.PutUint32(hostOrder, 0x01020304)
+	if b := KeyUint32Host(0x01020304); !bytes.Equal(b, hostOrder) {
+		t.Errorf("KeyUint32Host = %v, expected %v", b, hostOrder)
+	}
+	if v := DecodeKeyUint32Host(KeyUint32Host(0xdeadbeef)); v != 0xdeadbeef {
+		t.Errorf("DecodeKeyUint32Host round trip = %x", v)
+	}
+	if v := DecodeKeyUint16Host(KeyUint16Host(443)); v != 443 {
+		t.Errorf("DecodeKeyUint16Host round trip = %d", v)
+	}
+
+	if nativeEndian == binary.LittleEndian && bytes.Equal(KeyUint16Host(8080), KeyUint16BE(8080)) {
+		t.Error("host and network order encodings should differ on a little-endian host")
+	}
+}
+
+func TestMapParametersIPAndPortKeys(t *testing.T) {
+	v4Map := MapParameters{Name: "cali_test4", KeySize: 4}
+	v6Map := MapParameters{Name: "cali_test6", KeySize: 16}
+	v4 := net.ParseIP("10.0.0.1")
+	v6 := net.ParseIP("fd00::1")
+
+	for _, tc := range []struct {
+		mp MapParameters
+		ip net.IP
+	}{{v4Map, v4}, {v6Map, v6}} {
+		k, err := tc.mp.IPKey(tc.ip)
+		if err != nil || !bytes.Equal(k, IPKey(tc.ip)) {
+			t.Errorf("%s.IPKey(%v) = %v, %v", tc.mp.Name, tc.ip, k, err)
+		}
+		decoded, err := tc.mp.DecodeIPKey(k)
+		if err != nil || !decoded.Equal(tc.ip) {
+			t.Errorf("%s.DecodeIPKey round trip of %v = %v, %v", tc.mp.Name, tc.ip, decoded, err)
+		}
+	}
+	if _, err := v4Map.IPKey(v6); err == nil {
+		t.Error("Expected an error for an IPv6 key in an IPv4 map")
+	}
+	if _, err := v6Map.IPKey(v4); err == nil {
+		t.Error("Expected an error for an IPv4 key in an IPv6 map")
+	}
+	if _, err := v4Map.IPKey(net.IP{1, 2}); err == nil {
+		t.Error("Expected an error for an invalid IP")
+	}
+	if _, err := v4Map.DecodeIPKey(IPKey(v6)); err == nil {
+		t.Error("Expected an error decoding an IPv6 key from an IPv4 map")
+	}
+
+	portMap := MapParameters{Name: "cali_testp", KeySize: 2}
+	k, err := portMap.PortKey(8080)
+	if err != nil || !bytes.Equal(k, []byte{0x1f, 0x90}) {
+		t.Errorf("PortKey = %v, %v", k, err)
+	}
+	if p, err := portMap.DecodePortKey(k); err != nil || p != 8080 {
+		t.Errorf("DecodePortKey round trip = %d, %v", p, err)
+	}
+	if _, err := v4Map.PortKey(8080); err == nil {
+		t.Error("Expected an error for a port key in a map with 4-byte keys")
+	}
+}
+
+func TestIPAndPortKeys(t *testing.T) {
+	v4 := net.ParseIP("10.0.0.1")
+	if b := IPKey(v4); !bytes.Equal(b, []byte{10, 0, 0, 1}) {
+		t.Errorf("IPKey(%v) = %v", v4, b)
+	}
+	v6 := net.ParseIP("fd00::1")
+	expectedV6 := []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	if b := IPKey(v6); !bytes.Equal(b, expectedV6) {
+		t.Errorf("IPKey(%v) = %v", v6, b)
+	}
+	if b := IPKey(net.IP{1, 2}); b != nil {
+		t.Errorf("IPKey of invalid IP = %v, expected nil", b)
+	}
+	for _, ip := range []net.IP{v4, v6} {
+		decoded, err := DecodeIPKey(IPKey(ip))
+		if err != nil || !decoded.Equal(ip) {
+			t.Errorf("DecodeIPKey round trip of %v = %v, %v", ip, decoded, err)
+		}
+	}
+	if _, err := DecodeIPKey([]byte{1, 2, 3}); err == nil {
+		t.Error("Expected an error decoding a 3-byte IP")
+	}
+
+	if b := PortKey(8080); !bytes.Equal(b, []byte{0x1f, 0x90}) {
+		t.Errorf("PortKey = %v", b)
+	}
+	if p, err := DecodePortKey(PortKey(443)); err != nil || p != 443 {
+		t.Errorf("DecodePortKey round trip = %d, %v", p, err)
+	}
+
+	mp := MapParameters{Name: "cali_test", KeySize: 4}
+	if err := mp.CheckKey(IPKey(v4)); err != nil {
+		t.Errorf("Unexpected error for IPv4 key: %v", err)
+	}
+	if err := mp.CheckKey(IPKey(v6)); err == nil {
+		t.Error("Expected an error for an IPv6 key in an IPv4 map")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// LPMKeyFromCIDR builds a key for an lpm_trie map from cidr, using the kernel's
+// struct bpf_lpm_trie_key layout: the prefix length as a host-order uint32 followed by the
+// network-order address.  Host bits are masked off.  Returns an error if the resulting key
+// doesn't match the map's KeySize (for example, an IPv6 CIDR for an IPv4 map).
+func (mp *MapParameters) LPMKeyFromCIDR(cidr *net.IPNet) ([]byte, error) {
+	key, err := lpmKeyFromCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != mp.KeySize {
+		return nil, errors.Errorf("LPM key for %v has size %d but map %s has key size %d",
+			cidr, len(key), mp.versionedName(), mp.KeySize)
+	}
+	return key, nil
+}
+
+func lpmKeyFromCIDR(cidr *net.IPNet) ([]byte, error) {
+	if cidr == nil {
+		return nil, errors.New("nil CIDR")
+	}
+	addr := cidr.IP.Mask(cidr.Mask)
+	if addr == nil {
+		return nil, errors.Errorf("CIDR %v has mismatched address and mask", cidr)
+	}
+	ones, bits := cidr.Mask.Size()
+	if bits == 0 {
+		return nil, errors.Errorf("CIDR %v has a non-canonical mask", cidr)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		if bits == 8*net.IPv6len {
+			// IPv4 address with a 16-byte mask; the first 96 bits are the v4-in-v6 prefix.
+			ones -= 8 * (net.IPv6len - net.IPv4len)
+		}
+		addr = v4
+	}
+	if ones < 0 {
+		return nil, errors.Errorf("CIDR %v has an invalid prefix length", cidr)
+	}
+
+	key := make([]byte, 4+len(addr))
+	nativeEndian.PutUint32(key[:4], uint32(ones))
+	copy(key[4:], addr)
+	return key, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestLPMKeyFromCIDR(t *testing.T) {
+	v4Params := MapParameters{Name: "cali_test_v4", Type: "lpm_trie", KeySize: 8}
+	v6Params := MapParameters{Name: "cali_test_v6", Type: "lpm_trie", KeySize: 20}
+
+	for _, tc := range []struct {
+		cidr     string
+		params   MapParameters
+		expected []byte
+	}{
+		{"10.0.1.0/24", v4Params, append(KeyUint32Host(24), 10, 0, 1, 0)},
+		{"10.0.1.7/24", v4Params, append(KeyUint32Host(24), 10, 0, 1, 0)},
+		{"10.0.1.7/32", v4Params, append(KeyUint32Host(32), 10, 0, 1, 7)},
+		{"0.0.0.0/0", v4Params, append(KeyUint32Host(0), 0, 0, 0, 0)},
+		{"fd00:1::/64", v6Params, append(KeyUint32Host(64),
+			0xfd, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+	} {
+		_, cidr, err := net.ParseCIDR(tc.cidr)
+		if err != nil {
+			t.Fatalf("Bad CIDR %s: %v", tc.cidr, err)
+		}
+		key, err := tc.params.LPMKeyFromCIDR(cidr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.cidr, err)
+			continue
+		}
+		if !bytes.Equal(key, tc.expected) {
+			t.Errorf("%s: got key %v, expected %v", tc.cidr, key, tc.expected)
+		}
+	}
+
+	// ParseCIDR zeroes the host bits; check a hand-built IPNet with a 16-byte mask too.
+	cidr := &net.IPNet{IP: net.ParseIP("192.168.3.4"), Mask: net.CIDRMask(120, 128)}
+	key, err := v4Params.LPMKeyFromCIDR(cidr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := append(KeyUint32Host(24), 192, 168, 3, 0); !bytes.Equal(key, expected) {
+		t.Errorf("Got key %v, expected %v", key, expected)
+	}
+}
+
+func TestLPMKeyFromCIDRWrongFamily(t *testing.T) {
+	v4Params := MapParameters{Name: "cali_test_v4", Type: "lpm_trie", KeySize: 8}
+	_, cidr, _ := net.ParseCIDR("fd00::/8")
+	if _, err := v4Params.LPMKeyFromCIDR(cidr); err == nil {
+		t.Error("Expected an error for an IPv6 CIDR and an IPv4 map")
+	}
+	if _, err := v4Params.LPMKeyFromCIDR(nil); err == nil {
+		t.Error("Expected an error for a nil CIDR")
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mapParametersJSON is the on-disk format of a map spec file.
+type mapParametersJSON struct {
+	Filename   string             `json:"filename"`
+	Type       string             `json:"type"`
+	KeySize    int                `json:"key_size"`
+	ValueSize  int                `json:"value_size"`
+	MaxEntries int                `json:"max_entries"`
+	Name       string             `json:"name"`
+	Flags      int                `json:"flags,omitempty"`
+	Version    int                `json:"version,omitempty"`
+	InnerMap   *mapParametersJSON `json:"inner_map,omitempty"`
+}
+
+func (spec *mapParametersJSON) params() MapParameters {
+	mp := MapParameters{
+		Filename:   spec.Filename,
+		Type:       spec.Type,
+		KeySize:    spec.KeySize,
+		ValueSize:  spec.ValueSize,
+		MaxEntries: spec.MaxEntries,
+		Name:       spec.Name,
+		Flags:      spec.Flags,
+		Version:    spec.Version,
+	}
+	if spec.InnerMap != nil {
+		inner := spec.InnerMap.params()
+		mp.InnerMap = &inner
+	}
+	return mp
+}
+
+func mapSpecFromParams(mp *MapParameters) (*mapParametersJSON, error) {
+	if mp.RepinFilter != nil || mp.ValueLayout != nil || mp.LazyCreate || mp.PinByName ||
+		mp.DeriveNameFrom != "" {
+		return nil, errors.Errorf("map %s has parameters that can't be written to a map spec", mp.Name)
+	}
+	spec := &mapParametersJSON{
+		Filename:   mp.Filename,
+		Type:       mp.Type,
+		KeySize:    mp.KeySize,
+		ValueSize:  mp.ValueSize,
+		MaxEntries: mp.MaxEntries,
+		Name:       mp.Name,
+		Flags:      mp.Flags,
+		Version:    mp.Version,
+	}
+	if mp.InnerMap != nil {
+		inner, err := mapSpecFromParams(mp.InnerMap)
+		if err != nil {
+			return nil, err
+		}
+		spec.InnerMap = inner
+	}
+	return spec, nil
+}
+
+// MapParametersFromJSON reads and validates a map spec, such as:
+//
+//   {"filename": "/sys/fs/bpf/tc/globals/cali_foo", "type": "hash",
+//    "key_size": 4, "value_size": 8, "max_entries": 1024, "name": "cali_foo"}
+//
+// The template for the inner maps of a map-in-map type goes in "inner_map".
+func MapParametersFromJSON(r io.Reader) (MapParameters, error) {
+	var spec mapParametersJSON
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return MapParameters{}, errors.Wrap(err, "failed to parse map spec")
+	}
+	mp := spec.params()
+	if err := mp.validate(); err != nil {
+		return MapParameters{}, err
+	}
+	if mp.InnerMap != nil {
+		if err := mp.InnerMap.validate(); err != nil {
+			return MapParameters{}, errors.WithMessage(err, "invalid inner map")
+		}
+	}
+	return mp, nil
+}
+
+// MapParametersToJSON encodes the parameters in the format read by MapParametersFromJSON.  It
+// returns an error if the parameters use options that the spec format can't represent, such as
+// a RepinFilter, rather than silently dropping them.
+func MapParametersToJSON(mp MapParameters) ([]byte, error) {
+	spec, err := mapSpecFromParams(&mp)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// Option modifies MapParameters; see NewMapParameters and MapParametersFromStruct.
+type Option func(mp *MapParameters)
+
+func WithType(t string) Option {
+	return func(mp *MapParameters) { mp.Type = t }
+}
+
+func WithName(name string) Option {
+	return func(mp *MapParameters) { mp.Name = name }
+}
+
+func WithFilename(filename string) Option {
+	return func(mp *MapParameters) { mp.Filename = filename }
+}
+
+func WithMaxEntries(n int) Option {
+	return func(mp *MapParameters) { mp.MaxEntries = n }
+}
+
+func WithFlags(flags int) Option {
+	return func(mp *MapParameters) { mp.Flags = flags }
+}
+
+func WithVersion(version int) Option {
+	return func(mp *MapParameters) { mp.Version = version }
+}
+
+// WithNoPrealloc adds BPF_F_NO_PREALLOC to the map's flags, so that a hash map allocates its
+// entries as they're added rather than all up front.  It must come after any WithFlags option,
+// which replaces the flags.
+func WithNoPrealloc() Option {
+	return func(mp *MapParameters) { mp.Flags |= unix.BPF_F_NO_PREALLOC }
+}
+
+// defaultPinPath returns the path that a map with the given name is pinned to if no filename is
+// given.
+func defaultPinPath(name string) string {
+	return "/sys/fs/bpf/tc/globals/" + name
+}
+
+const (
+	// derivedNamePrefix starts every derived map name, so that derived maps are recognised as
+	// ours, like the rest of our maps.
+	derivedNamePrefix = "cali_"
+	// derivedNameHashLen is the number of hex digits of the parameter hash in a derived name.
+	derivedNameHashLen = 6
+)
+
+// DerivedName returns a map name that is derived from feature and a hash of the full feature
+// string and params' type, key size, value size, flags and version.  It is of the form
+// cali_<feature>_<hash>, with feature truncated (and any characters that the kernel doesn't
+// allow in names replaced by underscores) so that the versioned name fits in BPF_OBJ_NAME_LEN
+// for versions of up to three digits.  Unlike truncating a hand-written name, features that share
+// a prefix, or the same feature with a different layout, get different names unless their hashes
+// collide.  MaxEntries, Name and Filename aren't hashed, so that resizing a map doesn't change
+// its name.
+//
+// The name is used to find existing maps, so it must be stable: for given inputs, DerivedName
+// returns the same name in every release.  The hash input and encoding must never change.
+func DerivedName(feature string, params MapParameters) string {
+	return derivedName(feature, params, 0)
+}
+
+// derivedName is DerivedName, with the feature truncated further to leave room for reserved
+// characters, such as a MapContext's NamePrefix, in front of the name.
+func derivedName(feature string, params MapParameters, reserved int) string {
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s|%s|%d|%d|%d|%d",
+		feature, params.Type, params.KeySize, params.ValueSize, params.Flags, params.Version)
+	hash := fmt.Sprintf("%0*x", derivedNameHashLen, h.Sum32()&(1<<(4*derivedNameHashLen)-1))
+
+	maxLen := unix.BPF_OBJ_NAME_LEN - 1 - len(versionedStr(params.Version, ""))
+	featureLen := maxLen - reserved - len(derivedNamePrefix) - 1 - len(hash)
+	sanitized := []byte(feature)
+	for i, c := range sanitized {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.') {
+			sanitized[i] = '_'
+		}
+	}
+	if featureLen < 0 {
+		// Only possible with a version of four or more digits, or a long reserved prefix;
+		// validation will reject the name.
+		featureLen = 0
+	}
+	if len(sanitized) > featureLen {
+		sanitized = sanitized[:featureLen]
+	}
+	return derivedNamePrefix + string(sanitized) + "_" + hash
+}
+
+// withDerivedName sets the name, and the filename if it is empty, from DeriveNameFrom, if set.
+// The name leaves room for a name prefix of prefixLen characters.
+func (mp MapParameters) withDerivedName(prefixLen int) MapParameters {
+	if mp.DeriveNameFrom == "" {
+		return mp
+	}
+	mp.Name = derivedName(mp.DeriveNameFrom, mp, prefixLen)
+	if mp.Filename == "" {
+		mp.Filename = defaultPinPath(mp.Name)
+	}
+	return mp
+}
+
+// NewMapParameters returns parameters for a map with the given name, type and sizes, modified
+// by opts.  The filename defaults to /sys/fs/bpf/tc/globals/<name>.  It returns an error if the
+// name is empty or the parameters are otherwise invalid, for example if a size is zero.
+func NewMapParameters(name, typ string, keySize, valueSize, maxEntries int, opts ...Option) (MapParameters, error) {
+	mp := MapParameters{
+		Type:       typ,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+		Name:       name,
+	}
+	for _, opt := range opts {
+		opt(&mp)
+	}
+	if mp.Name == "" {
+		return MapParameters{}, errors.New("BPF map name is required")
+	}
+	if mp.Filename == "" {
+		mp.Filename = defaultPinPath(mp.Name)
+	}
+	if err := mp.validate(); err != nil {
+		return MapParameters{}, err
+	}
+	return mp, nil
+}
+
+// mapStructTag is the struct tag that MapParametersFromStruct reads.
+const mapStructTag = "bpfmap"
+
+// MapParametersFromStruct derives map parameters from the Go types used for the map's keys and
+// values, so that the sizes can't drift from the structs that are marshalled into the map.  The
+// key and value sizes are the encoded sizes of keyType and valueType (which may be values or
+// pointers) as computed by binary.Size, so the types must be fixed-size.  The map's type, name
+// and max entries can be given by a "bpfmap" tag on a blank field of either struct:
+//
+//   type natValue struct {
+//       _     struct{} `bpfmap:"type=hash,name=cali_v4_nat_fe,max_entries=65536"`
+//       ID    uint32
+//       Count uint32
+//   }
+//
+// The filename defaults to /sys/fs/bpf/tc/globals/<name>.  opts are applied last so they
+// override the tag.
+func MapParametersFromStruct(keyType, valueType interface{}, opts ...Option) (MapParameters, error) {
+	var mp MapParameters
+	var err error
+	if mp.KeySize, err = fixedSize(keyType); err != nil {
+		return MapParameters{}, errors.WithMessage(err, "invalid key type")
+	}
+	if mp.ValueSize, err = fixedSize(valueType); err != nil {
+		return MapParameters{}, errors.WithMessage(err, "invalid value type")
+	}
+
+	tagged := false
+	for _, t := range []interface{}{keyType, valueType} {
+		tag, ok := findMapStructTag(t)
+		if !ok {
+			continue
+		}
+		if tagged {
+			return MapParameters{}, errors.Errorf("both key and value types have a %s tag", mapStructTag)
+		}
+		tagged = true
+		if err := mp.applyStructTag(tag); err != nil {
+			return MapParameters{}, err
+		}
+	}
+
+	for _, opt := range opts {
+		opt(&mp)
+	}
+	if mp.Filename == "" && mp.Name != "" {
+		mp.Filename = defaultPinPath(mp.Name)
+	}
+	if err := mp.validate(); err != nil {
+		return MapParameters{}, err
+	}
+	return mp, nil
+}
+
+func fixedSize(v interface{}) (int, error) {
+	if v == nil {
+		return 0, errors.New("type is nil")
+	}
+	size := binary.Size(v)
+	if size < 0 {
+		return 0, errors.Errorf("%T is not fixed-size", v)
+	}
+	return size, nil
+}
+
+// ValidateValueLayout checks that sample, a value (or pointer to a value) of the Go type that
+// is marshalled into the map's values, has an encoded size, as computed by binary.Size, equal to
+// ValueSize.  It also checks that the type has no implicit padding: the Go compiler pads structs
+// for alignment but binary.Write doesn't, and the C compiler may pad differently, so any padding
+// must be given as explicit blank fields for the Go and C layouts to be sure to agree.
+func (mp *MapParameters) ValidateValueLayout(sample interface{}) error {
+	size, err := fixedSize(sample)
+	if err != nil {
+		return errors.WithMessagef(err, "invalid value layout for map %s", mp.versionedName())
+	}
+	if size != mp.ValueSize {
+		return errors.Errorf("value layout %T of map %s has size %d but the map's value size is %d",
+			sample, mp.versionedName(), size, mp.ValueSize)
+	}
+	t := reflect.TypeOf(sample)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if err := checkNoPadding(t, t.Name()); err != nil {
+		return errors.WithMessagef(err, "value layout %T of map %s", sample, mp.versionedName())
+	}
+	return nil
+}
+
+// checkNoPadding returns an error naming the first place where the Go compiler has inserted
+// padding into t.  path is the name of t, for use in the error.
+func checkNoPadding(t reflect.Type, path string) error {
+	switch t.Kind() {
+	case reflect.Struct:
+		var offset uintptr
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Offset != offset {
+				return errors.Errorf("has %d bytes of implicit padding before field %s.%s",
+					f.Offset-offset, path, f.Name)
+			}
+			if err := checkNoPadding(f.Type, path+"."+f.Name); err != nil {
+				return err
+			}
+			offset += f.Type.Size()
+		}
+		if offset != t.Size() {
+			return errors.Errorf("has %d bytes of implicit padding at the end of %s", t.Size()-offset, path)
+		}
+	case reflect.Array:
+		return checkNoPadding(t.Elem(), path+"[]")
+	}
+	return nil
+}
+
+func findMapStructTag(v interface{}) (string, bool) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return "", false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup(mapStructTag); ok {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// applyStructTag parses a tag of the form "type=hash,name=cali_foo,max_entries=1024".
+func (mp *MapParameters) applyStructTag(tag string) error {
+	for _, part := range strings.Split(tag, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("malformed %s tag item %q", mapStructTag, part)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "type":
+			mp.Type = value
+		case "name":
+			mp.Name = value
+		case "max_entries":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Errorf("invalid max_entries %q in %s tag", value, mapStructTag)
+			}
+			mp.MaxEntries = n
+		default:
+			return errors.Errorf("unknown %s tag item %q", mapStructTag, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMapParametersJSONRoundTrip(t *testing.T) {
+	params := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_v4_ct",
+		Type:       "hash",
+		KeySize:    16,
+		ValueSize:  64,
+		MaxEntries: 512000,
+		Name:       "cali_v4_ct",
+		Flags:      1,
+		Version:    2,
+	}
+	data, err := MapParametersToJSON(params)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	parsed, err := MapParametersFromJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", data, err)
+	}
+	if !reflect.DeepEqual(parsed, params) {
+		t.Errorf("round trip mismatch: %+v != %+v", parsed, params)
+	}
+
+	// Map-in-map specs carry their inner map template.
+	outer := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_outer",
+		Type:       "hash_of_maps",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_outer",
+		InnerMap: &MapParameters{
+			Type:       "hash",
+			KeySize:    4,
+			ValueSize:  8,
+			MaxEntries: 32,
+			Name:       "cali_inner",
+		},
+	}
+	data, err = MapParametersToJSON(outer)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	parsed, err = MapParametersFromJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", data, err)
+	}
+	if !reflect.DeepEqual(parsed, outer) {
+		t.Errorf("round trip mismatch: %+v != %+v", parsed, outer)
+	}
+
+	// Parameters that the spec can't represent are an error, not silently dropped.
+	params.RepinFilter = func(k, v []byte) bool { return true }
+	if _, err := MapParametersToJSON(params); err == nil {
+		t.Error("expected an error for parameters with a RepinFilter")
+	}
+
+	// Encoding the struct itself, for example when logging, is unaffected.
+	data, err = json.Marshal(outer)
+	if err != nil || !strings.Contains(string(data), "InnerMap") {
+		t.Errorf("expected default encoding of MapParameters, got %s, %v", data, err)
+	}
+}
+
+func TestMapParametersFromJSONInvalid(t *testing.T) {
+	for _, spec := range []string{
+		`not json`,
+		`{"type": "hash", "key_size": 4, "value_size": 4, "max_entries": 10, "name": "cali_x", "bogus": 1}`,
+		`{"type": "nope", "key_size": 4, "value_size": 4, "max_entries": 10, "name": "cali_x"}`,
+		`{"type": "hash", "key_size": 0, "value_size": 4, "max_entries": 10, "name": "cali_x"}`,
+		`{"type": "hash", "key_size": 4, "value_size": 4, "max_entries": -1, "name": "cali_x"}`,
+		`{"type": "hash", "key_size": 4, "value_size": 4, "max_entries": 10, "name": "cali_name_too_long"}`,
+	} {
+		if _, err := MapParametersFromJSON(strings.NewReader(spec)); err == nil {
+			t.Errorf("expected error for spec %s", spec)
+		}
+	}
+}
+
+type testStructKey struct {
+	Addr [4]byte
+	Port uint16
+	Pad  uint16
+}
+
+type testStructValue struct {
+	_       struct{} `bpfmap:"type=lru_hash,name=cali_v4_tst,max_entries=1024"`
+	Packets uint64
+	Bytes   uint64
+	Flags   uint32
+}
+
+func TestMapParametersFromStruct(t *testing.T) {
+	params, err := MapParametersFromStruct(testStructKey{}, &testStructValue{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_v4_tst",
+		Type:       "lru_hash",
+		KeySize:    8,
+		ValueSize:  20,
+		MaxEntries: 1024,
+		Name:       "cali_v4_tst",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("MapParametersFromStruct() = %+v, expected %+v", params, expected)
+	}
+
+	// Options override the tag; untagged types need options for everything else.
+	params, err = MapParametersFromStruct(testStructKey{}, &testStructValue{}, WithMaxEntries(10), WithVersion(2))
+	if err != nil || params.MaxEntries != 10 || params.Version != 2 {
+		t.Errorf("options not applied: %+v, %v", params, err)
+	}
+	params, err = MapParametersFromStruct(uint32(0), uint64(0),
+		WithType("array"), WithName("cali_arr"), WithMaxEntries(4))
+	if err != nil || params.KeySize != 4 || params.ValueSize != 8 || params.Type != "array" {
+		t.Errorf("unexpected result for untagged types: %+v, %v", params, err)
+	}
+}
+
+func TestMapParametersFromStructInvalid(t *testing.T) {
+	type variableSize struct {
+		Data []byte
+	}
+	type badTag struct {
+		_ struct{} `bpfmap:"type=hash,colour=blue"`
+		A uint32
+	}
+	for _, tc := range []struct {
+		name       string
+		key, value interface{}
+	}{
+		{"variable size", variableSize{}, testStructValue{}},
+		{"nil type", nil, testStructValue{}},
+		{"unknown tag item", uint32(0), badTag{}},
+		{"tags on both", testStructValue{}, testStructValue{}},
+		{"no type or name", uint32(0), uint32(0)},
+	} {
+		if _, err := MapParametersFromStruct(tc.key, tc.value); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestNewMapParameters(t *testing.T) {
+	params, err := NewMapParameters("cali_test", "hash", 4, 8, 1024, WithVersion(2), WithNoPrealloc())
+	if err != nil {
+		t.Fatalf("NewMapParameters failed: %v", err)
+	}
+	expected := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1024,
+		Name:       "cali_test",
+		Flags:      unix.BPF_F_NO_PREALLOC,
+		Version:    2,
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Got %+v, expected %+v", params, expected)
+	}
+
+	params, err = NewMapParameters("cali_test", "lpm_trie", 8, 4, 16,
+		WithFilename("/sys/fs/bpf/cali_other"), WithFlags(0x10), WithNoPrealloc())
+	if err != nil || params.Filename != "/sys/fs/bpf/cali_other" || params.Flags != 0x10|unix.BPF_F_NO_PREALLOC {
+		t.Errorf("Unexpected result with options: %+v, %v", params, err)
+	}
+
+	for _, tc := range []struct {
+		name                           string
+		mapName, typ                   string
+		keySize, valueSize, maxEntries int
+	}{
+		{"no name", "", "hash", 4, 4, 16},
+		{"zero key size", "cali_test", "hash", 0, 4, 16},
+		{"zero value size", "cali_test", "hash", 4, 0, 16},
+		{"zero max entries", "cali_test", "hash", 4, 4, 0},
+		{"unknown type", "cali_test", "hashy", 4, 4, 16},
+	} {
+		if _, err := NewMapParameters(tc.mapName, tc.typ, tc.keySize, tc.valueSize, tc.maxEntries); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestValidateValueLayout(t *testing.T) {
+	type packed struct {
+		A uint32
+		B uint16
+		_ [2]byte
+		C [2]uint32
+	}
+	type padded struct {
+		A uint16
+		B uint32
+	}
+	type trailingPadding struct {
+		A uint32
+		B uint8
+	}
+	type nestedPadding struct {
+		A   uint64
+		Sub [2]trailingPadding
+	}
+	params := MapParameters{Name: "cali_test", ValueSize: 16}
+	if err := params.ValidateValueLayout(packed{}); err != nil {
+		t.Errorf("Unexpected error for packed struct: %v", err)
+	}
+	if err := params.ValidateValueLayout(&packed{}); err != nil {
+		t.Errorf("Unexpected error for pointer to packed struct: %v", err)
+	}
+
+	params.ValueSize = 6
+	err := params.ValidateValueLayout(padded{})
+	if err == nil || !strings.Contains(err.Error(), "padding before field padded.B") {
+		t.Errorf("Expected padding error for padded struct, got %v", err)
+	}
+	params.ValueSize = 5
+	err = params.ValidateValueLayout(trailingPadding{})
+	if err == nil || !strings.Contains(err.Error(), "padding at the end of trailingPadding") {
+		t.Errorf("Expected trailing padding error, got %v", err)
+	}
+	params.ValueSize = 18
+	err = params.ValidateValueLayout(nestedPadding{})
+	if err == nil || !strings.Contains(err.Error(), "nestedPadding.Sub[]") {
+		t.Errorf("Expected padding error for nested struct, got %v", err)
+	}
+
+	// Size mismatch and types that aren't fixed-size.
+	params.ValueSize = 8
+	if err := params.ValidateValueLayout(packed{}); err == nil {
+		t.Error("Expected an error for the wrong size")
+	}
+	if err := params.ValidateValueLayout(struct{ S string }{}); err == nil {
+		t.Error("Expected an error for a type that isn't fixed-size")
+	}
+
+	// EnsureExists checks the layout before touching the BPF filesystem.
+	m := (&MapContext{}).newPinnedMap(MapParameters{
+		Filename:    "/sys/fs/bpf/tc/globals/cali_test",
+		Type:        "hash",
+		KeySize:     4,
+		ValueSize:   6,
+		MaxEntries:  1,
+		Name:        "cali_test",
+		ValueLayout: padded{},
+	})
+	if err := m.EnsureExists(); err == nil || !strings.Contains(err.Error(), "padding") {
+		t.Errorf("Expected EnsureExists to reject the padded layout, got %v", err)
+	}
+}
+
+func TestDerivedName(t *testing.T) {
+	params := MapParameters{Type: "hash", KeySize: 16, ValueSize: 8, MaxEntries: 1024}
+
+	// The names must never change, or we'd lose track of existing maps.
+	if name := DerivedName("nat_frontend", params); name != "cali_nat_5d454e" {
+		t.Errorf("Derived name changed: %q", name)
+	}
+	v3 := params
+	v3.Version = 3
+	if name := DerivedName("nat_frontend", v3); name != "cali_na_5d43bb" {
+		t.Errorf("Derived name changed: %q", name)
+	}
+
+	// Deterministic, and independent of the fields that aren't hashed.
+	resized := params
+	resized.MaxEntries = 2048
+	resized.Name = "cali_other"
+	if DerivedName("nat_frontend", params) != DerivedName("nat_frontend", resized) {
+		t.Error("Derived name depends on max entries or name")
+	}
+
+	// Features that truncate to the same prefix, and layouts that differ, get different names.
+	wider := params
+	wider.ValueSize = 16
+	names := map[string]bool{}
+	for _, n := range []string{
+		DerivedName("nat_frontend", params),
+		DerivedName("nat_backend", params),
+		DerivedName("nat_frontend", wider),
+	} {
+		if names[n] {
+			t.Errorf("Derived name %q collides", n)
+		}
+		names[n] = true
+	}
+
+	// The versioned name always fits.
+	for _, feature := range []string{"", "x", "a_very_long_feature_name_indeed", "bad/chars here"} {
+		for _, version := range []int{0, 1, 2, 10, 100} {
+			p := params
+			p.Version = version
+			p.Name = DerivedName(feature, p)
+			if len(p.versionedName()) > unix.BPF_OBJ_NAME_LEN-1 {
+				t.Errorf("Derived name %q is too long for version %d", p.versionedName(), version)
+			}
+			if !strings.HasPrefix(p.Name, "cali_") || strings.ContainsAny(p.Name, "/ ") {
+				t.Errorf("Unexpected derived name %q", p.Name)
+			}
+		}
+	}
+}
+
+func TestDeriveNameFrom(t *testing.T) {
+	params := MapParameters{Type: "hash", KeySize: 16, ValueSize: 8, MaxEntries: 1024, DeriveNameFrom: "nat_frontend"}
+	m, err := (&MapContext{}).NewPinnedMapE(params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.GetName() != "cali_nat_5d454e" || m.Path() != "/sys/fs/bpf/tc/globals/cali_nat_5d454e" {
+		t.Errorf("Unexpected name %q and path %q", m.GetName(), m.Path())
+	}
+
+	// The feature is shortened to leave room for the context's name prefix.
+	m, err = (&MapContext{NamePrefix: "ab"}).NewPinnedMapE(params)
+	if err != nil {
+		t.Fatalf("Expected a derived name to fit with a name prefix: %v", err)
+	}
+	if m.GetName() != "abcali_n_5d454e" {
+		t.Errorf("Unexpected prefixed name %q", m.GetName())
+	}
+
+	params.Filename = "/sys/fs/bpf/tc/globals/custom"
+	m, err = (&MapContext{}).NewPinnedMapE(params)
+	if err != nil || m.Path() != params.Filename {
+		t.Errorf("Expected an explicit filename to be kept, got %q, %v", m.Path(), err)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mapTypes maps the type names used by bpftool (and in MapParameters.Type) to the kernel's
+// enum bpf_map_type values.
+var mapTypes = map[string]uint32{
+	"hash":                  1,
+	"array":                 2,
+	"prog_array":            3,
+	"perf_event_array":      4,
+	"percpu_hash":           5,
+	"percpu_array":          6,
+	"stack_trace":           7,
+	"cgroup_array":          8,
+	"lru_hash":              9,
+	"lru_percpu_hash":       10,
+	"lpm_trie":              11,
+	"array_of_maps":         12,
+	"hash_of_maps":          13,
+	"devmap":                14,
+	"sockmap":               15,
+	"cpumap":                16,
+	"xskmap":                17,
+	"sockhash":              18,
+	"cgroup_storage":        19,
+	"reuseport_sockarray":   20,
+	"percpu_cgroup_storage": 21,
+	"queue":                 22,
+	"stack":                 23,
+	"sk_storage":            24,
+	"devmap_hash":           25,
+	"struct_ops":            26,
+	"ringbuf":               27,
+	"inode_storage":         28,
+	"task_storage":          29,
+	"bloom_filter":          30,
+}
+
+// mapTypesWithoutDelete lists the map types whose entries can't be deleted by key:
+//
+//   - array, percpu_array: entries always exist; "deleting" means writing a zero value.
+//   - cgroup_storage, percpu_cgroup_storage: entries are tied to the lifetime of the cgroup.
+//   - queue, stack: entries are removed by popping, not by key.
+//   - bloom_filter: elements can only be added.
+//   - ringbuf, struct_ops: not key/value maps in the usual sense.
+//
+// All other types (hashes, tries, and the fd-valued arrays such as prog_array and array_of_maps)
+// support BPF_MAP_DELETE_ELEM.
+var mapTypesWithoutDelete = map[string]bool{
+	"array":                 true,
+	"percpu_array":          true,
+	"cgroup_storage":        true,
+	"percpu_cgroup_storage": true,
+	"queue":                 true,
+	"stack":                 true,
+	"bloom_filter":          true,
+	"ringbuf":               true,
+	"struct_ops":            true,
+}
+
+// keylessMapTypes lists the map types that have no key, so they must be created with key size 0.
+var keylessMapTypes = map[string]bool{
+	"queue":        true,
+	"stack":        true,
+	"bloom_filter": true,
+}
+
+// MapTypeSupportsDelete returns true if entries of maps of the given type can be deleted by key.
+func MapTypeSupportsDelete(typeStr string) bool {
+	return !mapTypesWithoutDelete[typeStr]
+}
+
+// MapTypeID returns the kernel's numeric ID for the given map type name.
+func MapTypeID(typeStr string) (uint32, bool) {
+	id, ok := mapTypes[typeStr]
+	return id, ok
+}
+
+// MapTypeName returns the name of the map type with the given kernel ID, or "" if the ID is unknown.
+func MapTypeName(id uint32) string {
+	for name, typeID := range mapTypes {
+		if typeID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// probeParams returns the parameters for a minimal map of the given type, for use by
+// MapTypeSupported, or false if the type can't be probed this way.  The storage map types
+// (sk_storage etc.) need BTF and struct_ops needs a kernel struct, so they aren't supported.
+func probeParams(typeStr string) (MapParameters, bool) {
+	params := MapParameters{
+		Type:       typeStr,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+		Name:       "cali_probe",
+	}
+	switch typeStr {
+	case "sk_storage", "inode_storage", "task_storage", "struct_ops":
+		return params, false
+	case "lpm_trie":
+		params.KeySize = 8
+		params.Flags = unix.BPF_F_NO_PREALLOC
+	case "queue", "stack", "bloom_filter":
+		params.KeySize = 0
+	case "ringbuf":
+		params.KeySize = 0
+		params.ValueSize = 0
+		params.MaxEntries = os.Getpagesize()
+	case "cgroup_storage", "percpu_cgroup_storage":
+		// Key is struct bpf_cgroup_storage_key (padded to 16 bytes); max_entries must be 0.
+		params.KeySize = 16
+		params.MaxEntries = 0
+	case "array_of_maps", "hash_of_maps":
+		params.InnerMap = &MapParameters{
+			Type:       "array",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+			Name:       "cali_probe_in",
+		}
+	}
+	if _, ok := mapTypes[typeStr]; !ok {
+		return params, false
+	}
+	return params, true
+}
+
+var (
+	mapTypeSupportLock  sync.Mutex
+	mapTypeSupportCache = map[string]bool{}
+
+	// createProbeMap is a var so that tests can stub it out.
+	createProbeMap = CreateMap
+)
+
+// MapTypeSupported returns true if the kernel supports maps of the given type.  It finds out by
+// trying to create, and then closing, a tiny map of that type so it needs the same privileges
+// as creating maps.  EINVAL (or E2BIG, from kernels that predate the type's attributes) means
+// that the type isn't supported.  EPERM means that we can't tell, so it is returned as an error.
+// Definite results are cached for the life of the process.
+func MapTypeSupported(typeStr string) (bool, error) {
+	mapTypeSupportLock.Lock()
+	defer mapTypeSupportLock.Unlock()
+	if supported, ok := mapTypeSupportCache[typeStr]; ok {
+		return supported, nil
+	}
+
+	params, ok := probeParams(typeStr)
+	if !ok {
+		return false, errors.Errorf("can't probe support for map type %q", typeStr)
+	}
+	fd, err := createProbeMap(params)
+	switch errors.Cause(err) {
+	case nil:
+		_ = fd.Close()
+		mapTypeSupportCache[typeStr] = true
+		return true, nil
+	case unix.EINVAL, unix.E2BIG:
+		mapTypeSupportCache[typeStr] = false
+		return false, nil
+	case unix.EPERM:
+		return false, errors.Wrapf(err, "not permitted to create a map to probe for type %s", typeStr)
+	}
+	return false, errors.WithMessagef(err, "failed to probe for map type %s", typeStr)
+}
+
+// maxEntriesProbeLimit is the largest max_entries that MaxEntriesLimit tries.  The probe is
+// further bounded by probeMemoryBudget so that it never tries to allocate more memory than the
+// host can spare.
+const maxEntriesProbeLimit = 1 << 24
+
+// probeEntryOverhead approximates the kernel's per-entry bookkeeping for a map element (for
+// example, struct htab_elem), in bytes.
+const probeEntryOverhead = 64
+
+// probeMemoryBudget returns the number of bytes that a single probe map may use: the smaller of
+// RLIMIT_MEMLOCK (which older kernels charge maps to), if finite, and half of the free memory.  It
+// is a var so that tests can mock it.
+var probeMemoryBudget = func() (uint64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, errors.Wrap(err, "failed to read available memory")
+	}
+	budget := uint64(info.Freeram) * uint64(info.Unit) / 2
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rlim); err != nil {
+		return 0, errors.Wrap(err, "failed to read RLIMIT_MEMLOCK")
+	}
+	if rlim.Cur != unix.RLIM_INFINITY && rlim.Cur < budget {
+		budget = rlim.Cur
+	}
+	return budget, nil
+}
+
+// probeEntrySize estimates the memory that one entry of a map with the given parameters uses.
+func probeEntrySize(params MapParameters) (uint64, error) {
+	roundUp := func(n int) uint64 { return uint64(n+7) &^ 7 }
+	valueSize := roundUp(params.ValueSize)
+	if strings.Contains(params.Type, "percpu") {
+		numCPUs, err := NumPossibleCPUs()
+		if err != nil {
+			return 0, err
+		}
+		valueSize *= uint64(numCPUs)
+	}
+	return roundUp(params.KeySize) + valueSize + probeEntryOverhead, nil
+}
+
+type maxEntriesKey struct {
+	typeStr            string
+	keySize, valueSize int
+}
+
+var (
+	maxEntriesLimitLock  sync.Mutex
+	maxEntriesLimitCache = map[maxEntriesKey]int{}
+)
+
+// MaxEntriesLimit estimates the largest max_entries with which a map of the given type and sizes
+// can be created, up to 2^24 and up to what fits in the probe memory budget, so that oversized
+// configuration can be clamped before creating the map fails.  It binary-searches by creating (and
+// closing) maps; hash maps are probed with BPF_F_NO_PREALLOC so that they don't allocate their
+// entries up front, but other types briefly allocate their full size.  ENOMEM, E2BIG and EPERM
+// (from kernels that charge maps to RLIMIT_MEMLOCK) mean that a size is too big.  The result is
+// only an estimate: other maps, other processes and memory pressure all change the real limit
+// over time.  Results are cached for the life of the process.
+func MaxEntriesLimit(typeStr string, keySize, valueSize int) (int, error) {
+	key := maxEntriesKey{typeStr, keySize, valueSize}
+	maxEntriesLimitLock.Lock()
+	defer maxEntriesLimitLock.Unlock()
+	if limit, ok := maxEntriesLimitCache[key]; ok {
+		return limit, nil
+	}
+
+	params, ok := probeParams(typeStr)
+	if !ok || params.MaxEntries != 1 {
+		return 0, errors.Errorf("can't probe max entries for map type %q", typeStr)
+	}
+	params.KeySize = keySize
+	params.ValueSize = valueSize
+	switch typeStr {
+	case "hash", "percpu_hash", "hash_of_maps":
+		params.Flags |= unix.BPF_F_NO_PREALLOC
+	}
+	entrySize, err := probeEntrySize(params)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "failed to size probe for map type %s", typeStr)
+	}
+	budget, err := probeMemoryBudget()
+	if err != nil {
+		return 0, err
+	}
+	probeLimit := maxEntriesProbeLimit
+	if n := budget / entrySize; n < uint64(probeLimit) {
+		probeLimit = int(n)
+	}
+	if probeLimit < 1 {
+		probeLimit = 1
+	}
+
+	tryCreate := func(maxEntries int) (bool, error) {
+		params.MaxEntries = maxEntries
+		fd, err := createProbeMap(params)
+		switch errors.Cause(err) {
+		case nil:
+			_ = fd.Close()
+			return true, nil
+		case unix.ENOMEM, unix.E2BIG, unix.EPERM:
+			return false, nil
+		}
+		return false, errors.WithMessagef(err, "failed to probe max entries for map type %s", typeStr)
+	}
+
+	// Check that we can create the smallest map at all, so that a lack of privileges or bad
+	// parameters aren't mistaken for a size limit.
+	fd, err := createProbeMap(params)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "failed to create map of type %s", typeStr)
+	}
+	_ = fd.Close()
+
+	lo, hi := 1, probeLimit
+	ok, err = tryCreate(hi)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		lo = hi
+	}
+	// Invariant: lo can be created, hi can't (unless lo == hi).
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := tryCreate(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	maxEntriesLimitCache[key] = lo
+	return lo, nil
+}
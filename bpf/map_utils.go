@@ -0,0 +1,357 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIterTimeout is returned by IterTimeout if it stopped before reaching the end of the map.
+var ErrIterTimeout = errors.New("iteration timed out")
+
+// iterTimeoutCheckInterval is the number of entries between IterTimeout's checks of the clock.
+const iterTimeoutCheckInterval = 32
+
+// Entry is a single key/value pair from a map.  It is the type returned by the APIs that collect
+// entries, such as Diff, Snapshot.Entries and IterPage; MapIter callbacks get the key and value
+// separately, without a copy.
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Clone returns a deep copy of the entry, which can be retained after the buffers that the entry
+// refers to are reused.  A nil key or value stays nil.
+func (e Entry) Clone() Entry {
+	return Entry{
+		Key:   cloneBytes(e.Key),
+		Value: cloneBytes(e.Value),
+	}
+}
+
+// Equal returns true if the two entries have the same key and value.  As with bytes.Equal, a nil
+// slice is equal to an empty one.
+func (e Entry) Equal(other Entry) bool {
+	return bytes.Equal(e.Key, other.Key) && bytes.Equal(e.Value, other.Value)
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// Entries returns a copy of every entry in the map, in iteration order.
+func Entries(m Map) ([]Entry, error) {
+	var entries []Entry
+	err := m.Iter(func(k, v []byte) {
+		entries = append(entries, Entry{Key: k, Value: v}.Clone())
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to iterate map %s", m.GetName())
+	}
+	return entries, nil
+}
+
+// IterChunked iterates over the map, passing the entries to f in batches of at most chunkSize
+// entries, so that the caller can checkpoint its progress between batches.  If f returns an
+// error, iteration stops and the error is returned.
+func IterChunked(m Map, chunkSize int, f func(batch []Entry) error) error {
+	if chunkSize <= 0 {
+		return errors.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	var fErr error
+	batch := make([]Entry, 0, chunkSize)
+	err := m.Iter(func(k, v []byte) {
+		if fErr != nil {
+			return
+		}
+		batch = append(batch, Entry{Key: k, Value: v}.Clone())
+		if len(batch) == chunkSize {
+			fErr = f(batch)
+			batch = make([]Entry, 0, chunkSize)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if fErr != nil {
+		return fErr
+	}
+	if len(batch) > 0 {
+		return f(batch)
+	}
+	return nil
+}
+
+// IterWithStop iterates over the map, calling f for each entry until f returns false.  Map.Iter
+// can't be interrupted, so the remaining entries are still read (for PinnedMap, the whole
+// bpftool dump has already been read anyway) but f isn't called for them.
+func IterWithStop(m Map, f func(k, v []byte) (cont bool)) error {
+	stopped := false
+	return m.Iter(func(k, v []byte) {
+		if stopped {
+			return
+		}
+		stopped = !f(k, v)
+	})
+}
+
+// IterTransform iterates over the map, passing each value through transform before calling f with
+// the result; for example, to subtract a baseline from counters or to mask out fields.  transform
+// is given a copy of the value so it may modify and return it in place; the map itself is never
+// written.
+func IterTransform(m Map, transform func(k, v []byte) []byte, f MapIter) error {
+	return m.Iter(func(k, v []byte) {
+		f(k, transform(k, append([]byte(nil), v...)))
+	})
+}
+
+// IterValueFilter iterates over the map, calling f only for the entries whose value passes pred;
+// for example, to find counters over a threshold.  BPF maps can't be queried by value so every
+// entry is still read.
+func IterValueFilter(m Map, pred func(v []byte) bool, f MapIter) error {
+	return IterWithStop(m, func(k, v []byte) bool {
+		if pred(v) {
+			f(k, v)
+		}
+		return true
+	})
+}
+
+// IterExcept iterates over the map, skipping the entries whose keys are in exclude; for example,
+// control entries stored at well-known keys alongside the data.  If the map can check its keys
+// (PinnedMap and the mock map can), the excluded keys are validated before iterating.
+func IterExcept(m Map, exclude [][]byte, f MapIter) error {
+	checker, canCheck := m.(interface{ CheckKey(k []byte) error })
+	excluded := make(map[string]bool, len(exclude))
+	for _, k := range exclude {
+		if canCheck {
+			if err := checker.CheckKey(k); err != nil {
+				return errors.WithMessage(err, "invalid excluded key")
+			}
+		}
+		excluded[string(k)] = true
+	}
+	return m.Iter(func(k, v []byte) {
+		if !excluded[string(k)] {
+			f(k, v)
+		}
+	})
+}
+
+// IterTimeout iterates over the map until the end of the map or until d has elapsed, in which case
+// it returns ErrIterTimeout; the entries passed to f so far are a partial result that the caller
+// can use or discard.  The clock is only checked every few entries so iteration may overrun d by
+// the time taken to read and process those entries.
+//
+// A PinnedMap is read a page at a time with IterPage, so that d bounds the time spent reading the
+// map too.  If entries are deleted concurrently, a hash map can restart from its first key, so
+// entries may be passed to f more than once.  Other maps, and PinnedMaps that use the bpftool
+// backend or are per-CPU, are read by Iter, which reads the whole map before the first callback;
+// for them, d only bounds the time spent in f.
+func IterTimeout(m Map, d time.Duration, f MapIter) error {
+	start := time.Now()
+	if pm, ok := m.(*PinnedMap); ok && !pm.perCPU && pm.context.backend() != BackendBPFTool {
+		return iterTimeoutPaged(pm, start, d, f)
+	}
+	n := 0
+	timedOut := false
+	err := IterWithStop(m, func(k, v []byte) bool {
+		n++
+		if n%iterTimeoutCheckInterval == 0 && time.Since(start) > d {
+			timedOut = true
+			return false
+		}
+		f(k, v)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if timedOut {
+		return ErrIterTimeout
+	}
+	return nil
+}
+
+// iterTimeoutPaged implements IterTimeout for a PinnedMap, checking the clock between pages.
+func iterTimeoutPaged(m *PinnedMap, start time.Time, d time.Duration, f MapIter) error {
+	var token []byte
+	for {
+		entries, next, err := m.IterPage(token, iterTimeoutCheckInterval)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			f(e.Key, e.Value)
+		}
+		if next == nil {
+			return nil
+		}
+		if time.Since(start) > d {
+			return ErrIterTimeout
+		}
+		token = next
+	}
+}
+
+// CountWhere returns the number of entries in the map for which pred returns true.  Entries are
+// examined one at a time so the map isn't loaded into memory.
+func CountWhere(m Map, pred func(k, v []byte) bool) (int, error) {
+	count := 0
+	err := IterWithStop(m, func(k, v []byte) bool {
+		if pred(k, v) {
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ReconcileStreaming makes m contain exactly the entries returned by next, which is called until
+// it returns false.  Each desired entry is written as it is received and the keys that were
+// already in the map, as returned by existingKeys, are deleted at the end if next didn't return
+// them.  Only the existing key set is held in memory, not the desired or existing values, so
+// memory use is bounded by the number of existing keys times the key size.
+//
+// Entries added to m by another writer after existingKeys returns are left in place.  Existing
+// entries that disappear before they're deleted are ignored.
+func ReconcileStreaming(m Map, next func() (Entry, bool), existingKeys func() ([][]byte, error)) error {
+	keys, err := existingKeys()
+	if err != nil {
+		return errors.WithMessage(err, "failed to list existing keys")
+	}
+	unseen := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		unseen[string(k)] = struct{}{}
+	}
+
+	for {
+		e, ok := next()
+		if !ok {
+			break
+		}
+		if err := m.Update(e.Key, e.Value); err != nil {
+			return errors.WithMessagef(err, "failed to update map %s", m.GetName())
+		}
+		delete(unseen, string(e.Key))
+	}
+
+	for k := range unseen {
+		err := m.Delete([]byte(k))
+		if err != nil && err != ErrKeyNotExist && !IsNotExists(err) {
+			return errors.WithMessagef(err, "failed to delete stale entry from map %s", m.GetName())
+		}
+	}
+	return nil
+}
+
+// Diff compares the contents of two maps.  It returns the entries that are only in a, those that
+// are only in b and, for keys that are in both maps with different values, the entries from a.
+// Both maps are loaded into memory in full, so this is only suitable for moderately sized maps.
+func Diff(a, b Map) (onlyInA, onlyInB, different []Entry, err error) {
+	aContents, err := readContents(a)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bContents, err := readContents(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	onlyInA, onlyInB, different = diffContents(aContents, bContents)
+	return onlyInA, onlyInB, different, nil
+}
+
+func verifyAgainst(m Map, expected map[string][]byte) ([]Entry, error) {
+	var mismatches []Entry
+	seen := make(map[string]bool, len(expected))
+	err := m.Iter(func(k, v []byte) {
+		want, ok := expected[string(k)]
+		if ok {
+			seen[string(k)] = true
+		}
+		if !ok || !bytes.Equal(v, want) {
+			mismatches = append(mismatches, Entry{Key: k, Value: v}.Clone())
+		}
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to iterate map %s", m.GetName())
+	}
+	for k := range expected {
+		if !seen[k] {
+			mismatches = append(mismatches, Entry{Key: []byte(k)})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return bytes.Compare(mismatches[i].Key, mismatches[j].Key) < 0
+	})
+	return mismatches, nil
+}
+
+func readContents(m Map) (map[string]Entry, error) {
+	entries, err := Entries(m)
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string]Entry, len(entries))
+	for _, e := range entries {
+		contents[string(e.Key)] = e
+	}
+	return contents, nil
+}
+
+func diffContents(a, b map[string]Entry) (onlyInA, onlyInB, different []Entry) {
+	for k, aE := range a {
+		bE, ok := b[k]
+		if !ok {
+			onlyInA = append(onlyInA, aE)
+		} else if !aE.Equal(bE) {
+			different = append(different, aE)
+		}
+	}
+	for k, bE := range b {
+		if _, ok := a[k]; !ok {
+			onlyInB = append(onlyInB, bE)
+		}
+	}
+	return
+}
+
+// ContentHash returns a hash of the map's contents that doesn't depend on iteration order, so
+// it can be used to cheaply check whether a map has changed without keeping a copy of it.
+func ContentHash(m Map) (uint64, error) {
+	var sum uint64
+	err := m.Iter(func(k, v []byte) {
+		h := fnv.New64a()
+		_, _ = h.Write(k)
+		_, _ = h.Write(v)
+		sum += h.Sum64()
+	})
+	if err != nil {
+		return 0, errors.WithMessagef(err, "failed to iterate map %s", m.GetName())
+	}
+	return sum, nil
+}
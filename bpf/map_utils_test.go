@@ -0,0 +1,518 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/projectcalico/felix/bpf"
+	"github.com/projectcalico/felix/bpf/mock"
+)
+
+var testMapParams = bpf.MapParameters{
+	Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+	Type:       "hash",
+	KeySize:    4,
+	ValueSize:  4,
+	MaxEntries: 100,
+	Name:       "cali_test",
+}
+
+func newTestMockMap(t *testing.T, n int) *mock.Map {
+	m := mock.NewMockMap(testMapParams)
+	for i := 0; i < n; i++ {
+		err := m.Update([]byte{byte(i), 0, 0, 0}, []byte{byte(i), 1, 2, 3})
+		if err != nil {
+			t.Fatalf("failed to populate mock map: %v", err)
+		}
+	}
+	return m
+}
+
+func TestIterChunked(t *testing.T) {
+	m := newTestMockMap(t, 7)
+
+	var sizes []int
+	seen := map[byte]bool{}
+	err := bpf.IterChunked(m, 3, func(batch []bpf.Entry) error {
+		sizes = append(sizes, len(batch))
+		for _, e := range batch {
+			seen[e.Key[0]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterChunked failed: %v", err)
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("unexpected batch sizes %v", sizes)
+	}
+	if len(seen) != 7 {
+		t.Errorf("expected to see 7 keys, saw %d", len(seen))
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = bpf.IterChunked(m, 2, func(batch []bpf.Entry) error {
+		calls++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected error from callback to be returned, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected iteration to stop after first batch, got %d calls", calls)
+	}
+}
+
+func TestCountWhere(t *testing.T) {
+	m := newTestMockMap(t, 10)
+	n, err := bpf.CountWhere(m, func(k, v []byte) bool {
+		return k[0]%3 == 0
+	})
+	if err != nil {
+		t.Fatalf("CountWhere failed: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 matching entries, got %d", n)
+	}
+
+	calls := 0
+	err = bpf.IterWithStop(m, func(k, v []byte) bool {
+		calls++
+		return calls < 3
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected iteration to stop after 3 entries, got %d calls, err %v", calls, err)
+	}
+}
+
+func TestIterTransform(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	results := map[byte][]byte{}
+	err := bpf.IterTransform(m, func(k, v []byte) []byte {
+		// Modify the value in place and truncate it.
+		v[0] += 10
+		return v[:2]
+	}, func(k, v []byte) {
+		results[k[0]] = v
+	})
+	if err != nil {
+		t.Fatalf("IterTransform failed: %v", err)
+	}
+	for i := byte(0); i < 3; i++ {
+		if string(results[i]) != string([]byte{i + 10, 1}) {
+			t.Errorf("Unexpected transformed value for key %d: %v", i, results[i])
+		}
+		if v, _ := m.Get([]byte{i, 0, 0, 0}); v[0] != i {
+			t.Errorf("Transform modified the map's value for key %d: %v", i, v)
+		}
+	}
+}
+
+func TestIterValueFilter(t *testing.T) {
+	params := testMapParams
+	params.ValueSize = 8
+	m := mock.NewMockMap(params)
+	for i, count := range []uint64{10, 5000, 999, 1000, 1 << 40} {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, count)
+		if err := m.Update([]byte{byte(i), 0, 0, 0}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[byte]bool{}
+	err := bpf.IterValueFilter(m, func(v []byte) bool {
+		return binary.LittleEndian.Uint64(v) >= 1000
+	}, func(k, v []byte) {
+		seen[k[0]] = true
+	})
+	if err != nil {
+		t.Fatalf("IterValueFilter failed: %v", err)
+	}
+	if len(seen) != 3 || !seen[1] || !seen[3] || !seen[4] {
+		t.Errorf("Unexpected entries passed the filter: %v", seen)
+	}
+}
+
+func TestIterExcept(t *testing.T) {
+	m := newTestMockMap(t, 5)
+	seen := map[byte]bool{}
+	err := bpf.IterExcept(m, [][]byte{{0, 0, 0, 0}, {3, 0, 0, 0}, {9, 0, 0, 0}}, func(k, v []byte) {
+		seen[k[0]] = true
+	})
+	if err != nil {
+		t.Fatalf("IterExcept failed: %v", err)
+	}
+	if len(seen) != 3 || !seen[1] || !seen[2] || !seen[4] {
+		t.Errorf("Unexpected entries seen: %v", seen)
+	}
+
+	if err := bpf.IterExcept(m, [][]byte{{0, 0}}, func(k, v []byte) {}); err == nil {
+		t.Error("Expected an error for an excluded key of the wrong size")
+	}
+}
+
+func TestIterTimeout(t *testing.T) {
+	m := newTestMockMap(t, 200)
+
+	// A slow callback: the timeout should cut iteration short.
+	seen := 0
+	err := bpf.IterTimeout(m, 10*time.Millisecond, func(k, v []byte) {
+		seen++
+		time.Sleep(time.Millisecond)
+	})
+	if err != bpf.ErrIterTimeout {
+		t.Errorf("Expected ErrIterTimeout, got %v", err)
+	}
+	if seen == 0 || seen >= 200 {
+		t.Errorf("Expected a partial iteration, saw %d entries", seen)
+	}
+
+	seen = 0
+	err = bpf.IterTimeout(m, time.Minute, func(k, v []byte) {
+		seen++
+	})
+	if err != nil || seen != 200 {
+		t.Errorf("Expected a complete iteration, saw %d entries, err %v", seen, err)
+	}
+}
+
+func TestReconcileStreaming(t *testing.T) {
+	params := testMapParams
+	params.MaxEntries = 100000
+	m := mock.NewMockMap(params)
+	key := func(i int) []byte {
+		k := make([]byte, 4)
+		binary.LittleEndian.PutUint32(k, uint32(i))
+		return k
+	}
+	// Existing entries 0..59999; desired entries 20000..79999 with new values.
+	for i := 0; i < 60000; i++ {
+		if err := m.Update(key(i), []byte{1, 1, 1, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existingKeys := func() ([][]byte, error) {
+		var keys [][]byte
+		err := m.Iter(func(k, v []byte) {
+			keys = append(keys, k)
+		})
+		return keys, err
+	}
+	i := 20000
+	next := func() (bpf.Entry, bool) {
+		if i >= 80000 {
+			return bpf.Entry{}, false
+		}
+		e := bpf.Entry{Key: key(i), Value: []byte{2, 2, 2, 2}}
+		i++
+		return e, true
+	}
+
+	if err := bpf.ReconcileStreaming(m, next, existingKeys); err != nil {
+		t.Fatalf("ReconcileStreaming failed: %v", err)
+	}
+	if len(m.Contents) != 60000 {
+		t.Errorf("Expected 60000 entries, got %d", len(m.Contents))
+	}
+	for k, v := range m.Contents {
+		n := binary.LittleEndian.Uint32([]byte(k))
+		if n < 20000 || n >= 80000 || v != string([]byte{2, 2, 2, 2}) {
+			t.Fatalf("Unexpected entry %d = %v", n, []byte(v))
+		}
+	}
+
+	listErr := errors.New("list failed")
+	err := bpf.ReconcileStreaming(m, next, func() ([][]byte, error) {
+		return nil, listErr
+	})
+	if err == nil || len(m.Contents) != 60000 {
+		t.Errorf("Expected an error and no changes when listing keys fails, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := newTestMockMap(t, 4)
+	b := newTestMockMap(t, 4)
+
+	// Remove key 0 from b, add key 9 to b and change the value of key 2 in b.
+	_ = b.Delete([]byte{0, 0, 0, 0})
+	_ = b.Update([]byte{9, 0, 0, 0}, []byte{9, 9, 9, 9})
+	_ = b.Update([]byte{2, 0, 0, 0}, []byte{2, 2, 2, 2})
+
+	onlyInA, onlyInB, different, err := bpf.Diff(a, b)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(onlyInA) != 1 || onlyInA[0].Key[0] != 0 {
+		t.Errorf("unexpected onlyInA: %v", onlyInA)
+	}
+	if len(onlyInB) != 1 || onlyInB[0].Key[0] != 9 {
+		t.Errorf("unexpected onlyInB: %v", onlyInB)
+	}
+	if len(different) != 1 || different[0].Key[0] != 2 || different[0].Value[1] != 1 {
+		t.Errorf("unexpected different: %v", different)
+	}
+
+	onlyInA, onlyInB, different, err = bpf.Diff(a, a)
+	if err != nil || len(onlyInA)+len(onlyInB)+len(different) != 0 {
+		t.Errorf("expected no differences comparing a map with itself: %v %v %v %v",
+			onlyInA, onlyInB, different, err)
+	}
+}
+
+func TestEntryCloneAndEqual(t *testing.T) {
+	e := bpf.Entry{Key: []byte{1, 2}, Value: []byte{3, 4}}
+	c := e.Clone()
+	if !c.Equal(e) {
+		t.Errorf("expected clone %v to equal %v", c, e)
+	}
+	c.Key[0] = 9
+	c.Value[0] = 9
+	if e.Key[0] != 1 || e.Value[0] != 3 {
+		t.Errorf("modifying the clone changed the original: %v", e)
+	}
+	if c.Equal(e) {
+		t.Errorf("expected modified clone %v not to equal %v", c, e)
+	}
+	if (bpf.Entry{Key: []byte{1, 2}, Value: []byte{3, 5}}).Equal(e) {
+		t.Error("expected entries with different values not to be equal")
+	}
+
+	missing := bpf.Entry{Key: []byte{1}}.Clone()
+	if missing.Value != nil {
+		t.Errorf("expected a nil value to stay nil, got %v", missing.Value)
+	}
+	if !missing.Equal(bpf.Entry{Key: []byte{1}, Value: []byte{}}) {
+		t.Error("expected a nil value to equal an empty one")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	m := newTestMockMap(t, 4)
+	entries, err := bpf.Entries(m)
+	if err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %v", entries)
+	}
+	for _, e := range entries {
+		v, err := m.Get(e.Key)
+		if err != nil || !e.Equal(bpf.Entry{Key: e.Key, Value: v}) {
+			t.Errorf("entry %v doesn't match the map's value %v, %v", e, v, err)
+		}
+	}
+}
+
+func TestMockIterPage(t *testing.T) {
+	m := newTestMockMap(t, 5)
+
+	var token []byte
+	var pages [][]bpf.Entry
+	for {
+		entries, next, err := m.IterPage(token, 2)
+		if err != nil {
+			t.Fatalf("IterPage failed: %v", err)
+		}
+		pages = append(pages, entries)
+		if next == nil {
+			break
+		}
+		token = next
+	}
+	if len(pages) != 3 || len(pages[0]) != 2 || len(pages[1]) != 2 || len(pages[2]) != 1 {
+		t.Fatalf("Unexpected pages: %v", pages)
+	}
+	for i, e := range append(append(pages[0], pages[1]...), pages[2]...) {
+		if e.Key[0] != byte(i) || e.Value[0] != byte(i) {
+			t.Errorf("Unexpected entry %d: %v", i, e)
+		}
+	}
+
+	// An exact multiple of the page size shouldn't need an extra, empty, page.
+	entries, next, err := m.IterPage(nil, 5)
+	if err != nil || len(entries) != 5 || next != nil {
+		t.Errorf("Expected a single full page, got %v, %v, %v", entries, next, err)
+	}
+}
+
+func TestMockIterLimit(t *testing.T) {
+	m := newTestMockMap(t, 5)
+
+	var seen [][]byte
+	err := m.IterLimit(3, func(k, v []byte) {
+		seen = append(seen, k)
+	})
+	limitErr, ok := err.(*bpf.IterLimitError)
+	if !ok {
+		t.Fatalf("Expected an IterLimitError, got %v", err)
+	}
+	if len(seen) != 3 || limitErr.LastKey[0] != 2 {
+		t.Fatalf("Expected to stop after 3 entries, saw %v, last key %v", seen, limitErr.LastKey)
+	}
+
+	// Resuming from the last key should return the rest of the map.
+	entries, next, err := m.IterPage(limitErr.LastKey, 3)
+	if err != nil || len(entries) != 2 || entries[0].Key[0] != 3 || next != nil {
+		t.Errorf("Unexpected resumed page %v, %v, %v", entries, next, err)
+	}
+
+	// If everything fits, there's nothing to resume.
+	seen = nil
+	if err := m.IterLimit(5, func(k, v []byte) { seen = append(seen, k) }); err != nil || len(seen) != 5 {
+		t.Errorf("Expected all 5 entries and no error, saw %d, %v", len(seen), err)
+	}
+}
+
+func TestMockVerifyAgainst(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	expected := map[string][]byte{
+		string([]byte{0, 0, 0, 0}): {0, 1, 2, 3},
+		string([]byte{1, 0, 0, 0}): {1, 1, 2, 3},
+		string([]byte{2, 0, 0, 0}): {2, 1, 2, 3},
+	}
+	if mismatches, err := m.VerifyAgainst(expected); err != nil || len(mismatches) != 0 {
+		t.Fatalf("Expected no mismatches, got %v, %v", mismatches, err)
+	}
+
+	// Drift one value, add an extra entry and remove an expected one.
+	if err := m.Update([]byte{1, 0, 0, 0}, []byte{1, 9, 9, 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update([]byte{5, 0, 0, 0}, []byte{5, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete([]byte{2, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := m.VerifyAgainst(expected)
+	if err != nil {
+		t.Fatalf("VerifyAgainst failed: %v", err)
+	}
+	if len(mismatches) != 3 {
+		t.Fatalf("Expected 3 mismatches, got %v", mismatches)
+	}
+	if mismatches[0].Key[0] != 1 || mismatches[0].Value[1] != 9 {
+		t.Errorf("Expected the drifted entry first, got %v", mismatches[0])
+	}
+	if mismatches[1].Key[0] != 2 || mismatches[1].Value != nil {
+		t.Errorf("Expected the missing entry with a nil value, got %v", mismatches[1])
+	}
+	if mismatches[2].Key[0] != 5 || mismatches[2].Value[0] != 5 {
+		t.Errorf("Expected the extra entry last, got %v", mismatches[2])
+	}
+}
+
+func TestMockAssertType(t *testing.T) {
+	m := newTestMockMap(t, 0)
+	if err := m.AssertType("hash"); err != nil {
+		t.Errorf("Unexpected mismatch: %v", err)
+	}
+	if err := m.AssertType("array"); err == nil {
+		t.Error("Expected an error for the wrong type")
+	}
+}
+
+func TestMockGoMapRoundTrip(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	goMap, err := m.ToGoMap()
+	if err != nil {
+		t.Fatalf("ToGoMap failed: %v", err)
+	}
+	if len(goMap) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", goMap)
+	}
+
+	// Modifying the Go map mustn't affect the original.
+	goMap[string([]byte{0, 0, 0, 0})][0] = 42
+
+	other := newTestMockMap(t, 0)
+	if err := other.FromGoMap(goMap); err != nil {
+		t.Fatalf("FromGoMap failed: %v", err)
+	}
+	if len(other.Contents) != 3 || other.Contents[string([]byte{0, 0, 0, 0})] != string([]byte{42, 1, 2, 3}) {
+		t.Errorf("Unexpected contents after FromGoMap: %v", other.Contents)
+	}
+	if m.Contents[string([]byte{0, 0, 0, 0})] != string([]byte{0, 1, 2, 3}) {
+		t.Errorf("ToGoMap result aliased the original: %v", m.Contents)
+	}
+}
+
+func TestMockSameAs(t *testing.T) {
+	m := newTestMockMap(t, 0)
+	handle := *m
+	other := newTestMockMap(t, 0)
+
+	if same, err := m.SameAs(&handle); err != nil || !same {
+		t.Errorf("Expected a copy of the map to be the same map: %v, %v", same, err)
+	}
+	if same, err := m.SameAs(other); err != nil || same {
+		t.Errorf("Expected different maps not to be the same: %v, %v", same, err)
+	}
+}
+
+func TestMockExistsBatch(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	exists, err := m.ExistsBatch([][]byte{{0, 0, 0, 0}, {5, 0, 0, 0}, {2, 0, 0, 0}, {3, 0, 0, 0}})
+	if err != nil {
+		t.Fatalf("ExistsBatch failed: %v", err)
+	}
+	if len(exists) != 4 || !exists[0] || exists[1] || !exists[2] || exists[3] {
+		t.Errorf("Unexpected result: %v", exists)
+	}
+
+	if _, err := m.ExistsBatch([][]byte{{0, 0, 0, 0}, {1}}); err == nil {
+		t.Error("Expected an error for a key of the wrong size")
+	}
+}
+
+func TestMockGetBatch(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	values, missing, err := m.GetBatch([][]byte{{0, 0, 0, 0}, {5, 0, 0, 0}, {2, 0, 0, 0}})
+	if err != nil {
+		t.Fatalf("GetBatch failed: %v", err)
+	}
+	if len(missing) != 3 || missing[0] || !missing[1] || missing[2] {
+		t.Errorf("Unexpected missing: %v", missing)
+	}
+	if len(values) != 3 || values[0][0] != 0 || values[1] != nil || values[2][0] != 2 {
+		t.Errorf("Unexpected values: %v", values)
+	}
+
+	if _, _, err := m.GetBatch([][]byte{{0, 0, 0, 0}, {1}}); err == nil {
+		t.Error("Expected an error for a key of the wrong size")
+	}
+}
+
+func TestMockUpdateBatch(t *testing.T) {
+	m := newTestMockMap(t, 0)
+	keys := [][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}}
+	values := [][]byte{{1, 1, 1, 1}, {2, 2, 2, 2}}
+	if err := m.UpdateBatch(keys, values); err != nil {
+		t.Fatalf("UpdateBatch failed: %v", err)
+	}
+	if len(m.Contents) != 2 || m.Contents[string(keys[1])] != string(values[1]) {
+		t.Errorf("Unexpected contents after UpdateBatch: %v", m.Contents)
+	}
+	if err := m.UpdateBatch(keys, values[:1]); err == nil {
+		t.Error("Expected an error for mismatched keys and values")
+	}
+}
@@ -15,12 +15,20 @@
 package bpf
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -28,8 +36,76 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrKeyNotExist is returned when deleting a key that isn't in the map.  It is os.ErrNotExist so
+// that existing os.IsNotExist() checks continue to work.
+var ErrKeyNotExist = os.ErrNotExist
+
+// ErrMapNotFound is returned when a map's pin doesn't exist.
+var ErrMapNotFound = errors.New("map not found")
+
+// ErrMapFull is the cause of the error returned by Update when the map has no room for another
+// key.  Use errors.Cause() to check for it.
+var ErrMapFull = errors.New("map full")
+
+// ErrBPFFSReadOnly is the cause of the error returned by EnsureExists when the BPF filesystem is
+// mounted read-only, so we can't create the map's directory or pin.  Use errors.Cause() to check
+// for it.
+var ErrBPFFSReadOnly = errors.New("BPF filesystem is read-only")
+
+// ErrDumpTruncated is the cause of the error returned by IterMapCmdOutput when bpftool's output
+// ends part way through the JSON array.  The entries before the truncation point have already
+// been passed to the callback.
+var ErrDumpTruncated = errors.New("bpftool map dump output truncated")
+
+// ErrZeroValueSize is the cause of the error returned when map parameters have value size 0.
+// The kernel rejects value_size 0 for every key/value map type (EINVAL), so a map where only the
+// presence of a key matters needs a 1-byte value; use Exists to check for a key.
+var ErrZeroValueSize = errors.New("BPF maps can't have value size 0")
+
 type MapIter func(k, v []byte)
 
+// ErrIterLimit is the cause of the IterLimitError returned by IterLimit when it stopped at the
+// limit before reaching the end of the map.  Use errors.Cause() to check for it.
+var ErrIterLimit = errors.New("iteration limit reached")
+
+// IterLimitError is returned by IterLimit when it stopped at the limit.  LastKey is the last key
+// that was passed to the callback; pass it to IterPage as the token to carry on from there.
+type IterLimitError struct {
+	LastKey []byte
+}
+
+func (e *IterLimitError) Error() string {
+	return fmt.Sprintf("%v after key %x", ErrIterLimit, e.LastKey)
+}
+
+// Cause returns ErrIterLimit, for use with errors.Cause().
+func (e *IterLimitError) Cause() error {
+	return ErrIterLimit
+}
+
+// CreateError is returned when creating a map fails.  It records the parameters that were used,
+// and bpftool's stderr if bpftool was used, so that the error is self-contained in logs.  Err,
+// the underlying error, is also its Cause.
+type CreateError struct {
+	Params MapParameters
+	Stderr string
+	Err    error
+}
+
+func (e *CreateError) Error() string {
+	msg := fmt.Sprintf("failed to create map %s (type %s, key size %d, value size %d, max entries %d, flags %#x): %v",
+		e.Params.versionedName(), e.Params.Type, e.Params.KeySize, e.Params.ValueSize, e.Params.MaxEntries,
+		e.Params.Flags, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *CreateError) Cause() error {
+	return e.Err
+}
+
 type Map interface {
 	GetName() string
 	// EnsureExists opens the map, creating and pinning it if needed.
@@ -41,8 +117,15 @@ type Map interface {
 
 	Iter(MapIter) error
 	Update(k, v []byte) error
+	// UpdateBatch writes all the given entries, in no particular order.
+	UpdateBatch(keys, values [][]byte) error
 	Get(k []byte) ([]byte, error)
 	Delete(k []byte) error
+	// SupportsDelete returns false if entries can't be deleted from the map (for example, an
+	// array map) and should be reset to a zero value instead.
+	SupportsDelete() bool
+	// AssertType returns an error if the map isn't of the given type (such as "hash" or "array").
+	AssertType(expected string) error
 }
 
 type MapParameters struct {
@@ -54,6 +137,42 @@ type MapParameters struct {
 	Name       string
 	Flags      int
 	Version    int
+
+	// InnerMap is used by the map-in-map types (array_of_maps and hash_of_maps) as the template
+	// for the inner maps.  The kernel rejects inner maps that don't match it.
+	InnerMap *MapParameters
+
+	// RepinFilter, if set, changes how an existing map is adopted when repinning is enabled.
+	// Rather than repinning the old map as-is, a fresh map is created and only the entries for
+	// which RepinFilter returns true are copied over from the old map.  It isn't supported for
+	// per-CPU maps.  It is skipped by encoding/json, which can't encode funcs, so that the
+	// parameters can still be logged.
+	RepinFilter func(k, v []byte) bool `json:"-"`
+
+	// LazyCreate defers creation of the map until it is first used.  With LazyCreate set,
+	// EnsureExists() only records that the map should exist; the map is then opened or created
+	// by the first Iter/Update/Get/Delete or MapFD() call.
+	LazyCreate bool
+
+	// PinByName makes the map's kernel name, rather than its pin path, the primary way to find
+	// it.  EnsureExists first looks for a loaded map with the map's name and, if it finds one,
+	// adopts it and pins it to Filename, replacing any pin there that refers to a different map.
+	// Only if there is no such map does it fall back to the pin path (and then to creating the
+	// map).  The name lookup is done whether or not RepinningEnabled is set; RepinningEnabled
+	// only controls the fallback lookup for maps that are managed by path.
+	PinByName bool
+
+	// DeriveNameFrom, if set, is a feature key from which the map's name is derived, with
+	// DerivedName, when the map is created through a MapContext.  The derived name replaces Name
+	// and, if Filename is empty, the filename defaults to the pin path for the derived name.  The
+	// context's NamePrefix is still applied; the feature part of the name is shortened to make
+	// room for it.
+	DeriveNameFrom string
+
+	// ValueLayout, if set, is a sample of the Go type that is marshalled into the map's values.
+	// EnsureExists checks it with ValidateValueLayout and fails if it doesn't match ValueSize or
+	// has implicit padding.
+	ValueLayout interface{}
 }
 
 func versionedStr(ver int, str string) string {
@@ -73,21 +192,399 @@ func (mp *MapParameters) versionedFilename() string {
 }
 
 type MapContext struct {
+	// openFDs counts the map file descriptors that are currently open; accessed atomically so
+	// it comes first to guarantee 64-bit alignment.
+	openFDs int64
+
 	RepinningEnabled bool
+	// OnMapFull, if set, is called with the name of the map whenever an Update fails because the
+	// map is full.  The error is still returned to the caller.
+	OnMapFull func(mapName string)
+	// OpTimeout, if non-zero, limits how long each bpftool command run by the context's maps may
+	// take; commands that are still running after the timeout are killed.
+	OpTimeout time.Duration
+	// OpenOnly makes EnsureExists only open maps that are already pinned, without trying to mount
+	// the BPF filesystem or to create directories, pins or maps.  A map that isn't pinned gives
+	// ErrMapNotFound.  This allows read-only introspection on nodes where the BPF filesystem is
+	// mounted read-only.
+	OpenOnly bool
+	// NamePrefix and FilePrefix are prepended to the name, and the base name of the pin file,
+	// respectively, of every map created through the context.  They allow two instances to use
+	// the same map definitions on one node without sharing maps.  The prefixed name must still
+	// fit in BPF_OBJ_NAME_LEN.
+	NamePrefix string
+	FilePrefix string
+	// FDSoftLimit, if non-zero, is the number of open map file descriptors above which the
+	// context logs a warning each time it opens another one, to help spot FD leaks.
+	FDSoftLimit int
+	// MaxBatchBytes, if non-zero, caps the size of the key and value buffers used for each batch
+	// lookup by IterBatch.  Defaults to 1MiB.
+	MaxBatchBytes int
+	// Backend selects between native syscalls and bpftool for operations that support both.
+	Backend Backend
+	// OnMutate, if set, is called after each successful write to the context's maps (Update and
+	// Delete, and the other methods that write entries), with op set to "update" or "delete".
+	// oldValue is the entry's previous value, or nil if it didn't exist; newValue is nil for
+	// deletes.  Setting the hook costs an extra lookup per mutation to fetch the previous value,
+	// and the lookup and the write aren't atomic so a concurrent writer (such as a BPF program)
+	// can make oldValue stale.
+	OnMutate func(mapName, op string, key, oldValue, newValue []byte)
+	// Decoders, if set, is used by GetDecoded in place of DefaultDecoders.
+	Decoders *DecoderRegistry
+	// RecoverIterPanics makes Iter return an error, rather than re-raising the panic, if its
+	// callback panics.
+	RecoverIterPanics bool
+	// CheckFDs makes EnsureMaps call CheckFDBudget before creating any maps, so that running out
+	// of file descriptors is reported up front rather than part way through.
+	CheckFDs bool
+	// BPFFSRoot is the mount point of the BPF filesystem that the context's maps are pinned in.
+	// Pin paths under /sys/fs/bpf, the default, are moved under it.  A custom root is mounted if
+	// nothing is mounted there yet, and must be a BPF filesystem.
+	BPFFSRoot string
+
+	// maps is the set of maps created through the context that haven't been closed.
+	mapsLock sync.Mutex
+	maps     map[*PinnedMap]struct{}
+
+	history opHistory
+}
+
+// command returns an exec.Cmd for the given command, applying OpTimeout, if set.  The returned
+// cancel function must be called once the command has finished.
+func (c *MapContext) command(name string, args ...string) (*exec.Cmd, context.CancelFunc) {
+	if c == nil || c.OpTimeout == 0 {
+		return exec.Command(name, args...), func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.OpTimeout)
+	return exec.CommandContext(ctx, name, args...), cancel
 }
 
+// NewPinnedMap creates a new map.  If the parameters are invalid, the error is logged and then
+// returned from EnsureExists(); use NewPinnedMapE to get the error immediately.
 func (c *MapContext) NewPinnedMap(params MapParameters) Map {
-	if len(params.versionedName()) >= unix.BPF_OBJ_NAME_LEN {
-		logrus.WithField("name", params.Name).Panic("Bug: BPF map name too long")
+	params = c.withPrefixes(params)
+	m := c.newPinnedMap(params)
+	if err := params.validate(); err != nil {
+		logrus.WithError(err).WithField("name", params.Name).Error("Invalid BPF map parameters")
+		m.configErr = err
 	}
+	return m
+}
+
+// NewPinnedMapE creates a new map, returning an error if the parameters are invalid.
+func (c *MapContext) NewPinnedMapE(params MapParameters) (Map, error) {
+	params = c.withPrefixes(params)
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return c.newPinnedMap(params), nil
+}
+
+func (c *MapContext) withPrefixes(params MapParameters) MapParameters {
+	params = params.withDerivedName(len(c.NamePrefix))
+	params.Name = c.NamePrefix + params.Name
+	params.Filename = c.rebasePinPath(params.Filename)
+	if c.FilePrefix != "" {
+		dir, file := filepath.Split(params.Filename)
+		params.Filename = dir + c.FilePrefix + file
+	}
+	return params
+}
+
+func (c *MapContext) newPinnedMap(params MapParameters) *PinnedMap {
 	m := &PinnedMap{
 		context:       c,
 		MapParameters: params,
 		perCPU:        strings.Contains(params.Type, "percpu"),
 	}
+	c.register(m)
 	return m
 }
 
+// register adds m to the context's set of maps, if it isn't already there.
+func (c *MapContext) register(m *PinnedMap) {
+	if c == nil {
+		return
+	}
+	c.mapsLock.Lock()
+	defer c.mapsLock.Unlock()
+	if c.maps == nil {
+		c.maps = map[*PinnedMap]struct{}{}
+	}
+	c.maps[m] = struct{}{}
+}
+
+// unregister removes m from the context's set of maps, so that a closed map isn't retained.
+func (c *MapContext) unregister(m *PinnedMap) {
+	if c == nil {
+		return
+	}
+	c.mapsLock.Lock()
+	defer c.mapsLock.Unlock()
+	delete(c.maps, m)
+}
+
+// mapList returns a copy of the context's set of maps, so that they can be worked on without
+// holding mapsLock.
+func (c *MapContext) mapList() []*PinnedMap {
+	c.mapsLock.Lock()
+	defer c.mapsLock.Unlock()
+	maps := make([]*PinnedMap, 0, len(c.maps))
+	for m := range c.maps {
+		maps = append(maps, m)
+	}
+	return maps
+}
+
+func (mp *MapParameters) validate() error {
+	if len(mp.versionedName()) >= unix.BPF_OBJ_NAME_LEN {
+		return errors.Errorf("BPF map name %q too long (max %d characters)",
+			mp.versionedName(), unix.BPF_OBJ_NAME_LEN-1)
+	}
+	if _, ok := MapTypeID(mp.Type); !ok {
+		return errors.Errorf("unknown BPF map type %q", mp.Type)
+	}
+	if mp.Type == "ringbuf" {
+		return mp.validateRingbuf()
+	}
+	if mp.ValueSize == 0 {
+		// Every key/value map type rejects value_size 0 with EINVAL (the kernel needs somewhere
+		// to point the value pointer that a BPF program's lookup returns).
+		return errors.WithMessage(ErrZeroValueSize, fmt.Sprintf(
+			"map %s (%s); use a 1-byte value for maps where only the presence of a key matters",
+			mp.Name, mp.Type))
+	}
+	if keylessMapTypes[mp.Type] {
+		if mp.KeySize != 0 {
+			return errors.Errorf("BPF map %s is a %s map, so its key size must be 0, not %d",
+				mp.Name, mp.Type, mp.KeySize)
+		}
+	} else if mp.KeySize <= 0 {
+		return errors.Errorf("BPF map %s has invalid key size %d", mp.Name, mp.KeySize)
+	}
+	if mp.ValueSize <= 0 || mp.MaxEntries <= 0 {
+		return errors.Errorf("BPF map %s has invalid sizes (key %d, value %d, max entries %d)",
+			mp.Name, mp.KeySize, mp.ValueSize, mp.MaxEntries)
+	}
+	if mp.RepinFilter != nil && strings.Contains(mp.Type, "percpu") {
+		return errors.Errorf("BPF map %s is a %s map; RepinFilter doesn't support per-CPU maps",
+			mp.Name, mp.Type)
+	}
+	return nil
+}
+
+// OpenFDCount returns the number of map file descriptors that are open for maps created through
+// the context.
+func (c *MapContext) OpenFDCount() int {
+	return int(atomic.LoadInt64(&c.openFDs))
+}
+
+func (c *MapContext) fdOpened(name string) {
+	n := atomic.AddInt64(&c.openFDs, 1)
+	if c.FDSoftLimit > 0 && n > int64(c.FDSoftLimit) {
+		logrus.WithFields(logrus.Fields{
+			"name":    name,
+			"openFDs": n,
+			"limit":   c.FDSoftLimit,
+		}).Warn("Number of open BPF map file descriptors exceeds soft limit; possible FD leak.")
+	}
+}
+
+func (c *MapContext) fdClosed() {
+	atomic.AddInt64(&c.openFDs, -1)
+}
+
+// CloseAll closes the file descriptors of all the maps created through this context.  It is
+// intended to be called on shutdown; the maps remain pinned.
+func (c *MapContext) CloseAll() error {
+	var lastErr error
+	for _, m := range c.mapList() {
+		if err := m.Close(); err != nil {
+			logrus.WithError(err).WithField("name", m.versionedName()).Warn("Failed to close map")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RevalidateAll checks that the open file descriptor of each map created through the context
+// still refers to the map that is pinned at its path, for example after the BPF filesystem has
+// been remounted.  Stale maps are reopened from their pin or, if the pin has gone, recreated
+// (empty).  Maps that have not been opened yet, or that were closed, are skipped.  It carries on
+// past failures and returns an error listing all of them.
+func (c *MapContext) RevalidateAll() error {
+	maps := c.mapList()
+
+	var failures []string
+	for _, m := range maps {
+		if err := m.revalidate(); err != nil {
+			logrus.WithError(err).WithField("name", m.versionedName()).Warn("Failed to revalidate map")
+			failures = append(failures, fmt.Sprintf("%s: %v", m.versionedName(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("failed to revalidate %d of %d maps: %s",
+			len(failures), len(maps), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// warmAllWorkers is the number of maps that WarmAll opens concurrently.
+const warmAllWorkers = 8
+
+// WarmAll loads the file descriptor of every map created through the context that doesn't have
+// one yet (closed maps excluded), as EnsureExists does, so that the first real use of each map
+// doesn't pay for opening (or creating) it.  LazyCreate maps are opened as if they had been used.
+// Maps are opened in parallel, by a bounded pool of workers.  It carries on past failures and
+// returns an error listing all of them.
+func (c *MapContext) WarmAll() error {
+	maps := c.mapList()
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		failures []string
+	)
+	work := make(chan *PinnedMap)
+	for i := 0; i < warmAllWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range work {
+				if err := m.warm(); err != nil {
+					logrus.WithError(err).WithField("name", m.versionedName()).Warn("Failed to warm map")
+					lock.Lock()
+					failures = append(failures, fmt.Sprintf("%s: %v", m.versionedName(), err))
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, m := range maps {
+		work <- m
+	}
+	close(work)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return errors.Errorf("failed to warm %d of %d maps: %s",
+			len(failures), len(maps), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// warm opens or creates the map if its file descriptor isn't loaded.
+func (b *PinnedMap) warm() error {
+	if b.configErr != nil {
+		return b.configErr
+	}
+	if b.LazyCreate {
+		b.lazyLock.Lock()
+		defer b.lazyLock.Unlock()
+		b.createRequested = true
+	}
+	return b.ensureExists()
+}
+
+// EnsureMaps creates a map for each of the given parameters and calls EnsureExists() on it.  It
+// is best-effort: a failure for one map doesn't stop the others from being created, and maps that
+// were created are not cleaned up.  The returned handles are keyed on MapParameters.Name and
+// only include the maps that succeeded; if any failed, the error lists them all.
+//
+// Before anything is created, the parameters are checked for maps that would share a pin path
+// or a kernel name (after applying the context's prefixes and the maps' versions), or that share
+// a Name, and so a key in the result, but have different versions; if there are any, an error
+// naming them is returned and no maps are created.  Similarly, if the context's
+// CheckFDs is set and CheckFDBudget reports that there aren't enough file descriptors left for
+// the maps, nothing is created.
+func EnsureMaps(ctx *MapContext, params []MapParameters) (map[string]Map, error) {
+	if err := checkForDuplicateMaps(ctx, params); err != nil {
+		return nil, err
+	}
+	if ctx.CheckFDs {
+		if err := CheckFDBudget(len(params)); err != nil {
+			return nil, err
+		}
+	}
+	maps := map[string]Map{}
+	var failures []string
+	for _, p := range params {
+		m, err := ctx.NewPinnedMapE(p)
+		if err == nil {
+			err = m.EnsureExists()
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("name", p.Name).Error("Failed to ensure BPF map exists")
+			failures = append(failures, fmt.Sprintf("%s: %v", p.Name, err))
+			continue
+		}
+		maps[p.Name] = m
+	}
+	if len(failures) > 0 {
+		return maps, errors.Errorf("failed to ensure %d of %d maps exist: %s",
+			len(failures), len(params), strings.Join(failures, "; "))
+	}
+	return maps, nil
+}
+
+// checkForDuplicateMaps returns an error if any of the maps would have the same pin path or
+// kernel name as another.  Such maps would silently share (or overwrite) each other's pins.  It
+// also rejects maps that have the same Name, on which EnsureMaps keys its result.
+func checkForDuplicateMaps(ctx *MapContext, params []MapParameters) error {
+	pathUsers := map[string][]string{}
+	nameUsers := map[string][]string{}
+	keyUsers := map[string][]string{}
+	keyVersions := map[string]map[int]bool{}
+	var paths, names, keys []string
+	for i, p := range params {
+		// EnsureMaps keys its result on the unprefixed, unversioned Name, so maps that only
+		// differ in version would overwrite each other's handles.
+		if len(keyUsers[p.Name]) == 0 {
+			keys = append(keys, p.Name)
+			keyVersions[p.Name] = map[int]bool{}
+		}
+		keyUsers[p.Name] = append(keyUsers[p.Name], fmt.Sprintf("#%d (%s)", i, p.Name))
+		keyVersions[p.Name][p.Version] = true
+
+		p = ctx.withPrefixes(p)
+		id := fmt.Sprintf("#%d (%s)", i, p.Name)
+		path := p.versionedFilename()
+		if len(pathUsers[path]) == 0 {
+			paths = append(paths, path)
+		}
+		pathUsers[path] = append(pathUsers[path], id)
+		name := p.versionedName()
+		if len(nameUsers[name]) == 0 {
+			names = append(names, name)
+		}
+		nameUsers[name] = append(nameUsers[name], id)
+	}
+
+	var conflicts []string
+	for _, path := range paths {
+		if users := pathUsers[path]; len(users) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("maps %s share pin path %s", strings.Join(users, ", "), path))
+		}
+	}
+	for _, name := range names {
+		if users := nameUsers[name]; len(users) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("maps %s share name %s", strings.Join(users, ", "), name))
+		}
+	}
+	for _, key := range keys {
+		// Maps with the same version already clash on their kernel name, above.
+		if len(keyVersions[key]) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("maps %s share Name %s with different versions",
+				strings.Join(keyUsers[key], ", "), key))
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.Errorf("conflicting map parameters: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
 type PinnedMap struct {
 	context *MapContext
 	MapParameters
@@ -95,6 +592,32 @@ type PinnedMap struct {
 	fdLoaded bool
 	fd       MapFD
 	perCPU   bool
+
+	lazyLock        sync.Mutex
+	createRequested bool
+
+	// rmwLock serialises our own read-modify-write operations on the map.
+	rmwLock sync.Mutex
+	// swapLock is held for reading by every operation that uses fd (see withFD) and for writing
+	// by Compact while it replaces the map.  It isn't reentrant: with Compact waiting, a second
+	// read lock would deadlock, so code that holds it must use fd directly.
+	swapLock sync.RWMutex
+
+	// configErr is set if the map was created with invalid parameters by NewPinnedMap.
+	configErr error
+
+	// valueBTF, if set by SetValueBTF, is used to decode values for GetPretty.
+	valueBTF       *btfSpec
+	valueBTFTypeID uint32
+
+	// readCache, if set by SetReadCache, caches the results of Get.
+	readCache *readCache
+
+	// pending holds writes made with UpdateCoalesced until they are flushed.
+	pending pendingWrites
+
+	// frozen is set, atomically, once we know that the map has been frozen; see IsFrozen.
+	frozen int32
 }
 
 func (b *PinnedMap) GetName() string {
@@ -102,6 +625,9 @@ func (b *PinnedMap) GetName() string {
 }
 
 func (b *PinnedMap) MapFD() MapFD {
+	if err := b.maybeCreateLazily(); err != nil {
+		logrus.WithError(err).WithField("name", b.versionedName()).Panic("Failed to lazily create map")
+	}
 	if !b.fdLoaded {
 		logrus.Panic("MapFD() called without first calling EnsureExists()")
 	}
@@ -112,13 +638,296 @@ func (b *PinnedMap) Path() string {
 	return b.versionedFilename()
 }
 
+// Close closes the map's file descriptor, if it is open, and removes the map from its context's
+// set of maps until it is reopened.  The map stays pinned.
 func (b *PinnedMap) Close() error {
+	b.context.unregister(b)
+	if !b.fdLoaded {
+		return nil
+	}
 	err := b.fd.Close()
 	b.fdLoaded = false
 	b.fd = 0
+	b.context.fdClosed()
 	return err
 }
 
+// setFD records a newly opened file descriptor for the map.
+func (b *PinnedMap) setFD(fd MapFD) {
+	b.fd = fd
+	b.fdLoaded = true
+	atomic.StoreInt32(&b.frozen, 0)
+	b.context.register(b)
+	b.context.fdOpened(b.versionedName())
+}
+
+// Reopen restores the file descriptor of a map that was closed with Close(), from its existing pin.
+// Unlike EnsureExists(), it never mounts, creates or repins anything; it returns ErrMapNotFound
+// if the pin has gone away.
+func (b *PinnedMap) Reopen() error {
+	if b.fdLoaded {
+		return nil
+	}
+	fd, err := GetMapFDByPin(b.versionedFilename())
+	if err != nil {
+		if IsNotExists(err) {
+			return ErrMapNotFound
+		}
+		return err
+	}
+	b.setFD(fd)
+	logrus.WithField("fd", b.fd).WithField("name", b.versionedFilename()).
+		Debug("Reopened map file descriptor.")
+	return nil
+}
+
+// revalidate implements RevalidateAll for one map.
+func (b *PinnedMap) revalidate() error {
+	b.lazyLock.Lock()
+	defer b.lazyLock.Unlock()
+	if !b.fdLoaded {
+		return nil
+	}
+
+	stale, err := b.swapInPinnedFD()
+	if err != nil || !stale {
+		return err
+	}
+	if b.readCache != nil {
+		b.readCache.clear()
+	}
+	if b.fdLoaded {
+		return nil
+	}
+	logrus.WithField("name", b.versionedName()).Warn("Map pin has gone, recreating the map.")
+	return b.ensureExists()
+}
+
+// swapInPinnedFD compares our file descriptor with the map that is pinned at our path.  If they
+// differ, our FD is replaced with one for the pinned map.  If there is no pin, our FD is dropped,
+// leaving fdLoaded false.  It returns whether our FD was stale.
+func (b *PinnedMap) swapInPinnedFD() (stale bool, err error) {
+	b.swapLock.Lock()
+	defer b.swapLock.Unlock()
+
+	info, infoErr := GetMapInfo(b.fd)
+	pinFD, err := GetMapFDByPin(b.versionedFilename())
+	if IsNotExists(err) {
+		b.dropFD(infoErr)
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open map pin")
+	}
+	pinInfo, err := GetMapInfo(pinFD)
+	if err != nil {
+		_ = pinFD.Close()
+		return false, errors.Wrap(err, "failed to get info for pinned map")
+	}
+	if infoErr == nil && info.ID == pinInfo.ID {
+		_ = pinFD.Close()
+		return false, nil
+	}
+	b.dropFD(infoErr)
+	b.setFD(pinFD)
+	logrus.WithField("name", b.versionedName()).Warn("Map FD was stale, reopened it from its pin.")
+	return true, nil
+}
+
+// dropFD forgets our file descriptor.  It is only closed if infoErr, the result of querying it,
+// shows that it is still open: if it was closed behind our back, the number may since have been
+// reused for something else.
+func (b *PinnedMap) dropFD(infoErr error) {
+	if infoErr != unix.EBADF {
+		_ = b.Close()
+		return
+	}
+	b.fdLoaded = false
+	b.fd = 0
+	b.context.fdClosed()
+}
+
+// CreatedAt returns the time that the map was pinned, which can be used to tell whether a map
+// survived a restart.  The kernel doesn't record a creation time for maps (unlike programs, there
+// is no load time in bpf_map_info) so this is the modification time of the pin.  For maps that we
+// create, that is the creation time; for repinned maps, it is the time that they were repinned.
+func (b *PinnedMap) CreatedAt() (time.Time, error) {
+	info, err := os.Stat(b.versionedFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, ErrMapNotFound
+		}
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// ID returns the kernel's ID for the map.
+func (b *PinnedMap) ID() (int, error) {
+	info, err := b.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.ID, nil
+}
+
+// SameAs returns true if other refers to the same kernel map as b, as determined by comparing
+// their kernel map IDs.  This is more reliable than comparing pin paths, which may differ for the
+// same map (for example, if the map has been pinned twice).  other must be a map that can report
+// its ID, such as another PinnedMap or an FDMap.
+func (b *PinnedMap) SameAs(other Map) (bool, error) {
+	o, ok := other.(interface{ ID() (int, error) })
+	if !ok {
+		return false, errors.Errorf("can't get the ID of map %s (%T)", other.GetName(), other)
+	}
+	id, err := b.ID()
+	if err != nil {
+		return false, err
+	}
+	otherID, err := o.ID()
+	if err != nil {
+		return false, err
+	}
+	return id == otherID, nil
+}
+
+// MaxEntriesConfigured returns the max_entries that the kernel reports for the map.  This can
+// differ from MapParameters.MaxEntries if we adopted an existing map that was created with a
+// different size.
+func (b *PinnedMap) MaxEntriesConfigured() (uint32, error) {
+	info, err := b.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(info.MaxEntries), nil
+}
+
+// KernelName returns the map's name as stored by the kernel, which is the name that the map was
+// created with, truncated to BPF_OBJ_NAME_LEN-1 characters.  For a map that we opened rather
+// than created, it can differ from the name in the map's parameters.  It is empty for maps
+// without a name and if the kernel's map info couldn't be read and fdinfo, which doesn't include
+// the name, was used instead.
+func (b *PinnedMap) KernelName() (string, error) {
+	info, err := b.GetInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Name, nil
+}
+
+// checkAdoptedName warns if a map that we opened, rather than created, has a different name to
+// the one that we'd have created it with; for example, because another agent pinned a different
+// map at our path.
+func (b *PinnedMap) checkAdoptedName() {
+	// Called from ensureExists, which may hold lazyLock, so don't go through KernelName.
+	info, err := b.getInfo()
+	if err != nil {
+		logrus.WithError(err).WithField("name", b.versionedName()).Warn(
+			"Failed to check name of existing map")
+		return
+	}
+	if info.Name != "" && info.Name != truncateMapName(b.versionedName()) {
+		logrus.WithFields(logrus.Fields{
+			"name":       b.versionedName(),
+			"kernelName": info.Name,
+			"path":       b.versionedFilename(),
+		}).Warn("Existing map has a different name to the requested name.")
+	}
+}
+
+// checkAdoptedSize warns if a map that we opened, rather than created, doesn't have the size
+// that we asked for.
+func (b *PinnedMap) checkAdoptedSize() {
+	// Called from ensureExists, which may hold lazyLock, so don't go through GetInfo.
+	info, err := b.getInfo()
+	if err != nil {
+		logrus.WithError(err).WithField("name", b.versionedName()).Warn(
+			"Failed to check size of existing map")
+		return
+	}
+	if info.MaxEntries != b.MaxEntries {
+		logrus.WithFields(logrus.Fields{
+			"name":       b.versionedName(),
+			"configured": info.MaxEntries,
+			"requested":  b.MaxEntries,
+		}).Warn("Existing map has different max entries to the requested size.")
+	}
+}
+
+// AttachedPrograms returns the IDs of the loaded BPF programs that use the map.
+func (b *PinnedMap) AttachedPrograms() ([]uint32, error) {
+	id, err := b.ID()
+	if err != nil {
+		return nil, err
+	}
+	progs, err := getAllProgs()
+	if err != nil {
+		return nil, err
+	}
+	return programsUsingMap(progs, id), nil
+}
+
+func programsUsingMap(progs []progInfo, mapID int) []uint32 {
+	var ids []uint32
+	for _, p := range progs {
+		for _, id := range p.MapIds {
+			if id == mapID {
+				ids = append(ids, uint32(p.Id))
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Unpin closes the map and removes its pin.  Removing the pin doesn't remove the map from any
+// programs that use it so, unless force is set, Unpin refuses to unpin a map that is still in use.
+func (b *PinnedMap) Unpin(force bool) error {
+	progIDs, err := b.programsUsingPin()
+	if err != nil {
+		if !force {
+			return errors.WithMessage(err, "failed to check for programs using map")
+		}
+		logrus.WithError(err).Warn("Failed to check for programs using map, unpinning anyway")
+	} else if len(progIDs) > 0 {
+		if !force {
+			return errors.Errorf("map %s is used by programs %v", b.versionedName(), progIDs)
+		}
+		logrus.WithField("programs", progIDs).WithField("name", b.versionedName()).Warn(
+			"Unpinning map that is still used by programs")
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return os.Remove(b.versionedFilename())
+}
+
+// programsUsingPin returns the IDs of the loaded BPF programs that use the map.  If the map isn't
+// open, its pin is opened temporarily to find out which map it is; if there is no pin, there are
+// no programs to check for.
+func (b *PinnedMap) programsUsingPin() ([]uint32, error) {
+	if b.fdLoaded {
+		return b.AttachedPrograms()
+	}
+	fd, err := GetMapFDByPin(b.versionedFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open pin %s", b.versionedFilename())
+	}
+	defer fd.Close()
+	info, err := GetMapInfo(fd)
+	if err != nil {
+		return nil, err
+	}
+	progs, err := getAllProgs()
+	if err != nil {
+		return nil, err
+	}
+	return programsUsingMap(progs, info.ID), nil
+}
+
 func (b *PinnedMap) RepinningEnabled() bool {
 	if b.context == nil {
 		return false
@@ -143,15 +952,38 @@ func DumpMapCmd(m Map) ([]string, error) {
 	return nil, errors.Errorf("unrecognized map type %T", m)
 }
 
-// IterMapCmdOutput iterates over the outout of a command obtained by DumpMapCmd
+// IterMapCmdOutput iterates over the outout of a command obtained by DumpMapCmd.  The JSON array is
+// decoded one entry at a time, so the whole dump is never held in memory as Go values and, if the
+// output was truncated, the complete entries before the truncation point are still passed to f
+// before an error with cause ErrDumpTruncated is returned.
 func IterMapCmdOutput(output []byte, f MapIter) error {
-	var mp []mapEntry
-	err := json.Unmarshal(output, &mp)
-	if err != nil {
+	dec := json.NewDecoder(bytes.NewReader(output))
+	numEntries := 0
+	checkErr := func(err error) error {
+		truncated := err == io.EOF || err == io.ErrUnexpectedEOF
+		if syntaxErr, ok := err.(*json.SyntaxError); ok && syntaxErr.Error() == "unexpected end of JSON input" {
+			// Reported when the input ends between the tokens of the array.
+			truncated = true
+		}
+		if truncated {
+			return errors.WithMessage(ErrDumpTruncated,
+				fmt.Sprintf("after %d entries (%d bytes)", numEntries, len(output)))
+		}
 		return errors.Errorf("cannot parse json output: %v\n%s", err, output)
 	}
 
-	for _, me := range mp {
+	tok, err := dec.Token()
+	if err != nil {
+		return checkErr(err)
+	}
+	if tok != json.Delim('[') {
+		return errors.Errorf("cannot parse json output: expected an array\n%s", output)
+	}
+	for dec.More() {
+		var me mapEntry
+		if err := dec.Decode(&me); err != nil {
+			return checkErr(err)
+		}
 		k, err := hexStringsToBytes(me.Key)
 		if err != nil {
 			return errors.Errorf("failed parsing entry %s key: %e", me, err)
@@ -161,49 +993,848 @@ func IterMapCmdOutput(output []byte, f MapIter) error {
 			return errors.Errorf("failed parsing entry %s val: %e", me, err)
 		}
 		f(k, v)
+		numEntries++
+	}
+	if _, err := dec.Token(); err != nil {
+		return checkErr(err)
 	}
 
 	return nil
 }
 
-func (b *PinnedMap) Iter(f MapIter) error {
+// RawDump returns the unparsed JSON output of bpftool's map dump.  It is intended for debugging
+// mismatches between IterMapCmdOutput and the output of a particular bpftool version.
+func (b *PinnedMap) RawDump() ([]byte, error) {
 	cmd, err := DumpMapCmd(b)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	prog := cmd[0]
 	args := cmd[1:]
 
 	printCommand(prog, args...)
-	output, err := exec.Command(prog, args...).Output()
+	dumpCmd, cancel := b.context.command(prog, args...)
+	defer cancel()
+	output, err := dumpCmd.Output()
 	if err != nil {
-		return errors.Errorf("failed to dump in map (%s): %s\n%s", b.versionedFilename(), err, output)
-	}
-
-	if err := IterMapCmdOutput(output, f); err != nil {
-		return errors.WithMessagef(err, "map %s", b.versionedFilename())
+		return nil, errors.Errorf("failed to dump in map (%s): %s\n%s", b.versionedFilename(), err, output)
 	}
 
-	return nil
-}
-
-func (b *PinnedMap) Update(k, v []byte) error {
-	if b.perCPU {
-		// Per-CPU maps need a buffer of value-size * num-CPUs.
-		logrus.Panic("Per-CPU operations not implemented")
-	}
-	return UpdateMapEntry(b.fd, k, v)
+	return output, nil
+}
+
+// Iter calls f for each entry in the map.  Depending on the context's Backend, the entries are
+// read with BPF_MAP_GET_NEXT_KEY and lookups or by parsing the output of bpftool.  The
+// callback is only invoked once all the keys have been read so, in auto mode, a failure of the
+// native path never results in entries being delivered twice.
+//
+// If f panics, iteration stops.  Neither path holds a lock, an extra FD or a running bpftool
+// process while f is being called, so nothing is leaked.  The panic is then re-raised with its
+// original value or, if the context's RecoverIterPanics is set, returned as an error with cause
+// ErrIterCallbackPanic.
+func (b *PinnedMap) Iter(f MapIter) (err error) {
+	defer func() {
+		b.context.recordOp(b.versionedName(), "iter", nil, err)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			// Set err even if we re-panic, so that the history records the failure.
+			var repanic interface{}
+			repanic, err = b.context.iterPanicError(b.versionedName(), r)
+			if repanic != nil {
+				panic(repanic)
+			}
+		}
+	}()
+	f = guardIterCallback(f)
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	calledF := false
+	native := func() error {
+		return b.iterNative(func(k, v []byte) {
+			calledF = true
+			f(k, v)
+		})
+	}
+	if b.perCPU && b.context.backend() == BackendAuto {
+		native = func() error {
+			return errors.New("native iteration of per-CPU maps is not supported")
+		}
+	}
+	return b.context.runDualPath("iter", b.versionedName(), native, func() error {
+		output, err := b.RawDump()
+		if err != nil {
+			return err
+		}
+		if err := IterMapCmdOutput(output, f); err != nil {
+			return errors.WithMessagef(err, "map %s", b.versionedFilename())
+		}
+		return nil
+	}, func(error) bool {
+		return !calledF
+	})
+}
+
+// Update writes v to the map under k.  If the map is full, the error's cause is ErrMapFull; if the
+// map has been frozen, it is ErrMapFrozen and, once the map is known to be frozen, no syscall is
+// made.
+func (b *PinnedMap) Update(k, v []byte) (err error) {
+	if b.perCPU {
+		// Per-CPU maps need a buffer of value-size * num-CPUs.
+		logrus.Panic("Per-CPU operations not implemented")
+	}
+	return b.write("update", k, func(fd MapFD) ([]byte, error) {
+		return v, UpdateMapEntry(fd, k, v)
+	})
+}
+
+// writesObserved returns true if the context's OnMutate hook or history needs to see each write,
+// so that writes mustn't take a shortcut around write.
+func (b *PinnedMap) writesObserved() bool {
+	c := b.context
+	return c != nil && (c.OnMutate != nil || atomic.LoadInt32(&c.history.enabled) != 0)
+}
+
+// write is the common path for every write to the map.  It calls do with the map's FD, holding
+// swapLock, to make the change, and returns do's error after converting map-full and frozen
+// errors.  It also records the operation in the context's history, invalidates the read cache
+// and, if the write succeeded, fires the context's OnMutate hook with op, the entry's previous
+// value and the new value that do returns (nil for a delete).  The caller must not hold swapLock.
+func (b *PinnedMap) write(op string, k []byte, do func(fd MapFD) (newValue []byte, err error)) (err error) {
+	defer func() {
+		b.context.recordOp(b.versionedName(), op, k, err)
+	}()
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.frozen) != 0 {
+		return b.frozenErr()
+	}
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
+	defer b.InvalidateCache(k)
+
+	hook := b.context != nil && b.context.OnMutate != nil
+	var old []byte
+	if hook {
+		old = b.lookupForHook(k)
+	}
+	newValue, err := do(b.fd)
+	if err != nil {
+		return b.checkFrozen(b.checkMapFull(err))
+	}
+	if hook {
+		b.context.OnMutate(b.versionedName(), op, k, old, newValue)
+	}
+	return nil
+}
+
+// lookupForHook returns the current value of k for the OnMutate hook, or nil if it can't be read
+// (or the map is per-CPU).  The caller must hold swapLock.
+func (b *PinnedMap) lookupForHook(k []byte) []byte {
+	if b.perCPU {
+		return nil
+	}
+	v, err := GetMapEntry(b.fd, k, b.ValueSize)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// UpdateKeyedBy stores v under the key computed by keyFn(v), for self-keyed maps where the key is
+// derived from the value (for example, a hash of it).  Using the same keyFn everywhere keeps
+// userspace in agreement with the BPF program about how keys are derived.
+func (b *PinnedMap) UpdateKeyedBy(v []byte, keyFn func(v []byte) []byte) error {
+	k, err := b.keyFor(v, keyFn)
+	if err != nil {
+		return err
+	}
+	return b.Update(k, v)
+}
+
+// DeleteKeyedBy deletes the entry whose key is keyFn(v).  See UpdateKeyedBy.
+func (b *PinnedMap) DeleteKeyedBy(v []byte, keyFn func(v []byte) []byte) error {
+	k, err := b.keyFor(v, keyFn)
+	if err != nil {
+		return err
+	}
+	return b.Delete(k)
+}
+
+func (b *PinnedMap) keyFor(v []byte, keyFn func(v []byte) []byte) ([]byte, error) {
+	k := keyFn(v)
+	if len(k) != b.KeySize {
+		return nil, errors.Errorf("computed key has wrong size (%d), expected %d", len(k), b.KeySize)
+	}
+	return k, nil
+}
+
+// SupportsDelete returns true if the map's type allows entries to be deleted by key.
+func (b *PinnedMap) SupportsDelete() bool {
+	return MapTypeSupportsDelete(b.Type)
+}
+
+// AssertType checks the type of the map, as reported by the kernel, against expected.
+func (b *PinnedMap) AssertType(expected string) error {
+	info, err := b.GetInfo()
+	if err != nil {
+		return errors.WithMessage(err, "failed to get map type")
+	}
+	return assertMapType(b.versionedName(), info, expected)
+}
+
+// assertMapType checks the type in a map's kernel info against expected.
+func assertMapType(name string, info *MapInfo, expected string) error {
+	actual := MapTypeName(uint32(info.Type))
+	if actual == "" {
+		actual = fmt.Sprintf("unknown (%d)", info.Type)
+	}
+	if actual != expected {
+		return errors.Errorf("map %s is of type %s, expected %s", name, actual, expected)
+	}
+	return nil
+}
+
+// checkMapFull converts the errors that the kernel returns when a map has no room for a new key
+// (E2BIG for hash maps, ENOSPC for some other types) into ErrMapFull and notifies the context.
+func (b *PinnedMap) checkMapFull(err error) error {
+	if !isMapFullErr(err) {
+		return err
+	}
+	if b.context != nil && b.context.OnMapFull != nil {
+		b.context.OnMapFull(b.versionedName())
+	}
+	return errors.WithMessage(ErrMapFull, fmt.Sprintf("map %s (%v)", b.versionedName(), err))
+}
+
+func isMapFullErr(err error) bool {
+	return err == unix.E2BIG || err == unix.ENOSPC
+}
+
+// UpdateRange writes values to consecutive indices of an array map, starting at startIndex.  All
+// values are validated before any are written.  If the map was created with BPF_F_MMAPABLE, the
+// values are copied straight into a shared mapping of the array, saving a syscall per entry;
+// otherwise, or if the context's OnMutate hook or history needs to see each write, they are
+// written one at a time with Update.  Writes through the mapping aren't atomic, so a BPF program
+// can see a partly-written value.
+func (b *PinnedMap) UpdateRange(startIndex uint32, values [][]byte) error {
+	if b.Type != "array" {
+		return errors.Errorf("map %s is not an array map (type %s)", b.versionedName(), b.Type)
+	}
+	if int64(startIndex)+int64(len(values)) > int64(b.MaxEntries) {
+		return errors.Errorf("range [%d, %d) exceeds max entries (%d) of map %s",
+			startIndex, int64(startIndex)+int64(len(values)), b.MaxEntries, b.versionedName())
+	}
+	for i, v := range values {
+		if len(v) != b.ValueSize {
+			return errors.Errorf("value at index %d has wrong size (%d), expected %d",
+				startIndex+uint32(i), len(v), b.ValueSize)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if b.Flags&bpfFMmapable != 0 && !b.writesObserved() && b.context.backend() != BackendBPFTool {
+		return b.updateRangeMmap(startIndex, values)
+	}
+
+	k := make([]byte, 4)
+	for i, v := range values {
+		nativeEndian.PutUint32(k, startIndex+uint32(i))
+		if err := b.Update(k, v); err != nil {
+			return errors.WithMessagef(err, "failed to update index %d", startIndex+uint32(i))
+		}
+	}
+	return nil
+}
+
+// bpfFMmapable is the kernel's BPF_F_MMAPABLE map flag (Linux 5.5), which lets an array map be
+// mmapped.
+const bpfFMmapable = 0x400
+
+// updateRangeMmap implements UpdateRange for a BPF_F_MMAPABLE array by mapping the pages that
+// hold the range.  The kernel lays the values out at multiples of the value size rounded up to 8
+// bytes.
+func (b *PinnedMap) updateRangeMmap(startIndex uint32, values [][]byte) error {
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.frozen) != 0 {
+		return b.frozenErr()
+	}
+	stride := perCPUValueStride(b.ValueSize)
+	start := int(startIndex) * stride
+	offset := start &^ (os.Getpagesize() - 1)
+	length := start + len(values)*stride - offset
+
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
+	mem, err := unix.Mmap(int(b.fd), int64(offset), length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return errors.WithMessagef(b.checkFrozen(err), "failed to mmap map %s", b.versionedName())
+	}
+	defer func() {
+		_ = unix.Munmap(mem)
+	}()
+	k := make([]byte, 4)
+	for i, v := range values {
+		copy(mem[start-offset+i*stride:], v)
+		nativeEndian.PutUint32(k, startIndex+uint32(i))
+		b.InvalidateCache(k)
+	}
+	return nil
 }
 
 func (b *PinnedMap) Get(k []byte) ([]byte, error) {
+	if b.readCache != nil {
+		if v, ok := b.readCache.get(k); ok {
+			return v, nil
+		}
+	}
+	v, err := b.getUncached(k)
+	if err == nil && b.readCache != nil {
+		b.readCache.put(k, v)
+	}
+	return v, err
+}
+
+// getUncached looks up k in the kernel, bypassing the read cache.  Read-modify-write operations
+// must use it so that they don't write back a stale value.
+func (b *PinnedMap) getUncached(k []byte) ([]byte, error) {
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
 	if b.perCPU {
 		// Per-CPU maps need a buffer of value-size * num-CPUs.
 		logrus.Panic("Per-CPU operations not implemented")
 	}
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
 	return GetMapEntry(b.fd, k, b.ValueSize)
 }
 
+// withFD calls f with the map's file descriptor, holding swapLock for reading so that Compact
+// can't close or replace the descriptor while f is using it.  f must not take swapLock again.
+func (b *PinnedMap) withFD(f func(fd MapFD) error) error {
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
+	return f(b.fd)
+}
+
+// Touch marks an entry in an LRU map as recently used, without changing its value, so that the
+// kernel is less likely to evict it.
+//
+// A lookup from userspace doesn't help: since v5.1, syscall lookups deliberately don't set the LRU
+// node's reference bit (only lookups from BPF programs do).  Instead, Touch rewrites the current
+// value with BPF_EXIST; the kernel allocates a fresh LRU node for the update.  A BPF program that
+// writes the entry between our read and write will have its change overwritten.
+func (b *PinnedMap) Touch(k []byte) error {
+	if !strings.Contains(b.Type, "lru") {
+		return errors.Errorf("map %s has type %s, Touch requires an LRU map", b.versionedName(), b.Type)
+	}
+	if b.perCPU {
+		return errors.Errorf("Touch of per-CPU map %s is not supported", b.versionedName())
+	}
+	if err := b.context.nativeOnly("touch", b.versionedName()); err != nil {
+		return err
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	return b.write("update", k, func(fd MapFD) ([]byte, error) {
+		v, err := GetMapEntry(fd, k, b.ValueSize)
+		if err != nil {
+			return nil, err
+		}
+		return v, UpdateMapEntryWithFlags(fd, k, v, unix.BPF_EXIST)
+	})
+}
+
+// Exists returns true if k is in the map.  It is intended for maps where only the presence of a
+// key matters.
+func (b *PinnedMap) Exists(k []byte) (bool, error) {
+	_, err := b.Get(k)
+	if IsNotExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ExistsBatch returns, for each of keys, whether it is in the map.  All the key sizes are checked
+// before any lookups are done.  BPF_MAP_LOOKUP_BATCH walks the map rather than looking up
+// particular keys, so this does one lookup per key; it saves callers from handling each error
+// separately rather than saving syscalls.
+func (b *PinnedMap) ExistsBatch(keys [][]byte) ([]bool, error) {
+	for i, k := range keys {
+		if len(k) != b.KeySize {
+			return nil, errors.Errorf("key %d has wrong size (%d), expected %d", i, len(k), b.KeySize)
+		}
+	}
+	exists := make([]bool, len(keys))
+	for i, k := range keys {
+		var err error
+		exists[i], err = b.Exists(k)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to look up key %d", i)
+		}
+	}
+	return exists, nil
+}
+
+// GetBatch looks up each of keys, returning its value and, in missing, whether it was absent (in
+// which case its value is nil).  All the key sizes are checked before any lookups are done.  As
+// with ExistsBatch, BPF_MAP_LOOKUP_BATCH can't look up particular keys, so this does one lookup
+// syscall per key, but it takes the map's locks once for the whole batch rather than once per key.
+// The read cache, if enabled, is used and filled as by Get.
+func (b *PinnedMap) GetBatch(keys [][]byte) (values [][]byte, missing []bool, err error) {
+	for i, k := range keys {
+		if len(k) != b.KeySize {
+			return nil, nil, errors.Errorf("key %d has wrong size (%d), expected %d", i, len(k), b.KeySize)
+		}
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, nil, err
+	}
+	if b.perCPU {
+		return nil, nil, errors.Errorf("batch get from per-CPU map %s is not supported", b.versionedName())
+	}
+	if err := b.context.nativeOnly("batch get", b.versionedName()); err != nil {
+		return nil, nil, err
+	}
+	values = make([][]byte, len(keys))
+	missing = make([]bool, len(keys))
+	b.swapLock.RLock()
+	defer b.swapLock.RUnlock()
+	for i, k := range keys {
+		if b.readCache != nil {
+			if v, ok := b.readCache.get(k); ok {
+				values[i] = v
+				continue
+			}
+		}
+		v, err := GetMapEntry(b.fd, k, b.ValueSize)
+		if IsNotExists(err) {
+			missing[i] = true
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "failed to look up key %d", i)
+		}
+		if b.readCache != nil {
+			b.readCache.put(k, v)
+		}
+		values[i] = v
+	}
+	return values, missing, nil
+}
+
+// GetOrCreate returns the value stored under k or, if there isn't one, inserts initial and returns
+// that.  The insert uses BPF_NOEXIST so, if another writer gets there first, its value is returned
+// rather than overwritten.
+func (b *PinnedMap) GetOrCreate(k, initial []byte) ([]byte, error) {
+	if len(k) != b.KeySize {
+		return nil, errors.Errorf("key has wrong size (%d), expected %d", len(k), b.KeySize)
+	}
+	if len(initial) != b.ValueSize {
+		return nil, errors.Errorf("initial value has wrong size (%d), expected %d", len(initial), b.ValueSize)
+	}
+	if err := b.context.nativeOnly("get-or-create", b.versionedName()); err != nil {
+		return nil, err
+	}
+	v, err := b.Get(k)
+	if !IsNotExists(err) {
+		return v, err
+	}
+	err = b.write("update", k, func(fd MapFD) ([]byte, error) {
+		return initial, UpdateMapEntryWithFlags(fd, k, initial, unix.BPF_NOEXIST)
+	})
+	if err == unix.EEXIST {
+		// Lost the race with another writer, return its value.
+		return b.Get(k)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return initial, nil
+}
+
+// AddUint64 adds delta to a uint64 value (in native byte order), creating the entry if it doesn't
+// exist.
+//
+// The increment is a lookup followed by an update so, while concurrent callers in this process
+// are serialised, it is NOT atomic with respect to BPF programs or other processes writing the
+// same entry.  BPF_F_LOCK can't help here: it requires a bpf_spin_lock inside the value, which
+// doesn't fit in a plain 8-byte counter.
+func (b *PinnedMap) AddUint64(k []byte, delta uint64) error {
+	if b.ValueSize != 8 {
+		return errors.Errorf("map %s has value size %d, expected 8", b.versionedName(), b.ValueSize)
+	}
+	if b.perCPU {
+		return errors.Errorf("map %s is a per-CPU map", b.versionedName())
+	}
+
+	b.rmwLock.Lock()
+	defer b.rmwLock.Unlock()
+
+	var current uint64
+	v, err := b.getUncached(k)
+	if err == nil {
+		current = nativeEndian.Uint64(v)
+	} else if !IsNotExists(err) {
+		return err
+	}
+
+	v = make([]byte, 8)
+	nativeEndian.PutUint64(v, current+delta)
+	return b.Update(k, v)
+}
+
+// Swap stores v under k and returns the value that it replaced, or nil if k wasn't in the map.
+//
+// Like AddUint64, this is a lookup followed by an update, serialised against other
+// read-modify-write operations in this process but NOT atomic with respect to BPF programs or
+// other processes.  BPF_MAP_LOOKUP_AND_DELETE_ELEM followed by an update wouldn't be better: it
+// is only supported for hash maps on recent kernels and it leaves a window in which the key is
+// missing altogether.
+func (b *PinnedMap) Swap(k, v []byte) (old []byte, err error) {
+	if len(k) != b.KeySize {
+		return nil, errors.Errorf("key has wrong size (%d), expected %d", len(k), b.KeySize)
+	}
+	if len(v) != b.ValueSize {
+		return nil, errors.Errorf("value has wrong size (%d), expected %d", len(v), b.ValueSize)
+	}
+
+	b.rmwLock.Lock()
+	defer b.rmwLock.Unlock()
+
+	old, err = b.getUncached(k)
+	if IsNotExists(err) {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := b.Update(k, v); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// UpdateMasked writes v to the entry for k, but only the bits that are set in mask; the other
+// bits keep their current values.  This lets us update the fields that userspace owns without
+// clobbering fields that the BPF program maintains, such as last-seen timestamps.  If k isn't in
+// the map, the unmasked bits are written as zero.
+//
+// Like AddUint64, this is a lookup followed by an update, serialised against other
+// read-modify-write operations in this process but NOT atomic with respect to BPF programs: a
+// kernel-owned field that changes between our lookup and our update is rolled back.  For values
+// that contain a struct bpf_spin_lock, UpdateMaskedLocked narrows the window.
+func (b *PinnedMap) UpdateMasked(k, v, mask []byte) error {
+	return b.updateMasked(k, v, mask, 0)
+}
+
+// UpdateMaskedLocked is UpdateMasked for maps whose values contain a struct bpf_spin_lock.  The
+// lookup and the update are each done with BPF_F_LOCK, so neither sees or leaves a value that a
+// BPF program is half-way through changing under the lock.  The kernel returns EINVAL if the
+// map's values don't have a spin lock.  Updates that the BPF program makes between our lookup and
+// our update are still overwritten.
+func (b *PinnedMap) UpdateMaskedLocked(k, v, mask []byte) error {
+	return b.updateMasked(k, v, mask, unix.BPF_F_LOCK)
+}
+
+func (b *PinnedMap) updateMasked(k, v, mask []byte, flags int) error {
+	if len(k) != b.KeySize {
+		return errors.Errorf("key has wrong size (%d), expected %d", len(k), b.KeySize)
+	}
+	if len(v) != b.ValueSize || len(mask) != b.ValueSize {
+		return errors.Errorf("value and mask must have size %d, got %d and %d", b.ValueSize, len(v), len(mask))
+	}
+	if b.perCPU {
+		return errors.Errorf("map %s is a per-CPU map", b.versionedName())
+	}
+
+	b.rmwLock.Lock()
+	defer b.rmwLock.Unlock()
+	return b.write("update", k, func(fd MapFD) ([]byte, error) {
+		current, err := getMapEntryWithFlags(fd, k, b.ValueSize, flags)
+		if IsNotExists(err) {
+			current = make([]byte, b.ValueSize)
+		} else if err != nil {
+			return nil, err
+		}
+		for i := range current {
+			current[i] = current[i]&^mask[i] | v[i]&mask[i]
+		}
+		return current, UpdateMapEntryWithFlags(fd, k, current, unix.BPF_ANY|flags)
+	})
+}
+
+// CompareAndSwapPair updates k1 to new1 and k2 to new2, but only if k1 currently holds expected1
+// and k2 holds expected2.  A nil expected value means that the key must be absent.  It returns
+// whether the values were swapped.
+//
+// The kernel can't update two keys atomically so this is best-effort: it is serialised against
+// other read-modify-write operations through this PinnedMap, but a BPF program or another
+// process can change either key between the reads and the writes, or read the map between the
+// two writes and see only the first.  If the second write fails, the first is reverted (again,
+// best-effort) before the error is returned.
+func (b *PinnedMap) CompareAndSwapPair(k1, expected1, new1, k2, expected2, new2 []byte) (bool, error) {
+	for _, k := range [][]byte{k1, k2} {
+		if len(k) != b.KeySize {
+			return false, errors.Errorf("key has wrong size (%d), expected %d", len(k), b.KeySize)
+		}
+	}
+	for _, v := range [][]byte{new1, new2} {
+		if len(v) != b.ValueSize {
+			return false, errors.Errorf("value has wrong size (%d), expected %d", len(v), b.ValueSize)
+		}
+	}
+
+	b.rmwLock.Lock()
+	defer b.rmwLock.Unlock()
+
+	matches := func(k, expected []byte) (bool, error) {
+		v, err := b.getUncached(k)
+		if IsNotExists(err) {
+			return expected == nil, nil
+		} else if err != nil {
+			return false, err
+		}
+		return expected != nil && bytes.Equal(v, expected), nil
+	}
+	for _, kv := range [][2][]byte{{k1, expected1}, {k2, expected2}} {
+		if ok, err := matches(kv[0], kv[1]); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if err := b.Update(k1, new1); err != nil {
+		return false, err
+	}
+	if err := b.Update(k2, new2); err != nil {
+		var revertErr error
+		if expected1 == nil {
+			revertErr = b.Delete(k1)
+		} else {
+			revertErr = b.Update(k1, expected1)
+		}
+		if revertErr != nil {
+			logrus.WithError(revertErr).WithField("name", b.versionedName()).Error(
+				"Failed to revert first key after failing to update second key in CompareAndSwapPair")
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Keys returns all the keys in the map.  It walks the map with BPF_MAP_GET_NEXT_KEY, so, unlike
+// Iter, it never transfers the values.  The order of the keys is unspecified and, if the map is
+// modified concurrently, keys may be skipped or returned more than once.
+func (b *PinnedMap) Keys() ([][]byte, error) {
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	err := b.context.runDualPath("keys", b.versionedName(), func() error {
+		return b.withFD(func(fd MapFD) (err error) {
+			keys, err = mapKeys(fd, b.KeySize)
+			return err
+		})
+	}, func() error {
+		keys = nil
+		output, err := b.RawDump()
+		if err != nil {
+			return err
+		}
+		return IterMapCmdOutput(output, func(k, v []byte) {
+			keys = append(keys, append([]byte(nil), k...))
+		})
+	}, func(error) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// mapKeys walks the keys of the map with BPF_MAP_GET_NEXT_KEY.
+func mapKeys(fd MapFD, keySize int) ([][]byte, error) {
+	var keys [][]byte
+	var k []byte
+	for {
+		next, err := GetMapNextKey(fd, k, keySize)
+		if IsNotExists(err) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, next)
+		k = next
+	}
+}
+
+// iterMapByID calls f for each entry of the map with the given ID, which must not be a per-CPU
+// map, using native syscalls.  Entries that are deleted during the walk are skipped.
+func iterMapByID(id, keySize, valueSize int, f MapIter) error {
+	fd, err := GetMapFDByID(id)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to open map by ID %d", id)
+	}
+	defer fd.Close()
+	keys, err := mapKeys(fd, keySize)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v, err := GetMapEntry(fd, k, valueSize)
+		if IsNotExists(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f(k, v)
+	}
+	return nil
+}
+
+// IterOrdered is like Iter but it calls f in order of the keys' bytes, so that dumps of the map
+// are reproducible.  It reads all the keys into memory and sorts them before looking up each
+// value in turn, so it is much slower than Iter for large maps.  Entries that are deleted while
+// IterOrdered is running are skipped.
+func (b *PinnedMap) IterOrdered(f MapIter) error {
+	keys, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	for _, k := range keys {
+		v, err := b.Get(k)
+		if IsNotExists(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f(k, v)
+	}
+	return nil
+}
+
+// ToGoMap reads the whole map into a Go map keyed by string(key).  It is intended for tests and
+// small config maps: it materialises every entry in memory, so it is unsuitable for huge maps,
+// and the key ordering of the BPF map is lost.
+func (b *PinnedMap) ToGoMap() (map[string][]byte, error) {
+	m := map[string][]byte{}
+	err := b.Iter(func(k, v []byte) {
+		m[string(k)] = append([]byte(nil), v...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VerifyAgainst compares the map with expected, which is keyed by string(key), and returns the
+// entries that don't match, sorted by key: for keys that are in the map but not in expected, or
+// whose values differ, the map's entry; for keys that are only in expected, an entry with a nil
+// Value.  It is intended for health checks of read-only config maps that should exactly match a
+// table shipped with the BPF program.  Unlike Diff, the map is streamed rather than loaded into
+// memory.
+func (b *PinnedMap) VerifyAgainst(expected map[string][]byte) ([]Entry, error) {
+	return verifyAgainst(b, expected)
+}
+
+// FromGoMap writes all the entries of m, which is keyed by string(key), to the map.  Existing
+// entries that aren't in m are left alone.  It stops at the first failed write.
+func (b *PinnedMap) FromGoMap(m map[string][]byte) error {
+	for k, v := range m {
+		if err := b.Update([]byte(k), v); err != nil {
+			return errors.WithMessagef(err, "failed to write key %x", k)
+		}
+	}
+	return nil
+}
+
+// IterPage returns up to limit entries, starting after the key token (or from the start of the map
+// if token is nil), and a token for the next page, which is nil once the map is exhausted.  Since
+// the token is just the last key returned, pages can be fetched statelessly, for example, across
+// separate API requests.
+//
+// Each page is read with BPF_MAP_GET_NEXT_KEY so, if the map is modified between (or during)
+// pages, entries can be skipped or returned twice.  In particular, if the token key has been
+// deleted, hash maps restart from the beginning.  Like the other iterators, it reads values from
+// the kernel rather than the read cache.
+func (b *PinnedMap) IterPage(token []byte, limit int) (entries []Entry, nextToken []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.Errorf("invalid page size %d", limit)
+	}
+	if err := b.context.nativeOnly("paged iteration", b.versionedName()); err != nil {
+		return nil, nil, err
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, nil, err
+	}
+	nextKey := func(k []byte) (next []byte, err error) {
+		err = b.withFD(func(fd MapFD) error {
+			next, err = GetMapNextKey(fd, k, b.KeySize)
+			return err
+		})
+		return
+	}
+	k := token
+	for len(entries) < limit {
+		next, err := nextKey(k)
+		if IsNotExists(err) {
+			return entries, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		k = next
+		// Bypass the read cache so that the values are as fresh as the keys.
+		v, err := b.getUncached(next)
+		if IsNotExists(err) {
+			// Deleted since we read the key.
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, Entry{Key: next, Value: v})
+	}
+	// Peek so that we can return a nil token when this page reached the end of the map.
+	if _, err := nextKey(k); IsNotExists(err) {
+		return entries, nil, nil
+	}
+	return entries, k, nil
+}
+
+// IterLimit calls f for at most maxEntries entries, so that a scheduler can round-robin over
+// several maps rather than letting one large map starve the others.  If it stops before the end
+// of the map, it returns an *IterLimitError holding the last key processed, which can be used as
+// the IterPage token to resume.  Unlike Iter, it reads the map a page at a time, so stopping early
+// doesn't cost a dump of the whole map.
+func (b *PinnedMap) IterLimit(maxEntries int, f MapIter) error {
+	entries, next, err := b.IterPage(nil, maxEntries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		f(e.Key, e.Value)
+	}
+	if next != nil {
+		return &IterLimitError{LastKey: next}
+	}
+	return nil
+}
+
 func appendBytes(strings []string, bytes []byte) []string {
 	for _, b := range bytes {
 		strings = append(strings, strconv.FormatInt(int64(b), 10))
@@ -213,41 +1844,145 @@ func appendBytes(strings []string, bytes []byte) []string {
 
 func (b *PinnedMap) Delete(k []byte) error {
 	logrus.WithField("key", k).Debug("Deleting map entry")
+	return b.write("delete", k, func(MapFD) ([]byte, error) {
+		return nil, b.delete(k)
+	})
+}
+
+func (b *PinnedMap) delete(k []byte) error {
+	return b.context.runDualPath("delete", b.versionedName(), func() error {
+		err := deleteMapEntry(b.fd, k, b.ValueSize)
+		if IsNotExists(err) {
+			logrus.WithField("k", k).Debug("Item didn't exist.")
+			return ErrKeyNotExist
+		}
+		return err
+	}, func() error {
+		return b.deleteBPFTool(k)
+	}, func(err error) bool {
+		return err != ErrKeyNotExist
+	})
+}
+
+func (b *PinnedMap) deleteBPFTool(k []byte) error {
 	args := make([]string, 0, 10+len(k))
-	args = append(args, "map", "delete",
+	args = append(args, "--json", "map", "delete",
 		"pinned", b.versionedFilename(),
 		"key")
 	args = appendBytes(args, k)
 
-	cmd := exec.Command("bpftool", args...)
+	cmd, cancel := b.context.command("bpftool", args...)
+	defer cancel()
 	out, err := cmd.Output()
 	if err != nil {
+		var stderr []byte
 		if err, ok := err.(*exec.ExitError); ok {
-			if strings.Contains(string(err.Stderr), "delete failed: No such file or directory") {
-				logrus.WithField("k", k).Debug("Item didn't exist.")
-				return os.ErrNotExist
-			}
+			stderr = err.Stderr
+		}
+		if b.isNotFoundAfterFailedDelete(k, out, stderr) {
+			logrus.WithField("k", k).Debug("Item didn't exist.")
+			return ErrKeyNotExist
 		}
 		logrus.WithField("out", string(out)).Error("Failed to run bpftool")
 	}
 	return err
 }
 
+// isNotFoundAfterFailedDelete classifies a failed bpftool delete.  bpftool's error text varies
+// between versions so, where we can, we confirm with a native lookup, which gives us an errno.
+// With the bpftool backend, we rely on the error text, so as not to make syscalls behind the
+// backend's back.
+func (b *PinnedMap) isNotFoundAfterFailedDelete(k, stdout, stderr []byte) bool {
+	if b.fdLoaded && !b.perCPU && b.context.backend() != BackendBPFTool {
+		_, err := GetMapEntry(b.fd, k, b.ValueSize)
+		return IsNotExists(err)
+	}
+	return isBPFToolNotFound(bpftoolErrorMessage(stdout, stderr))
+}
+
+type bpftoolError struct {
+	Error string `json:"error"`
+}
+
+// bpftoolErrorMessage extracts the error message from a failed bpftool command.  When run with
+// --json, bpftool reports errors as {"error": "..."} on stdout; otherwise (and in some older
+// versions) the error is written to stderr, prefixed with "Error:".
+func bpftoolErrorMessage(stdout, stderr []byte) string {
+	var e bpftoolError
+	if err := json.Unmarshal(stdout, &e); err == nil && e.Error != "" {
+		return e.Error
+	}
+	msg := strings.TrimSpace(string(stderr))
+	msg = strings.TrimPrefix(msg, "Error:")
+	return strings.TrimSpace(msg)
+}
+
+// isBPFToolNotFound returns true if the bpftool error message was caused by ENOENT.  bpftool
+// formats errno with strerror(), so we compare against that rather than the wording of the
+// message itself.
+func isBPFToolNotFound(msg string) bool {
+	return strings.HasSuffix(strings.ToLower(msg), unix.ENOENT.Error())
+}
+
 func (b *PinnedMap) EnsureExists() error {
+	if b.configErr != nil {
+		return b.configErr
+	}
+	if b.ValueLayout != nil {
+		if err := b.ValidateValueLayout(b.ValueLayout); err != nil {
+			return err
+		}
+	}
+	if b.LazyCreate {
+		b.lazyLock.Lock()
+		defer b.lazyLock.Unlock()
+		logrus.WithField("name", b.versionedName()).Debug("Deferring map creation until first use")
+		b.createRequested = true
+		return nil
+	}
+	return b.ensureExists()
+}
+
+// maybeCreateLazily creates (or opens) a LazyCreate map on its first use, if EnsureExists() has
+// been called for it.
+func (b *PinnedMap) maybeCreateLazily() error {
+	if !b.LazyCreate {
+		return nil
+	}
+	b.lazyLock.Lock()
+	defer b.lazyLock.Unlock()
+	if !b.createRequested {
+		return errors.Errorf("map %s used before EnsureExists() was called", b.versionedName())
+	}
+	return b.ensureExists()
+}
+
+func (b *PinnedMap) ensureExists() error {
 	if b.fdLoaded {
 		return nil
 	}
+	if b.context.OpenOnly {
+		return b.openExisting()
+	}
 
-	_, err := MaybeMountBPFfs()
+	_, err := b.context.MaybeMountBPFfs()
 	if err != nil {
 		logrus.WithError(err).Error("Failed to mount bpffs")
 		return err
 	}
-	// FIXME hard-coded dir
-	err = os.MkdirAll("/sys/fs/bpf/tc/globals", 0700)
+	err = os.MkdirAll(filepath.Dir(b.versionedFilename()), 0700)
 	if err != nil {
 		logrus.WithError(err).Error("Failed create dir")
-		return err
+		return readOnlyBPFFSErr(err)
+	}
+
+	removeLeftoverTempPin(b.versionedFilename())
+
+	if b.PinByName {
+		found, err := b.openByName()
+		if err != nil || found {
+			return err
+		}
 	}
 
 	_, err = os.Stat(b.versionedFilename())
@@ -256,9 +1991,12 @@ func (b *PinnedMap) EnsureExists() error {
 			return err
 		}
 		logrus.Debug("Map file didn't exist")
+		if b.context.RepinningEnabled && b.RepinFilter != nil {
+			return b.createAndCopyFromOldMap()
+		}
 		if b.context.RepinningEnabled {
 			logrus.WithField("name", b.Name).Info("Looking for map by name (to repin it)")
-			err = RepinMap(b.versionedName(), b.versionedFilename())
+			err = b.context.repinMap(b.versionedName(), b.versionedFilename(), &b.MapParameters)
 			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
@@ -267,64 +2005,399 @@ func (b *PinnedMap) EnsureExists() error {
 
 	if err == nil {
 		logrus.Debug("Map file already exists, trying to open it")
-		b.fd, err = GetMapFDByPin(b.versionedFilename())
+		var fd MapFD
+		fd, err = GetMapFDByPin(b.versionedFilename())
 		if err == nil {
-			b.fdLoaded = true
+			b.setFD(fd)
 			logrus.WithField("fd", b.fd).WithField("name", b.versionedFilename()).
 				Info("Loaded map file descriptor.")
+			b.checkAdoptedSize()
+			b.checkAdoptedName()
+		}
+		return err
+	}
+
+	return b.create()
+}
+
+// openByName opens the loaded map that has the map's name, for PinByName mode, and makes the pin
+// path refer to it.  It returns false if there is no map with the name.
+func (b *PinnedMap) openByName() (bool, error) {
+	meta, err := b.context.findMapByName(b.versionedName(), &b.MapParameters)
+	if os.IsNotExist(err) {
+		logrus.WithField("name", b.versionedName()).Debug("No map with that name, falling back to the pin path")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fd, err := GetMapFDByID(meta.ID)
+	if err != nil {
+		return false, errors.WithMessagef(err, "failed to open map %s by ID %d", b.versionedName(), meta.ID)
+	}
+	if err := b.repointPin(fd, meta.ID); err != nil {
+		_ = fd.Close()
+		return false, err
+	}
+	b.setFD(fd)
+	logrus.WithField("fd", b.fd).WithField("name", b.versionedName()).WithField("id", meta.ID).
+		Info("Loaded map file descriptor by name.")
+	return true, nil
+}
+
+// repointPin makes the map's pin path refer to the map with the given ID, replacing any pin to a
+// different map.
+func (b *PinnedMap) repointPin(fd MapFD, id int) error {
+	path := b.versionedFilename()
+	if pinnedFD, err := GetMapFDByPin(path); err == nil {
+		info, err := GetMapInfo(pinnedFD)
+		_ = pinnedFD.Close()
+		if err == nil && info.ID == id {
+			return nil
+		}
+		logrus.WithField("path", path).Info("Pin refers to a different map, replacing it")
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "failed to remove stale pin")
 		}
+	}
+	return PinBPFMap(fd, path)
+}
+
+// openExisting opens the map's existing pin, for OpenOnly mode.
+func (b *PinnedMap) openExisting() error {
+	if _, err := os.Stat(b.versionedFilename()); os.IsNotExist(err) {
+		return errors.WithMessage(ErrMapNotFound, b.versionedFilename())
+	}
+	fd, err := GetMapFDByPin(b.versionedFilename())
+	if err != nil {
+		return err
+	}
+	b.setFD(fd)
+	logrus.WithField("fd", b.fd).WithField("name", b.versionedFilename()).
+		Info("Loaded map file descriptor.")
+	return nil
+}
+
+// readOnlyBPFFSErr converts an EROFS error into one with ErrBPFFSReadOnly as its cause.
+func readOnlyBPFFSErr(err error) error {
+	cause := errors.Cause(err)
+	switch e := cause.(type) {
+	case *os.PathError:
+		cause = e.Err
+	case *os.LinkError:
+		cause = e.Err
+	case *os.SyscallError:
+		cause = e.Err
+	}
+	if cause != unix.EROFS {
 		return err
 	}
+	return errors.WithMessage(ErrBPFFSReadOnly, fmt.Sprintf(
+		"%v (to use existing maps without creating them, set MapContext.OpenOnly)", err))
+}
 
+func (b *PinnedMap) create() error {
 	logrus.Debug("Map didn't exist, creating it")
-	cmd := exec.Command("bpftool", "map", "create", b.versionedFilename(),
-		"type", b.Type,
-		"key", fmt.Sprint(b.KeySize),
-		"value", fmt.Sprint(b.ValueSize),
-		"entries", fmt.Sprint(b.MaxEntries),
-		"name", b.versionedName(),
-		"flags", fmt.Sprint(b.Flags),
-	)
-	out, err := cmd.CombinedOutput()
+	return b.context.runDualPath("create", b.versionedName(), func() error {
+		return readOnlyBPFFSErr(b.createNative())
+	}, b.createBPFTool, func(err error) bool {
+		// bpftool would fail in the same way but with a less useful error.
+		return errors.Cause(err) != ErrBPFFSReadOnly
+	})
+}
+
+func (b *PinnedMap) createBPFTool() error {
+	var err error
+	var extraArgs []string
+	if b.InnerMap != nil {
+		// Map-in-map types need an example of the inner map at creation time.  The kernel
+		// only uses it to record the inner map's type and sizes so we can remove it again
+		// straight away.
+		templateFilename := b.versionedFilename() + "_tmpl"
+		err = b.context.bpftoolCreateMap(templateFilename, b.InnerMap)
+		if err != nil {
+			return errors.WithMessage(err, "failed to create inner map template")
+		}
+		defer func() {
+			_ = os.Remove(templateFilename)
+		}()
+		extraArgs = []string{"inner_map", "pinned", templateFilename}
+	}
+	err = b.context.bpftoolCreateMap(b.versionedFilename(), &b.MapParameters, extraArgs...)
 	if err != nil {
-		logrus.WithField("out", string(out)).Error("Failed to run bpftool")
 		return err
 	}
-	b.fd, err = GetMapFDByPin(b.versionedFilename())
+	fd, err := GetMapFDByPin(b.versionedFilename())
 	if err == nil {
-		b.fdLoaded = true
+		b.setFD(fd)
 		logrus.WithField("fd", b.fd).WithField("name", b.versionedFilename()).
 			Info("Loaded map file descriptor.")
 	}
 	return err
 }
 
+// createNative creates and pins the map using the bpf syscall directly, avoiding the cost of
+// running bpftool.
+//
+// The map is pinned under a temporary name and only renamed into place once we know that the
+// pin refers to a valid map.  Since the rename is atomic, anyone looking for the map either sees
+// no pin or a complete one.  If we die before the rename, the temporary pin is cleaned up by the
+// next call to EnsureExists().
+func (b *PinnedMap) createNative() error {
+	fd, err := CreateMap(b.MapParameters)
+	if err != nil {
+		return &CreateError{Params: b.MapParameters, Err: err}
+	}
+	tmpFilename := tempPinFilename(b.versionedFilename())
+	err = PinBPFMap(fd, tmpFilename)
+	if err == nil {
+		_, err = GetMapInfo(fd)
+		if err == nil {
+			err = os.Rename(tmpFilename, b.versionedFilename())
+		}
+		if err != nil {
+			_ = os.Remove(tmpFilename)
+		}
+	}
+	if err != nil {
+		_ = fd.Close()
+		return errors.WithMessage(err, "failed to pin map")
+	}
+	b.setFD(fd)
+	logrus.WithField("fd", b.fd).WithField("name", b.versionedFilename()).
+		Info("Created map with BPF_MAP_CREATE.")
+	return nil
+}
+
+func tempPinFilename(filename string) string {
+	return filename + ".tmp"
+}
+
+// removeLeftoverTempPin removes the temporary pin left behind if a previous createNative() was
+// interrupted before it renamed the pin into place.
+func removeLeftoverTempPin(filename string) {
+	tmpFilename := tempPinFilename(filename)
+	err := os.Remove(tmpFilename)
+	if err == nil {
+		logrus.WithField("filename", tmpFilename).Info("Removed leftover temporary map pin.")
+	} else if !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("filename", tmpFilename).Warn(
+			"Failed to remove leftover temporary map pin.")
+	}
+}
+
+// createAndCopyFromOldMap is the RepinFilter variant of repinning: it creates a new map and
+// copies the entries that pass the filter from the old map with the same name, if there is one.
+func (b *PinnedMap) createAndCopyFromOldMap() error {
+	logrus.WithField("name", b.Name).Info("Looking for map by name (to copy filtered entries)")
+	old, err := b.context.findMapByName(b.versionedName(), &b.MapParameters)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.create(); err != nil {
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+
+	var entries [][2][]byte
+	collect := func(k, v []byte) {
+		entries = append(entries, [2][]byte{k, v})
+	}
+	err = b.context.runDualPath("copy", b.versionedName(), func() error {
+		entries = nil
+		return iterMapByID(old.ID, b.KeySize, b.ValueSize, collect)
+	}, func() error {
+		entries = nil
+		cmd, cancel := b.context.command("bpftool", "--json", "map", "dump", "id", fmt.Sprint(old.ID))
+		defer cancel()
+		output, err := cmd.Output()
+		if err != nil {
+			return errors.Errorf("failed to dump old map (id %d): %s\n%s", old.ID, err, output)
+		}
+		return IterMapCmdOutput(output, collect)
+	}, func(error) bool { return true })
+	if err != nil {
+		return errors.WithMessage(err, "failed to read entries from old map")
+	}
+
+	// Write straight to the new FD: this runs from ensureExists, which may hold lazyLock, so
+	// going through Update would try to create the map again.
+	var copied, dropped int
+	for _, e := range entries {
+		if !b.RepinFilter(e[0], e[1]) {
+			dropped++
+			continue
+		}
+		if err := UpdateMapEntry(b.fd, e[0], e[1]); err != nil {
+			return errors.WithMessage(b.checkMapFull(err), "failed to copy entries from old map")
+		}
+		copied++
+	}
+	logrus.WithFields(logrus.Fields{
+		"name":    b.versionedName(),
+		"copied":  copied,
+		"dropped": dropped,
+	}).Info("Copied entries from old map.")
+	return nil
+}
+
+func (c *MapContext) bpftoolCreateMap(filename string, mp *MapParameters, extraArgs ...string) error {
+	args := []string{"map", "create", filename,
+		"type", mp.Type,
+		"key", fmt.Sprint(mp.KeySize),
+		"value", fmt.Sprint(mp.ValueSize),
+		"entries", fmt.Sprint(mp.MaxEntries),
+		"name", mp.versionedName(),
+		"flags", fmt.Sprint(mp.Flags),
+	}
+	args = append(args, extraArgs...)
+	cmd, cancel := c.command("bpftool", args...)
+	defer cancel()
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr []byte
+		if err, ok := err.(*exec.ExitError); ok {
+			stderr = err.Stderr
+		}
+		logrus.WithField("out", string(out)).WithField("stderr", string(stderr)).Error("Failed to run bpftool")
+		return &CreateError{Params: *mp, Stderr: string(stderr), Err: err}
+	}
+	return nil
+}
+
+// CreateInnerMap creates a new inner map, using the map's InnerMap parameters as a template, and
+// stores it in this (outer) map under the given key.  The inner map is pinned next to the outer
+// map; if that pin already exists, the pinned map is reused.  Inner maps all share the template's
+// name, so they are always created directly, never found by name and repinned.
+func (b *PinnedMap) CreateInnerMap(key []byte) (*PinnedMap, error) {
+	if b.InnerMap == nil {
+		return nil, errors.Errorf("map %s has no inner map template", b.versionedName())
+	}
+	params := *b.InnerMap
+	params.Name = b.context.NamePrefix + params.Name
+	params.Filename = fmt.Sprintf("%s_%x", b.versionedFilename(), key)
+	if err := params.validate(); err != nil {
+		return nil, errors.WithMessage(err, "invalid inner map template")
+	}
+	inner := b.context.newPinnedMap(params)
+	if err := inner.openOrCreateInner(); err != nil {
+		inner.context.unregister(inner)
+		return nil, errors.WithMessage(err, "failed to create inner map")
+	}
+
+	v := make([]byte, 4)
+	nativeEndian.PutUint32(v, uint32(inner.fd))
+	if err := b.Update(key, v); err != nil {
+		return nil, errors.WithMessage(err, "failed to add inner map to outer map")
+	}
+	return inner, nil
+}
+
+// openOrCreateInner opens the inner map's pin, or creates and pins a new map if there isn't one.
+func (b *PinnedMap) openOrCreateInner() error {
+	filename := b.versionedFilename()
+	fd, err := GetMapFDByPin(filename)
+	if err == nil {
+		b.setFD(fd)
+		return nil
+	}
+	if !IsNotExists(err) {
+		return err
+	}
+	fd, err = CreateMap(b.MapParameters)
+	if err != nil {
+		return err
+	}
+	if err := PinBPFMap(fd, filename); err != nil {
+		_ = fd.Close()
+		return readOnlyBPFFSErr(err)
+	}
+	b.setFD(fd)
+	return nil
+}
+
 type bpftoolMapMeta struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	KeySize    int    `json:"bytes_key"`
+	ValueSize  int    `json:"bytes_value"`
+	MaxEntries int    `json:"max_entries"`
 }
 
+// RepinMap looks for a map with the given name and pins it to filename.
 func RepinMap(name string, filename string) error {
-	cmd := exec.Command("bpftool", "map", "list", "-j")
+	return (&MapContext{}).repinMap(name, filename, nil)
+}
+
+// repinMap looks for a map with the given name and pins it to filename.  If mp is non-nil, it is
+// used to choose between maps that share the same (truncated) name.
+func (c *MapContext) repinMap(name string, filename string, mp *MapParameters) error {
+	m, err := c.findMapByName(name, mp)
+	if err != nil {
+		return err
+	}
+	// Found the map, try to repin it.
+	cmd, cancel := c.command("bpftool", "map", "pin", "id", fmt.Sprint(m.ID), filename)
+	defer cancel()
+	return errors.Wrap(cmd.Run(), "bpftool failed to repin map")
+}
+
+// findMapByName looks up a loaded map by name, see findMapToRepin.
+func (c *MapContext) findMapByName(name string, mp *MapParameters) (*bpftoolMapMeta, error) {
+	cmd, cancel := c.command("bpftool", "map", "list", "-j")
+	defer cancel()
 	out, err := cmd.Output()
 	if err != nil {
-		return errors.Wrap(err, "bpftool map list failed")
+		return nil, errors.Wrap(err, "bpftool map list failed")
 	}
 	logrus.WithField("maps", string(out)).Debug("Got map metadata.")
 
 	var maps []bpftoolMapMeta
 	err = json.Unmarshal(out, &maps)
 	if err != nil {
-		return errors.Wrap(err, "bpftool returned bad JSON")
+		return nil, errors.Wrap(err, "bpftool returned bad JSON")
 	}
 
-	for _, m := range maps {
-		if m.Name == name {
-			// Found the map, try to repin it.
-			cmd := exec.Command("bpftool", "map", "pin", "id", fmt.Sprint(m.ID), filename)
-			return errors.Wrap(cmd.Run(), "bpftool failed to repin map")
+	return findMapToRepin(maps, name, mp)
+}
+
+// truncateMapName truncates name in the same way as the kernel does when it stores a map's name.
+func truncateMapName(name string) string {
+	if len(name) > unix.BPF_OBJ_NAME_LEN-1 {
+		return name[:unix.BPF_OBJ_NAME_LEN-1]
+	}
+	return name
+}
+
+// findMapToRepin finds the map with the given name.  The kernel truncates map names to
+// BPF_OBJ_NAME_LEN-1 characters so we compare against the truncated name.  Since truncation
+// can make names collide, candidates that don't match mp's type and sizes are discarded; if
+// more than one candidate remains, we refuse to guess.
+func findMapToRepin(maps []bpftoolMapMeta, name string, mp *MapParameters) (*bpftoolMapMeta, error) {
+	name = truncateMapName(name)
+
+	var candidates []*bpftoolMapMeta
+	for i := range maps {
+		m := &maps[i]
+		if m.Name != name {
+			continue
+		}
+		if mp != nil && (m.Type != mp.Type || m.KeySize != mp.KeySize || m.ValueSize != mp.ValueSize) {
+			logrus.WithField("map", *m).Debug("Map has matching name but different parameters")
+			continue
 		}
+		candidates = append(candidates, m)
 	}
 
-	return os.ErrNotExist
+	switch len(candidates) {
+	case 0:
+		return nil, os.ErrNotExist
+	case 1:
+		return candidates[0], nil
+	default:
+		return nil, errors.Errorf("found %d maps named %q, not repinning", len(candidates), name)
+	}
 }
@@ -0,0 +1,919 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func TestBPFToolDeleteErrorParsing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stdout   string
+		stderr   string
+		notFound bool
+	}{
+		{
+			name:     "v5.3 plain",
+			stderr:   "Error: delete failed: No such file or directory\n",
+			notFound: true,
+		},
+		{
+			name:     "v5.4 json",
+			stdout:   `{"error":"delete failed: No such file or directory"}`,
+			notFound: true,
+		},
+		{
+			name:     "v5.8 pretty json",
+			stdout:   "{\n    \"error\": \"delete failed: No such file or directory\"\n}\n",
+			notFound: true,
+		},
+		{
+			name:   "permission denied",
+			stdout: `{"error":"bpf obj get (/sys/fs/bpf/tc/globals): Operation not permitted"}`,
+		},
+		{
+			name:   "missing pin",
+			stderr: "Error: bpf obj get (/sys/fs/bpf/tc/globals/cali_v4_nat_fe): No such file or directory",
+			// Without an FD we can't tell this apart from a missing key.
+			notFound: true,
+		},
+		{
+			name:   "invalid key",
+			stdout: `{"error":"delete failed: Invalid argument"}`,
+		},
+		{
+			name:   "empty output",
+			stderr: "",
+		},
+	} {
+		msg := bpftoolErrorMessage([]byte(tc.stdout), []byte(tc.stderr))
+		if nf := isBPFToolNotFound(msg); nf != tc.notFound {
+			t.Errorf("%s: expected notFound=%v for %q, got %v", tc.name, tc.notFound, msg, nf)
+		}
+	}
+}
+
+func TestNewPinnedMapNameTooLong(t *testing.T) {
+	params := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_much_too_long",
+	}
+	mc := &MapContext{}
+
+	if _, err := mc.NewPinnedMapE(params); err == nil {
+		t.Error("expected NewPinnedMapE to reject a too-long name")
+	}
+
+	m := mc.NewPinnedMap(params)
+	if err := m.EnsureExists(); err == nil {
+		t.Error("expected EnsureExists to return the configuration error")
+	}
+
+	params.Name = "cali_ok"
+	if _, err := mc.NewPinnedMapE(params); err != nil {
+		t.Errorf("unexpected error for a valid name: %v", err)
+	}
+}
+
+func TestProgramsUsingMap(t *testing.T) {
+	progs := []progInfo{
+		{Id: 10, MapIds: []int{1, 2}},
+		{Id: 11, MapIds: []int{3}},
+		{Id: 12, MapIds: []int{2}},
+		{Id: 13},
+	}
+	ids := programsUsingMap(progs, 2)
+	if len(ids) != 2 || ids[0] != 10 || ids[1] != 12 {
+		t.Errorf("unexpected program IDs %v", ids)
+	}
+	if ids := programsUsingMap(progs, 4); len(ids) != 0 {
+		t.Errorf("expected no programs, got %v", ids)
+	}
+}
+
+func TestTruncateMapName(t *testing.T) {
+	if name := truncateMapName("cali_v4_nat_fe"); name != "cali_v4_nat_fe" {
+		t.Errorf("Short name was changed to %q", name)
+	}
+	if name := truncateMapName("cali_test_longname"); name != "cali_test_longn" {
+		t.Errorf("Long name was truncated to %q", name)
+	}
+}
+
+func TestFindMapToRepin(t *testing.T) {
+	maps := []bpftoolMapMeta{
+		{ID: 1, Name: "cali_v4_nat_fe", Type: "hash", KeySize: 12, ValueSize: 16},
+		{ID: 2, Name: "cali_test_longn", Type: "hash", KeySize: 4, ValueSize: 8},
+		{ID: 3, Name: "cali_dup", Type: "hash", KeySize: 4, ValueSize: 4},
+		{ID: 4, Name: "cali_dup", Type: "array", KeySize: 4, ValueSize: 4},
+	}
+
+	// The kernel stores the name truncated to 15 characters.
+	m, err := findMapToRepin(maps, "cali_test_longname", nil)
+	if err != nil || m.ID != 2 {
+		t.Errorf("expected to find map 2 by truncated name, got %v, %v", m, err)
+	}
+
+	m, err = findMapToRepin(maps, "cali_v4_nat_fe", nil)
+	if err != nil || m.ID != 1 {
+		t.Errorf("expected to find map 1, got %v, %v", m, err)
+	}
+
+	if _, err = findMapToRepin(maps, "cali_missing", nil); err != os.ErrNotExist {
+		t.Errorf("expected os.ErrNotExist for missing map, got %v", err)
+	}
+
+	if _, err = findMapToRepin(maps, "cali_dup", nil); err == nil {
+		t.Error("expected an error for an ambiguous name")
+	}
+	m, err = findMapToRepin(maps, "cali_dup", &MapParameters{Type: "array", KeySize: 4, ValueSize: 4})
+	if err != nil || m.ID != 4 {
+		t.Errorf("expected parameters to disambiguate to map 4, got %v, %v", m, err)
+	}
+}
+
+func TestMapCreatedAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "cali_pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	pinTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(f.Name(), pinTime, pinTime); err != nil {
+		t.Fatal(err)
+	}
+
+	m := (&MapContext{}).NewPinnedMap(MapParameters{
+		Filename:   f.Name(),
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	}).(*PinnedMap)
+	created, err := m.CreatedAt()
+	if err != nil {
+		t.Fatalf("CreatedAt failed: %v", err)
+	}
+	if !created.Equal(pinTime) {
+		t.Errorf("CreatedAt() = %v, expected %v", created, pinTime)
+	}
+
+	os.Remove(f.Name())
+	if _, err := m.CreatedAt(); err != ErrMapNotFound {
+		t.Errorf("expected ErrMapNotFound for missing pin, got %v", err)
+	}
+}
+
+func TestCheckMapFull(t *testing.T) {
+	var fullMaps []string
+	ctx := &MapContext{OnMapFull: func(name string) { fullMaps = append(fullMaps, name) }}
+	m := ctx.newPinnedMap(MapParameters{Name: "cali_test", Version: 2})
+
+	for _, errno := range []error{unix.E2BIG, unix.ENOSPC} {
+		err := m.checkMapFull(errno)
+		if errors.Cause(err) != ErrMapFull {
+			t.Errorf("%v: expected ErrMapFull, got %v", errno, err)
+		}
+	}
+	if err := m.checkMapFull(unix.EPERM); err != unix.EPERM {
+		t.Errorf("Expected EPERM to be returned unchanged, got %v", err)
+	}
+	if err := m.checkMapFull(nil); err != nil {
+		t.Errorf("Expected nil to be returned unchanged, got %v", err)
+	}
+	if len(fullMaps) != 2 || fullMaps[0] != "cali_test2" {
+		t.Errorf("Unexpected OnMapFull calls: %v", fullMaps)
+	}
+}
+
+func TestSupportsDelete(t *testing.T) {
+	for typ, expected := range map[string]bool{
+		"hash":          true,
+		"lru_hash":      true,
+		"lpm_trie":      true,
+		"prog_array":    true,
+		"array_of_maps": true,
+		"array":         false,
+		"percpu_array":  false,
+		"queue":         false,
+	} {
+		m := (&MapContext{}).newPinnedMap(MapParameters{Name: "cali_test", Type: typ})
+		if m.SupportsDelete() != expected {
+			t.Errorf("SupportsDelete() for %s map = %v, expected %v", typ, !expected, expected)
+		}
+	}
+}
+
+func TestRemoveLeftoverTempPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := dir + "/cali_test"
+	if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tempPinFilename(filename), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	removeLeftoverTempPin(filename)
+	if _, err := os.Stat(tempPinFilename(filename)); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary pin to be removed, stat returned %v", err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("Expected real pin to be left alone, stat returned %v", err)
+	}
+
+	// No-op if there's nothing to clean up.
+	removeLeftoverTempPin(filename)
+}
+
+func TestOpTimeoutKillsHungBPFTool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/bpftool", []byte("#!/bin/sh\nexec sleep 60\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	c := &MapContext{OpTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err = c.findMapByName("cali_test", nil)
+	if err == nil {
+		t.Error("Expected an error from the hung bpftool")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 10*time.Second {
+		t.Errorf("bpftool wasn't killed after the timeout, took %v", d)
+	}
+}
+
+func TestReadOnlyBPFFSErr(t *testing.T) {
+	for _, err := range []error{
+		unix.EROFS,
+		&os.PathError{Op: "mkdir", Path: "/sys/fs/bpf/tc", Err: unix.EROFS},
+		errors.WithMessage(unix.EROFS, "failed to pin map"),
+	} {
+		if errors.Cause(readOnlyBPFFSErr(err)) != ErrBPFFSReadOnly {
+			t.Errorf("Expected %v to be converted to ErrBPFFSReadOnly", err)
+		}
+	}
+	other := &os.PathError{Op: "mkdir", Path: "/sys/fs/bpf/tc", Err: unix.EPERM}
+	if readOnlyBPFFSErr(other) != other {
+		t.Error("Expected other errors to be returned unchanged")
+	}
+}
+
+func TestOpenOnlyMissingPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := (&MapContext{OpenOnly: true}).newPinnedMap(MapParameters{
+		Filename: dir + "/cali_test",
+		Name:     "cali_test",
+	})
+	if err := m.EnsureExists(); errors.Cause(err) != ErrMapNotFound {
+		t.Errorf("Expected ErrMapNotFound, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected nothing to be created, found %v", files)
+	}
+}
+
+func TestMapContextPrefixes(t *testing.T) {
+	params := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_v4_nat",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_v4_nat",
+		Version:    2,
+	}
+	a, err := (&MapContext{NamePrefix: "a", FilePrefix: "a_"}).NewPinnedMapE(params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b, err := (&MapContext{NamePrefix: "b", FilePrefix: "b_"}).NewPinnedMapE(params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if a.GetName() != "acali_v4_nat2" || b.GetName() != "bcali_v4_nat2" {
+		t.Errorf("Unexpected names %q and %q", a.GetName(), b.GetName())
+	}
+	if a.Path() != "/sys/fs/bpf/tc/globals/a_cali_v4_nat2" ||
+		b.Path() != "/sys/fs/bpf/tc/globals/b_cali_v4_nat2" {
+		t.Errorf("Unexpected paths %q and %q", a.Path(), b.Path())
+	}
+
+	_, err = (&MapContext{NamePrefix: "instance1_"}).NewPinnedMapE(params)
+	if err == nil {
+		t.Error("Expected an error when the prefix makes the name too long")
+	}
+}
+
+func TestZeroValueSizeRejected(t *testing.T) {
+	_, err := (&MapContext{}).NewPinnedMapE(MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  0,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	})
+	if err == nil || !strings.Contains(err.Error(), "1-byte value") {
+		t.Errorf("Expected an error suggesting a 1-byte value, got %v", err)
+	}
+	if errors.Cause(err) != ErrZeroValueSize {
+		t.Errorf("Expected ErrZeroValueSize, got %v", err)
+	}
+}
+
+func TestKeylessMapTypesValidate(t *testing.T) {
+	for _, typ := range []string{"queue", "stack", "bloom_filter"} {
+		params := MapParameters{Type: typ, KeySize: 0, ValueSize: 4, MaxEntries: 16, Name: "cali_test"}
+		if err := params.validate(); err != nil {
+			t.Errorf("Expected %s map with key size 0 to be valid, got %v", typ, err)
+		}
+		params.KeySize = 4
+		if err := params.validate(); err == nil {
+			t.Errorf("Expected an error for a %s map with a key", typ)
+		}
+	}
+	params := MapParameters{Type: "hash", KeySize: 0, ValueSize: 4, MaxEntries: 16, Name: "cali_test"}
+	if err := params.validate(); err == nil {
+		t.Error("Expected an error for a hash map with key size 0")
+	}
+}
+
+func TestRepinFilterRejectsPerCPU(t *testing.T) {
+	params := MapParameters{Type: "percpu_hash", KeySize: 4, ValueSize: 4, MaxEntries: 16, Name: "cali_test",
+		RepinFilter: func(k, v []byte) bool { return true }}
+	if err := params.validate(); err == nil {
+		t.Error("Expected an error for a per-CPU map with a RepinFilter")
+	}
+	params.Type = "hash"
+	if err := params.validate(); err != nil {
+		t.Errorf("Expected a hash map with a RepinFilter to be valid, got %v", err)
+	}
+}
+
+func TestEnsureMapsBestEffort(t *testing.T) {
+	valid := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+		// Lazy creation means EnsureExists() doesn't need the kernel.
+		LazyCreate: true,
+	}
+	tooLong := valid
+	tooLong.Name = "cali_much_too_long"
+	tooLong.Filename = "/sys/fs/bpf/tc/globals/cali_much_too_long"
+	badType := valid
+	badType.Name = "cali_test_bad"
+	badType.Filename = "/sys/fs/bpf/tc/globals/cali_test_bad"
+	badType.Type = "not_a_type"
+	other := valid
+	other.Name = "cali_test_2"
+	other.Filename = "/sys/fs/bpf/tc/globals/cali_test_2"
+
+	maps, err := EnsureMaps(&MapContext{}, []MapParameters{valid, tooLong, badType, other})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, name := range []string{"cali_much_too_long", "cali_test_bad"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected error to mention %s: %v", name, err)
+		}
+	}
+	if len(maps) != 2 || maps["cali_test"] == nil || maps["cali_test_2"] == nil {
+		t.Errorf("Expected handles for the valid maps, got %v", maps)
+	}
+
+	maps, err = EnsureMaps(&MapContext{}, []MapParameters{valid})
+	if err != nil || len(maps) != 1 {
+		t.Errorf("Expected success, got %v, %v", maps, err)
+	}
+}
+
+func TestEnsureMapsDuplicates(t *testing.T) {
+	a := MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_a",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_a",
+		LazyCreate: true,
+	}
+	samePath := a
+	samePath.Name = "cali_test_b"
+	sameName := a
+	sameName.Filename = "/sys/fs/bpf/tc/globals/cali_test_c"
+	differentVersion := a
+	differentVersion.Version = 2
+
+	maps, err := EnsureMaps(&MapContext{}, []MapParameters{a, differentVersion, samePath})
+	if err == nil || maps != nil {
+		t.Fatalf("Expected an error and no maps, got %v, %v", maps, err)
+	}
+	if !strings.Contains(err.Error(), "#0 (cali_test_a), #2 (cali_test_b) share pin path /sys/fs/bpf/tc/globals/cali_test_a") {
+		t.Errorf("Expected error to name the maps sharing a path: %v", err)
+	}
+
+	_, err = EnsureMaps(&MapContext{}, []MapParameters{a, sameName})
+	if err == nil || !strings.Contains(err.Error(), "share name cali_test_a") {
+		t.Errorf("Expected error to name the maps sharing a name: %v", err)
+	}
+
+	// The result is keyed on Name, so different versions of the same map would overwrite (and
+	// leak) each other's handles.
+	maps, err = EnsureMaps(&MapContext{}, []MapParameters{a, differentVersion})
+	if err == nil || maps != nil ||
+		!strings.Contains(err.Error(), "#0 (cali_test_a), #1 (cali_test_a) share Name cali_test_a with different versions") {
+		t.Errorf("Expected maps with the same Name and different versions to conflict, got %v, %v", maps, err)
+	}
+	if err != nil && strings.Contains(err.Error(), "share name") {
+		t.Errorf("Expected versioned names not to conflict: %v", err)
+	}
+
+	renamed := differentVersion
+	renamed.Name = "cali_test_d"
+	renamed.Filename = "/sys/fs/bpf/tc/globals/cali_test_d"
+	maps, err = EnsureMaps(&MapContext{}, []MapParameters{a, renamed})
+	if err != nil || len(maps) != 2 {
+		t.Errorf("Expected distinct maps not to conflict, got %v, %v", maps, err)
+	}
+}
+
+func TestBackendSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := dir + "/bpftool.log"
+	err = ioutil.WriteFile(dir+"/bpftool",
+		[]byte("#!/bin/sh\necho \"$@\" >> "+logFile+"\necho '[]'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	for _, tc := range []struct {
+		backend    Backend
+		expectTool bool
+		expectErr  bool
+	}{
+		// The map's FD isn't valid so the native path always fails.
+		{BackendAuto, true, false},
+		{BackendNative, false, true},
+		{BackendBPFTool, true, false},
+	} {
+		_ = os.Remove(logFile)
+		m := (&MapContext{Backend: tc.backend}).newPinnedMap(MapParameters{
+			Filename:   dir + "/cali_test",
+			Type:       "hash",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+			Name:       "cali_test",
+		})
+		m.fdLoaded = true
+		m.fd = MapFD(1 << 20)
+
+		errDel := m.Delete([]byte{1, 2, 3, 4})
+		errIter := m.Iter(func(k, v []byte) {})
+		for op, err := range map[string]error{"Delete": errDel, "Iter": errIter} {
+			if tc.expectErr != (err != nil) {
+				t.Errorf("%v: unexpected result from %s: %v", tc.backend, op, err)
+			}
+		}
+
+		log, _ := ioutil.ReadFile(logFile)
+		for _, cmd := range []string{"map delete", "map dump"} {
+			if strings.Contains(string(log), cmd) != tc.expectTool {
+				t.Errorf("%v: unexpected bpftool usage for %q, log: %q", tc.backend, cmd, log)
+			}
+		}
+	}
+}
+
+func TestUnpinChecksUnopenedPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Not a BPF pin, so it can't be opened to check for programs that use it.
+	path := dir + "/cali_test"
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := (&MapContext{}).newPinnedMap(MapParameters{
+		Filename:   path,
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	})
+	if err := m.Unpin(false); err == nil {
+		t.Error("Expected Unpin to refuse when it can't check the pin for programs")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the pin to be kept: %v", err)
+	}
+	if err := m.Unpin(true); err != nil {
+		t.Errorf("Expected forced Unpin to succeed, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the pin to be removed: %v", err)
+	}
+}
+
+func TestBPFToolBackendClassifiesFailedDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/bpftool",
+		[]byte("#!/bin/sh\necho 'Error: delete failed: No such file or directory' >&2\nexit 255\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	m := (&MapContext{Backend: BackendBPFTool}).newPinnedMap(MapParameters{
+		Filename:   dir + "/cali_test",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	})
+	// Not a valid FD, so a native lookup would fail with EBADF rather than ENOENT.
+	m.fdLoaded = true
+	m.fd = MapFD(1 << 20)
+	if err := m.Delete([]byte{1, 2, 3, 4}); err != ErrKeyNotExist {
+		t.Errorf("Expected bpftool's error to be classified as not found, got %v", err)
+	}
+}
+
+func TestBPFToolBackendDoesNotCrossOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := dir + "/bpftool.log"
+	err = ioutil.WriteFile(dir+"/bpftool",
+		[]byte("#!/bin/sh\necho \"$@\" >> "+logFile+"\necho '[]'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	m := (&MapContext{Backend: BackendBPFTool}).newPinnedMap(MapParameters{
+		Filename:   dir + "/cali_test",
+		Type:       "lru_hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test",
+	})
+	// Not a valid FD, so any native syscall would fail.
+	m.fdLoaded = true
+	m.fd = MapFD(1 << 20)
+	k := []byte{1, 2, 3, 4}
+
+	// Operations with a bpftool equivalent use it.
+	if keys, err := m.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("Keys() = %v, %v; expected no keys from bpftool", keys, err)
+	}
+	if err := <-m.DeleteAsync([][]byte{k}); err != nil {
+		t.Errorf("DeleteAsync failed: %v", err)
+	}
+	log, _ := ioutil.ReadFile(logFile)
+	for _, cmd := range []string{"map dump", "map delete"} {
+		if !strings.Contains(string(log), cmd) {
+			t.Errorf("Expected bpftool %q to be run, log: %q", cmd, log)
+		}
+	}
+
+	// The others refuse, rather than making syscalls behind the backend's back.
+	_, _, errGetBatch := m.GetBatch([][]byte{k})
+	_, errGetOrCreate := m.GetOrCreate(k, []byte{0, 0, 0, 0})
+	_, _, errIterPage := m.IterPage(nil, 10)
+	for op, err := range map[string]error{
+		"Touch":       m.Touch(k),
+		"GetBatch":    errGetBatch,
+		"GetOrCreate": errGetOrCreate,
+		"IterPage":    errIterPage,
+		"IterLimit":   m.IterLimit(10, func(k, v []byte) {}),
+		"IterBatch":   m.IterBatch(func(k, v []byte) {}),
+		"Compact":     m.Compact(),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "backend is bpftool") {
+			t.Errorf("Expected %s to refuse to use native syscalls, got %v", op, err)
+		}
+	}
+}
+
+func TestIterMapCmdOutputTruncated(t *testing.T) {
+	const dump = `[{
+        "key": ["0x01","0x00","0x00","0x00"],
+        "value": ["0x0a","0x00","0x00","0x00"]
+    },{
+        "key": ["0x02","0x00","0x00","0x00"],
+        "value": ["0x0b","0x00","0x00","0x00"]
+    }
+]`
+	var keys []byte
+	err := IterMapCmdOutput([]byte(dump), func(k, v []byte) {
+		keys = append(keys, k[0])
+	})
+	if err != nil || string(keys) != "\x01\x02" {
+		t.Fatalf("Failed to parse complete dump: %v, keys %v", err, keys)
+	}
+
+	// Cut off part way through the second entry.
+	keys = nil
+	truncated := dump[:strings.Index(dump, `"0x0b"`)]
+	err = IterMapCmdOutput([]byte(truncated), func(k, v []byte) {
+		keys = append(keys, k[0])
+	})
+	if errors.Cause(err) != ErrDumpTruncated {
+		t.Errorf("Expected ErrDumpTruncated, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "after 1 entries") {
+		t.Errorf("Expected the error to say how many entries were parsed, got %v", err)
+	}
+	if string(keys) != "\x01" {
+		t.Errorf("Expected the complete entry to be delivered, got keys %v", keys)
+	}
+
+	// Missing only the closing bracket.
+	keys = nil
+	err = IterMapCmdOutput([]byte(strings.TrimSuffix(dump, "]")), func(k, v []byte) {
+		keys = append(keys, k[0])
+	})
+	if errors.Cause(err) != ErrDumpTruncated || len(keys) != 2 {
+		t.Errorf("Expected ErrDumpTruncated after 2 entries, got %v, keys %v", err, keys)
+	}
+
+	// Malformed, rather than truncated, output is a different error.
+	err = IterMapCmdOutput([]byte(`[{"key": ["0x01"]}}`), func(k, v []byte) {})
+	if err == nil || errors.Cause(err) == ErrDumpTruncated {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestMapTypeSupported(t *testing.T) {
+	defer func(orig func(MapParameters) (MapFD, error)) {
+		createProbeMap = orig
+		mapTypeSupportCache = map[string]bool{}
+	}(createProbeMap)
+
+	calls := 0
+	var createErr error
+	createProbeMap = func(params MapParameters) (MapFD, error) {
+		calls++
+		if createErr != nil {
+			return 0, createErr
+		}
+		fd, err := unix.Open("/dev/null", unix.O_RDONLY, 0)
+		return MapFD(fd), err
+	}
+
+	for _, tc := range []struct {
+		createErr error
+		supported bool
+		expectErr bool
+		cached    bool
+	}{
+		{nil, true, false, true},
+		{unix.EINVAL, false, false, true},
+		{unix.EPERM, false, true, false},
+	} {
+		mapTypeSupportCache = map[string]bool{}
+		createErr = tc.createErr
+		calls = 0
+		for i := 0; i < 2; i++ {
+			supported, err := MapTypeSupported("ringbuf")
+			if supported != tc.supported || (err != nil) != tc.expectErr {
+				t.Errorf("create error %v: got %v, %v", tc.createErr, supported, err)
+			}
+		}
+		if expectedCalls := map[bool]int{true: 1, false: 2}[tc.cached]; calls != expectedCalls {
+			t.Errorf("create error %v: expected %d probes, got %d", tc.createErr, expectedCalls, calls)
+		}
+	}
+
+	if _, err := MapTypeSupported("sk_storage"); err == nil {
+		t.Error("Expected an error for a type that can't be probed")
+	}
+	if _, err := MapTypeSupported("not_a_type"); err == nil {
+		t.Error("Expected an error for an unknown type")
+	}
+}
+
+func TestMaxEntriesLimit(t *testing.T) {
+	defer func(orig func(MapParameters) (MapFD, error), origBudget func() (uint64, error)) {
+		createProbeMap = orig
+		probeMemoryBudget = origBudget
+		maxEntriesLimitCache = map[maxEntriesKey]int{}
+	}(createProbeMap, probeMemoryBudget)
+
+	calls := 0
+	limit := 0
+	maxTried := 0
+	var budget uint64 = 1 << 40
+	probeMemoryBudget = func() (uint64, error) {
+		return budget, nil
+	}
+	createProbeMap = func(params MapParameters) (MapFD, error) {
+		calls++
+		if params.MaxEntries > maxTried {
+			maxTried = params.MaxEntries
+		}
+		if params.Type == "hash" && params.Flags&unix.BPF_F_NO_PREALLOC == 0 {
+			t.Errorf("Expected hash map to be probed without preallocation")
+		}
+		if params.MaxEntries*(params.KeySize+params.ValueSize) > limit {
+			return 0, unix.ENOMEM
+		}
+		fd, err := unix.Open("/dev/null", unix.O_RDONLY, 0)
+		return MapFD(fd), err
+	}
+
+	for _, tc := range []struct {
+		limit, expected int
+	}{
+		{1000 * 16, 1000},
+		{12345 * 16, 12345},
+		{16, 1},
+		{1 << 30, maxEntriesProbeLimit},
+	} {
+		maxEntriesLimitCache = map[maxEntriesKey]int{}
+		limit = tc.limit
+		n, err := MaxEntriesLimit("hash", 8, 8)
+		if err != nil || n != tc.expected {
+			t.Errorf("limit %d: expected %d, got %d, %v", tc.limit, tc.expected, n, err)
+		}
+	}
+
+	// Results are cached.
+	calls = 0
+	if n, err := MaxEntriesLimit("hash", 8, 8); err != nil || n != maxEntriesProbeLimit || calls != 0 {
+		t.Errorf("Expected cached result, got %d, %v after %d calls", n, err, calls)
+	}
+
+	// The probe never tries a size that doesn't fit in the memory budget.
+	maxEntriesLimitCache = map[maxEntriesKey]int{}
+	limit = 1 << 30
+	maxTried = 0
+	budget = 1000 * (8 + 8 + probeEntryOverhead)
+	if n, err := MaxEntriesLimit("hash", 8, 8); err != nil || n != 1000 || maxTried != 1000 {
+		t.Errorf("Expected probe bounded to 1000 entries, got %d, %v; tried up to %d", n, err, maxTried)
+	}
+	budget = 1 << 40
+
+	// If even the smallest map can't be created, that's an error, not a limit.
+	limit = 0
+	if _, err := MaxEntriesLimit("array", 4, 4); err == nil {
+		t.Error("Expected an error when no map can be created")
+	}
+	if _, err := MaxEntriesLimit("ringbuf", 0, 0); err == nil {
+		t.Error("Expected an error for a map type without a max entries limit")
+	}
+}
+
+func TestCreateErrorIncludesParameters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/bpftool",
+		[]byte("#!/bin/sh\necho 'Error: map create failed: Operation not permitted' >&2\nexit 255\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	params := MapParameters{
+		Filename:   dir + "/cali_test",
+		Type:       "lru_hash",
+		KeySize:    16,
+		ValueSize:  48,
+		MaxEntries: 512000,
+		Name:       "cali_test",
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	}
+	err = (&MapContext{}).bpftoolCreateMap(params.Filename, &params)
+	createErr, ok := err.(*CreateError)
+	if !ok {
+		t.Fatalf("Expected a CreateError, got %T: %v", err, err)
+	}
+	if _, ok := errors.Cause(err).(*exec.ExitError); !ok {
+		t.Errorf("Expected the cause to be the bpftool exit error, got %v", errors.Cause(err))
+	}
+	for _, s := range []string{
+		"cali_test", "lru_hash", "key size 16", "value size 48", "max entries 512000", "flags 0x1",
+		"Operation not permitted",
+	} {
+		if !strings.Contains(createErr.Error(), s) {
+			t.Errorf("Expected error to contain %q: %v", s, createErr)
+		}
+	}
+}
+
+func TestWarmAllCollectsErrors(t *testing.T) {
+	mc := &MapContext{}
+	for _, name := range []string{"cali_bad1", "cali_bad2"} {
+		mc.NewPinnedMap(MapParameters{
+			Filename: "/sys/fs/bpf/tc/globals/" + name,
+			Type:     "not_a_type",
+			Name:     name,
+		})
+	}
+	err := mc.WarmAll()
+	if err == nil {
+		t.Fatal("Expected WarmAll to fail")
+	}
+	for _, name := range []string{"cali_bad1", "cali_bad2"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected error to mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestMapContextForgetsClosedMaps(t *testing.T) {
+	c := &MapContext{}
+	params := MapParameters{Filename: "/sys/fs/bpf/tc/globals/cali_test_set", Type: "hash",
+		KeySize: 4, ValueSize: 4, MaxEntries: 16, Name: "cali_test_set"}
+	a := c.newPinnedMap(params)
+	b := c.newPinnedMap(params)
+	if n := len(c.mapList()); n != 2 {
+		t.Fatalf("expected 2 maps in the context, got %d", n)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if maps := c.mapList(); len(maps) != 1 || maps[0] != b {
+		t.Errorf("expected only the open map to remain, got %v", maps)
+	}
+	if err := c.CloseAll(); err != nil {
+		t.Fatalf("CloseAll failed: %v", err)
+	}
+	if n := len(c.mapList()); n != 0 {
+		t.Errorf("expected no maps after CloseAll, got %d", n)
+	}
+}
@@ -15,6 +15,10 @@
 package mock
 
 import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 
@@ -26,8 +30,17 @@ type Map struct {
 	logCxt *logrus.Entry
 
 	Contents map[string]string
+	// DeleteUnsupported makes the map behave like an array map: SupportsDelete returns false and
+	// Delete fails.
+	DeleteUnsupported bool
+
+	// id is a synthetic map ID, unique to each map created by NewMockMap.  Copies of the Map
+	// share their ID (and their Contents), like two handles on the same kernel map.
+	id int
 }
 
+var lastMockMapID int64
+
 func (m Map) MapFD() bpf.MapFD {
 	panic("implement me")
 }
@@ -52,6 +65,114 @@ func (m Map) Iter(f bpf.MapIter) error {
 	return nil
 }
 
+// IterPage mimics PinnedMap.IterPage, returning entries in key order.
+func (m Map) IterPage(token []byte, limit int) (entries []bpf.Entry, nextToken []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.Errorf("invalid page size %d", limit)
+	}
+	keys := make([]string, 0, len(m.Contents))
+	for k := range m.Contents {
+		if token == nil || k > string(token) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(entries) == limit {
+			return entries, entries[len(entries)-1].Key, nil
+		}
+		entries = append(entries, bpf.Entry{Key: []byte(k), Value: []byte(m.Contents[k])})
+	}
+	return entries, nil, nil
+}
+
+// IterLimit mimics PinnedMap.IterLimit.
+func (m Map) IterLimit(maxEntries int, f bpf.MapIter) error {
+	entries, next, err := m.IterPage(nil, maxEntries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		f(e.Key, e.Value)
+	}
+	if next != nil {
+		return &bpf.IterLimitError{LastKey: next}
+	}
+	return nil
+}
+
+// VerifyAgainst mimics PinnedMap.VerifyAgainst.
+func (m Map) VerifyAgainst(expected map[string][]byte) ([]bpf.Entry, error) {
+	var mismatches []bpf.Entry
+	for k, v := range m.Contents {
+		if want, ok := expected[k]; !ok || string(want) != v {
+			mismatches = append(mismatches, bpf.Entry{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	for k := range expected {
+		if _, ok := m.Contents[k]; !ok {
+			mismatches = append(mismatches, bpf.Entry{Key: []byte(k)})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return string(mismatches[i].Key) < string(mismatches[j].Key)
+	})
+	return mismatches, nil
+}
+
+// ToGoMap mimics PinnedMap.ToGoMap.
+func (m Map) ToGoMap() (map[string][]byte, error) {
+	goMap := make(map[string][]byte, len(m.Contents))
+	for k, v := range m.Contents {
+		goMap[k] = []byte(v)
+	}
+	return goMap, nil
+}
+
+// FromGoMap mimics PinnedMap.FromGoMap.
+func (m Map) FromGoMap(goMap map[string][]byte) error {
+	for k, v := range goMap {
+		if err := m.Update([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExistsBatch mimics PinnedMap.ExistsBatch.
+func (m Map) ExistsBatch(keys [][]byte) ([]bool, error) {
+	for i, k := range keys {
+		if len(k) != m.KeySize {
+			return nil, errors.Errorf("key %d has wrong size (%d), expected %d", i, len(k), m.KeySize)
+		}
+	}
+	exists := make([]bool, len(keys))
+	for i, k := range keys {
+		_, exists[i] = m.Contents[string(k)]
+	}
+	return exists, nil
+}
+
+// GetBatch mimics PinnedMap.GetBatch.
+func (m Map) GetBatch(keys [][]byte) (values [][]byte, missing []bool, err error) {
+	for i, k := range keys {
+		if len(k) != m.KeySize {
+			return nil, nil, errors.Errorf("key %d has wrong size (%d), expected %d", i, len(k), m.KeySize)
+		}
+	}
+	values = make([][]byte, len(keys))
+	missing = make([]bool, len(keys))
+	for i, k := range keys {
+		v, ok := m.Contents[string(k)]
+		if !ok {
+			missing[i] = true
+			continue
+		}
+		values[i] = []byte(v)
+	}
+	return values, missing, nil
+}
+
 func (m Map) Update(k, v []byte) error {
 	if len(k) != m.KeySize {
 		m.logCxt.Panicf("Key had wrong size (%d)", len(k))
@@ -63,6 +184,19 @@ func (m Map) Update(k, v []byte) error {
 	return nil
 }
 
+// UpdateBatch writes the entries one at a time, in order.
+func (m Map) UpdateBatch(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.Errorf("got %d keys but %d values", len(keys), len(values))
+	}
+	for i := range keys {
+		if err := m.Update(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m Map) Get(k []byte) ([]byte, error) {
 	vstr, ok := m.Contents[string(k)]
 	if !ok {
@@ -75,10 +209,42 @@ func (m Map) Delete(k []byte) error {
 	if len(k) != m.KeySize {
 		m.logCxt.Panicf("Key had wrong size (%d)", len(k))
 	}
+	if m.DeleteUnsupported {
+		return unix.EINVAL
+	}
 	delete(m.Contents, string(k))
 	return nil
 }
 
+func (m Map) SupportsDelete() bool {
+	return !m.DeleteUnsupported
+}
+
+func (m Map) AssertType(expected string) error {
+	if m.Type != expected {
+		return errors.Errorf("map %s is of type %s, expected %s", m.Name, m.Type, expected)
+	}
+	return nil
+}
+
+// ID mimics PinnedMap.ID, returning the map's synthetic ID.
+func (m Map) ID() (int, error) {
+	return m.id, nil
+}
+
+// SameAs mimics PinnedMap.SameAs by comparing synthetic IDs.
+func (m Map) SameAs(other bpf.Map) (bool, error) {
+	o, ok := other.(interface{ ID() (int, error) })
+	if !ok {
+		return false, errors.Errorf("can't get the ID of map %s (%T)", other.GetName(), other)
+	}
+	otherID, err := o.ID()
+	if err != nil {
+		return false, err
+	}
+	return m.id == otherID, nil
+}
+
 func NewMockMap(params bpf.MapParameters) *Map {
 	if params.KeySize <= 0 {
 		logrus.WithField("params", params).Panic("KeySize should be >0")
@@ -95,6 +261,7 @@ func NewMockMap(params bpf.MapParameters) *Map {
 			"valueSize": params.ValueSize,
 		}),
 		Contents: map[string]string{},
+		id:       int(atomic.AddInt64(&lastMockMapID, 1)),
 	}
 	return m
 }
@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// OpenInNamespace opens the map pinned at filename in the mount namespace at nsPath (for
+// example, /proc/<pid>/ns/mnt for a container's process), so that node-level tooling can inspect
+// maps that are pinned in a container's own BPF filesystem.  The returned FD can be used from any
+// namespace.  The caller needs CAP_SYS_ADMIN and CAP_SYS_CHROOT.
+//
+// Namespaces are per-thread, so the work is done on a new goroutine that is locked to its OS
+// thread with runtime.LockOSThread; the calling goroutine's thread is never moved.  Joining a mount
+// namespace also requires the thread to stop sharing its filesystem attributes (root and working
+// directory) with the rest of the process, which can't be undone, so that goroutine exits without
+// unlocking its thread and the Go runtime discards the thread rather than reusing it.
+func OpenInNamespace(nsPath string, filename string) (MapFD, error) {
+	type result struct {
+		fd  MapFD
+		err error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		// Deliberately never unlocked; see above.
+		runtime.LockOSThread()
+		fd, err := openInNamespace(nsPath, filename)
+		resultC <- result{fd, err}
+	}()
+	r := <-resultC
+	return r.fd, r.err
+}
+
+// openInNamespace implements OpenInNamespace.  It must be called on a locked OS thread that won't
+// be reused.
+func openInNamespace(nsPath string, filename string) (MapFD, error) {
+	targetNS, err := os.Open(nsPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open target mount namespace")
+	}
+	defer targetNS.Close()
+	origNS, err := os.Open("/proc/thread-self/ns/mnt")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open current mount namespace")
+	}
+	defer origNS.Close()
+
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return 0, errors.Wrap(err, "failed to unshare filesystem attributes")
+	}
+	if err := unix.Setns(int(targetNS.Fd()), unix.CLONE_NEWNS); err != nil {
+		return 0, errors.Wrapf(err, "failed to enter mount namespace %s", nsPath)
+	}
+	fd, openErr := GetMapFDByPin(filename)
+	if err := unix.Setns(int(origNS.Fd()), unix.CLONE_NEWNS); err != nil {
+		// Harmless, since the thread won't be reused, but unexpected.
+		logrus.WithError(err).Warn("Failed to restore mount namespace")
+	}
+	if openErr != nil {
+		return 0, errors.Wrapf(openErr, "failed to open map %s in mount namespace %s", filename, nsPath)
+	}
+	return fd, nil
+}
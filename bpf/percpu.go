@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const possibleCPUsFile = "/sys/devices/system/cpu/possible"
+
+var (
+	numPossibleCPUsOnce sync.Once
+	numPossibleCPUs     int
+	numPossibleCPUsErr  error
+)
+
+// NumPossibleCPUs returns the number of CPUs that the kernel sizes per-CPU map values for.  This
+// is the number of possible CPUs, which may be larger than the number of online CPUs.
+func NumPossibleCPUs() (int, error) {
+	numPossibleCPUsOnce.Do(func() {
+		var data []byte
+		data, numPossibleCPUsErr = ioutil.ReadFile(possibleCPUsFile)
+		if numPossibleCPUsErr != nil {
+			return
+		}
+		numPossibleCPUs, numPossibleCPUsErr = parseCPURange(string(data))
+	})
+	return numPossibleCPUs, numPossibleCPUsErr
+}
+
+// parseCPURange parses a kernel CPU list, such as "0-3,5", and returns one more than the highest
+// CPU number in the list.
+func parseCPURange(s string) (int, error) {
+	max := -1
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		last := part
+		if idx := strings.Index(part, "-"); idx >= 0 {
+			last = part[idx+1:]
+		}
+		n, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, errors.Errorf("failed to parse CPU list %q", s)
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max + 1, nil
+}
+
+// UpdateAllCPUs sets the value of a per-CPU map entry to v on every CPU.
+func (b *PinnedMap) UpdateAllCPUs(k, v []byte) error {
+	if !b.perCPU {
+		return errors.Errorf("map %s is not a per-CPU map", b.versionedName())
+	}
+	if len(v) != b.ValueSize {
+		return errors.Errorf("value has wrong size (%d), expected %d", len(v), b.ValueSize)
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return err
+	}
+	numCPUs, err := NumPossibleCPUs()
+	if err != nil {
+		return err
+	}
+
+	return b.write("update", k, func(fd MapFD) ([]byte, error) {
+		return v, UpdatePerCPUMapEntry(fd, k, packPerCPUValue(v, numCPUs), b.ValueSize)
+	})
+}
+
+// perCPUValueStride returns the distance between the values for consecutive CPUs in the buffers
+// used to read and write per-CPU map entries.  The kernel copies each CPU's value to an 8-byte
+// aligned offset, so the stride is the value size rounded up to a multiple of 8.
+func perCPUValueStride(valueSize int) int {
+	return (valueSize + 7) &^ 7
+}
+
+// packPerCPUValue returns a buffer for writing v to a per-CPU map entry on every CPU.
+func packPerCPUValue(v []byte, numCPUs int) []byte {
+	stride := perCPUValueStride(len(v))
+	buf := make([]byte, stride*numCPUs)
+	for i := 0; i < numCPUs; i++ {
+		copy(buf[i*stride:], v)
+	}
+	return buf
+}
+
+// unpackPerCPUValue splits a buffer read from a per-CPU map entry into the value for each CPU.
+func unpackPerCPUValue(buf []byte, valueSize, numCPUs int) [][]byte {
+	stride := perCPUValueStride(valueSize)
+	values := make([][]byte, numCPUs)
+	for i := range values {
+		values[i] = buf[i*stride : i*stride+valueSize]
+	}
+	return values
+}
+
+// GetPerCPU looks up a per-CPU map entry and returns its value on each possible CPU.
+func (b *PinnedMap) GetPerCPU(k []byte) ([][]byte, error) {
+	if !b.perCPU {
+		return nil, errors.Errorf("map %s is not a per-CPU map", b.versionedName())
+	}
+	if err := b.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	numCPUs, err := NumPossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	err = b.withFD(func(fd MapFD) (err error) {
+		buf, err = GetPerCPUMapEntry(fd, k, b.ValueSize, numCPUs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unpackPerCPUValue(buf, b.ValueSize, numCPUs), nil
+}
+
+// GetUint64PerCPU looks up an entry in a per-CPU map of uint64 counters and returns the value on
+// each possible CPU, decoded in native byte order.
+func (b *PinnedMap) GetUint64PerCPU(k []byte) ([]uint64, error) {
+	if b.ValueSize != 8 {
+		return nil, errors.Errorf("map %s has value size %d, expected 8", b.versionedName(), b.ValueSize)
+	}
+	values, err := b.GetPerCPU(k)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUint64PerCPU(values), nil
+}
+
+func decodeUint64PerCPU(values [][]byte) []uint64 {
+	counts := make([]uint64, len(values))
+	for i, v := range values {
+		counts[i] = nativeEndian.Uint64(v)
+	}
+	return counts
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPURange(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected int
+	}{
+		{"0\n", 1},
+		{"0-7\n", 8},
+		{"0-3,5", 6},
+		{"0,2-3,8-11\n", 12},
+	} {
+		n, err := parseCPURange(tc.input)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tc.input, err)
+		}
+		if n != tc.expected {
+			t.Errorf("parseCPURange(%q) = %d, expected %d", tc.input, n, tc.expected)
+		}
+	}
+
+	if _, err := parseCPURange("garbage"); err == nil {
+		t.Error("expected error parsing garbage CPU list")
+	}
+}
+
+func TestDecodeUint64PerCPU(t *testing.T) {
+	values := make([][]byte, 3)
+	for i := range values {
+		values[i] = make([]byte, 8)
+		nativeEndian.PutUint64(values[i], uint64(i*1000+1))
+	}
+
+	counts := decodeUint64PerCPU(values)
+	if expected := []uint64{1, 1001, 2001}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("decodeUint64PerCPU() = %v, expected %v", counts, expected)
+	}
+}
+
+func TestPerCPUValueStride(t *testing.T) {
+	// A 4-byte value is padded to 8 bytes per CPU by the kernel.
+	buf := []byte{
+		1, 0, 0, 0, 0xee, 0xee, 0xee, 0xee,
+		2, 0, 0, 0, 0xee, 0xee, 0xee, 0xee,
+		3, 0, 0, 0, 0xee, 0xee, 0xee, 0xee,
+	}
+	values := unpackPerCPUValue(buf, 4, 3)
+	if expected := [][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}, {3, 0, 0, 0}}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("unpackPerCPUValue() = %v, expected %v", values, expected)
+	}
+
+	packed := packPerCPUValue([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, 2)
+	expected := []byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0, 0, 0, 0,
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0, 0, 0, 0,
+	}
+	if !reflect.DeepEqual(packed, expected) {
+		t.Errorf("packPerCPUValue() = %v, expected %v", packed, expected)
+	}
+
+	if s := perCPUValueStride(8); s != 8 {
+		t.Errorf("perCPUValueStride(8) = %d, expected 8", s)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	promMetricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	promLabelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	promLabelEscaper     = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// WriteProm writes the contents of the map to w as samples of a gauge in the Prometheus text
+// exposition format.  labeler derives each sample's labels from an entry's key and value
+// converts its value to a number.  For per-CPU maps, value is called for each CPU's value and
+// the results are summed.  Entries that get the same labels are summed into one sample.  The
+// samples are sorted by their labels so that the output is stable.
+func (b *PinnedMap) WriteProm(
+	w io.Writer,
+	metricName string,
+	labeler func(k []byte) map[string]string,
+	value func(v []byte) float64,
+) error {
+	iter := func(f func(k []byte, v float64)) error {
+		return b.Iter(func(k, v []byte) {
+			f(k, value(v))
+		})
+	}
+	if b.perCPU {
+		iter = func(f func(k []byte, v float64)) error {
+			keys, err := b.Keys()
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				values, err := b.GetPerCPU(k)
+				if IsNotExists(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				sum := 0.0
+				for _, v := range values {
+					sum += value(v)
+				}
+				f(k, sum)
+			}
+			return nil
+		}
+	}
+	return writeProm(w, metricName, labeler, iter)
+}
+
+func writeProm(
+	w io.Writer,
+	metricName string,
+	labeler func(k []byte) map[string]string,
+	iter func(f func(k []byte, v float64)) error,
+) error {
+	if !promMetricNameRegexp.MatchString(metricName) {
+		return errors.Errorf("invalid metric name %q", metricName)
+	}
+	samples := map[string]float64{}
+	var labelErr error
+	err := iter(func(k []byte, v float64) {
+		labels, err := formatPromLabels(labeler(k))
+		if err != nil {
+			if labelErr == nil {
+				labelErr = err
+			}
+			return
+		}
+		samples[labels] += v
+	})
+	if err != nil {
+		return err
+	}
+	if labelErr != nil {
+		return labelErr
+	}
+
+	labelSets := make([]string, 0, len(samples))
+	for labels := range samples {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# TYPE %s gauge\n", metricName)
+	for _, labels := range labelSets {
+		fmt.Fprintf(bw, "%s%s %s\n", metricName, labels, formatPromValue(samples[labels]))
+	}
+	return bw.Flush()
+}
+
+// formatPromLabels renders labels as {name="value",...}, sorted by name, or "" if there are no
+// labels.
+func formatPromLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !promLabelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return "", errors.Errorf("invalid label name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, promLabelEscaper.Replace(labels[name]))
+	}
+	return "{" + strings.Join(parts, ",") + "}", nil
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
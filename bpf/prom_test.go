@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestWriteProm(t *testing.T) {
+	entries := []struct {
+		k []byte
+		v float64
+	}{
+		{[]byte{2, 0, 0, 0}, 20},
+		{[]byte{1, 0, 0, 0}, 10},
+		{[]byte{3, 0, 0, 0}, 5},
+		{[]byte{4, 0, 0, 0}, math.Inf(1)},
+	}
+	iter := func(f func(k []byte, v float64)) error {
+		for _, e := range entries {
+			f(e.k, e.v)
+		}
+		return nil
+	}
+	labeler := func(k []byte) map[string]string {
+		labels := map[string]string{"ifindex": fmt.Sprint(k[0])}
+		if k[0] == 3 {
+			// Merged with key 2.
+			labels["ifindex"] = "2"
+		}
+		if k[0] == 4 {
+			labels["name"] = "eth\"0\"\n"
+		}
+		return labels
+	}
+
+	var buf bytes.Buffer
+	if err := writeProm(&buf, "felix_bpf_test_bytes", labeler, iter); err != nil {
+		t.Fatalf("writeProm failed: %v", err)
+	}
+	expected := `# TYPE felix_bpf_test_bytes gauge
+felix_bpf_test_bytes{ifindex="1"} 10
+felix_bpf_test_bytes{ifindex="2"} 25
+felix_bpf_test_bytes{ifindex="4",name="eth\"0\"\n"} +Inf
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	if err := writeProm(&buf, "bad-name", labeler, iter); err == nil {
+		t.Error("Expected an error for an invalid metric name")
+	}
+	badLabeler := func(k []byte) map[string]string {
+		return map[string]string{"if-index": "1"}
+	}
+	if err := writeProm(&buf, "felix_bpf_test_bytes", badLabeler, iter); err == nil {
+		t.Error("Expected an error for an invalid label name")
+	}
+}
@@ -834,6 +834,14 @@ func (m *mockNATMap) Path() string {
 	return "/sys/fs/bpf/tc/nat"
 }
 
+func (m *mockNATMap) SupportsDelete() bool {
+	return true
+}
+
+func (m *mockNATMap) AssertType(expected string) error {
+	return checkMockMapType(nat.FrontendMapParameters, expected)
+}
+
 func (m *mockNATMap) Iter(iter bpf.MapIter) error {
 	m.Lock()
 	defer m.Unlock()
@@ -847,6 +855,15 @@ func (m *mockNATMap) Iter(iter bpf.MapIter) error {
 	return nil
 }
 
+func (m *mockNATMap) UpdateBatch(keys, values [][]byte) error {
+	for i := range keys {
+		if err := m.Update(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mockNATMap) Update(k, v []byte) error {
 	m.Lock()
 	defer m.Unlock()
@@ -919,6 +936,14 @@ func (m *mockNATBackendMap) Path() string {
 	return "/sys/fs/bpf/tc/natbe"
 }
 
+func (m *mockNATBackendMap) SupportsDelete() bool {
+	return true
+}
+
+func (m *mockNATBackendMap) AssertType(expected string) error {
+	return checkMockMapType(nat.BackendMapParameters, expected)
+}
+
 func (m *mockNATBackendMap) Iter(iter bpf.MapIter) error {
 	m.Lock()
 	defer m.Unlock()
@@ -932,6 +957,15 @@ func (m *mockNATBackendMap) Iter(iter bpf.MapIter) error {
 	return nil
 }
 
+func (m *mockNATBackendMap) UpdateBatch(keys, values [][]byte) error {
+	for i := range keys {
+		if err := m.Update(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mockNATBackendMap) Update(k, v []byte) error {
 	m.Lock()
 	defer m.Unlock()
@@ -1000,6 +1034,14 @@ func (m *mockAffinityMap) Path() string {
 	return "/sys/fs/bpf/tc/aff"
 }
 
+func (m *mockAffinityMap) SupportsDelete() bool {
+	return true
+}
+
+func (m *mockAffinityMap) AssertType(expected string) error {
+	return checkMockMapType(nat.AffinityMapParameters, expected)
+}
+
 func (m *mockAffinityMap) Iter(iter bpf.MapIter) error {
 	m.Lock()
 	defer m.Unlock()
@@ -1013,6 +1055,15 @@ func (m *mockAffinityMap) Iter(iter bpf.MapIter) error {
 	return nil
 }
 
+func (m *mockAffinityMap) UpdateBatch(keys, values [][]byte) error {
+	for i := range keys {
+		if err := m.Update(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mockAffinityMap) Update(k, v []byte) error {
 	m.Lock()
 	defer m.Unlock()
@@ -1061,3 +1112,10 @@ func (m *mockAffinityMap) Delete(k []byte) error {
 func (m *mockAffinityMap) MapFD() bpf.MapFD {
 	panic("implement me")
 }
+
+func checkMockMapType(params bpf.MapParameters, expected string) error {
+	if params.Type != expected {
+		return errors.Errorf("map %s is of type %s, expected %s", params.Name, params.Type, expected)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// SetReadCache enables a read-through cache for Get, holding up to size values for at most ttl
+// each.  A size of 0 disables the cache.  It should be called before the map is shared between
+// goroutines.
+//
+// The cache is only eventually consistent with the kernel: Update and Delete through this
+// PinnedMap invalidate the key that they write, but writes by BPF programs, other processes or
+// other PinnedMaps for the same map are not seen until the cached value expires.  Only use it for
+// values where a result that is up to ttl stale is acceptable.
+func (b *PinnedMap) SetReadCache(size int, ttl time.Duration) {
+	if size <= 0 {
+		b.readCache = nil
+		return
+	}
+	b.readCache = newReadCache(size, ttl)
+}
+
+// InvalidateCache removes k from the read cache, if there is one, so that the next Get reads it
+// from the kernel.
+func (b *PinnedMap) InvalidateCache(k []byte) {
+	if b.readCache != nil {
+		b.readCache.invalidate(k)
+	}
+}
+
+// readCache is a size-limited LRU cache of map values with a TTL.
+type readCache struct {
+	lock  sync.Mutex
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	key    string
+	value  []byte
+	expiry time.Time
+}
+
+func newReadCache(size int, ttl time.Duration) *readCache {
+	return &readCache{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		lru:   list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *readCache) get(k []byte) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[string(k)]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*readCacheEntry)
+	if c.now().After(entry.expiry) {
+		c.lru.Remove(elem)
+		delete(c.items, entry.key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return append([]byte(nil), entry.value...), true
+}
+
+func (c *readCache) put(k, v []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &readCacheEntry{
+		key:    string(k),
+		value:  append([]byte(nil), v...),
+		expiry: c.now().Add(c.ttl),
+	}
+	if elem, ok := c.items[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[entry.key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*readCacheEntry).key)
+	}
+}
+
+func (c *readCache) invalidate(k []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[string(k)]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, string(k))
+	}
+}
+
+func (c *readCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Init()
+	c.items = map[string]*list.Element{}
+}
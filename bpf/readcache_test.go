@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadCache(t *testing.T) {
+	now := time.Now()
+	c := newReadCache(2, time.Second)
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get([]byte{1}); ok {
+		t.Error("Expected a miss on an empty cache")
+	}
+	c.put([]byte{1}, []byte{10})
+	if v, ok := c.get([]byte{1}); !ok || !bytes.Equal(v, []byte{10}) {
+		t.Errorf("Expected a hit, got %v, %v", v, ok)
+	}
+
+	// Key 1 was used most recently so key 2 should be evicted when 3 is added.
+	c.put([]byte{2}, []byte{20})
+	c.get([]byte{1})
+	c.put([]byte{3}, []byte{30})
+	if _, ok := c.get([]byte{2}); ok {
+		t.Error("Expected least recently used key to be evicted")
+	}
+	if _, ok := c.get([]byte{1}); !ok {
+		t.Error("Expected recently used key to survive eviction")
+	}
+
+	c.invalidate([]byte{1})
+	if _, ok := c.get([]byte{1}); ok {
+		t.Error("Expected a miss after invalidation")
+	}
+
+	now = now.Add(2 * time.Second)
+	if _, ok := c.get([]byte{3}); ok {
+		t.Error("Expected a miss after the TTL")
+	}
+	if len(c.items) != 0 || c.lru.Len() != 0 {
+		t.Errorf("Expected cache to be empty, has %d items", len(c.items))
+	}
+}
+
+func TestPinnedMapReadCache(t *testing.T) {
+	m := (&MapContext{}).newPinnedMap(MapParameters{Name: "cali_test", KeySize: 1, ValueSize: 1})
+	m.SetReadCache(10, time.Minute)
+
+	// Seed the cache directly so that the lookup doesn't need the kernel.
+	m.readCache.put([]byte{1}, []byte{10})
+	v, err := m.Get([]byte{1})
+	if err != nil || !bytes.Equal(v, []byte{10}) {
+		t.Errorf("Expected cached value, got %v, %v", v, err)
+	}
+	v[0] = 99
+	if v, _ := m.readCache.get([]byte{1}); v[0] != 10 {
+		t.Error("Modifying a returned value shouldn't change the cache")
+	}
+
+	m.InvalidateCache([]byte{1})
+	if _, ok := m.readCache.get([]byte{1}); ok {
+		t.Error("Expected InvalidateCache to remove the key")
+	}
+
+	m.SetReadCache(0, 0)
+	if m.readCache != nil {
+		t.Error("Expected size 0 to disable the cache")
+	}
+	m.InvalidateCache([]byte{1})
+}
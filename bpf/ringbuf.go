@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// RoundRingbufSize returns the smallest valid ringbuf size that can hold the given number of
+// bytes.  The kernel requires ringbuf sizes (which are passed as max_entries) to be a power of
+// two and a multiple of the page size.
+func RoundRingbufSize(bytes int) int {
+	size := os.Getpagesize()
+	for size < bytes {
+		size <<= 1
+	}
+	return size
+}
+
+func (mp *MapParameters) validateRingbuf() error {
+	if mp.KeySize != 0 || mp.ValueSize != 0 {
+		return errors.Errorf("ringbuf map %s must have zero key and value sizes", mp.Name)
+	}
+	if mp.MaxEntries <= 0 || RoundRingbufSize(mp.MaxEntries) != mp.MaxEntries {
+		return errors.Errorf("ringbuf map %s has invalid size %d: it must be a power of two and a "+
+			"multiple of the page size (%d), try %d",
+			mp.Name, mp.MaxEntries, os.Getpagesize(), RoundRingbufSize(mp.MaxEntries))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Bits in the length word of a ringbuf record header.  The header is 8 bytes: a 32-bit
+	// length (with these flags in the top bits) followed by a 32-bit page offset that only the
+	// kernel uses.
+	ringbufBusyBit    = 1 << 31
+	ringbufDiscardBit = 1 << 30
+	ringbufHdrSize    = 8
+
+	ringbufPollTimeoutMS = 100
+)
+
+// RingBuf is a userspace consumer for a BPF ringbuf map.  The kernel maps the data area twice,
+// back to back, so that a record that wraps around the end of the buffer can still be read as a
+// contiguous slice.
+type RingBuf struct {
+	consumerPos *uint64
+	producerPos *uint64
+	data        []byte
+	mask        uint64
+
+	// wait blocks until the producer may have written more data or the timeout (in ms) expires.
+	wait  func(timeoutMS int) error
+	close func() error
+}
+
+// NewRingBuf mmaps the given ringbuf map and prepares to consume records from it.  The map must
+// already exist.
+func NewRingBuf(m *PinnedMap) (*RingBuf, error) {
+	if m.Type != "ringbuf" {
+		return nil, errors.Errorf("map %s is a %s map, not a ringbuf", m.versionedName(), m.Type)
+	}
+	if err := m.maybeCreateLazily(); err != nil {
+		return nil, err
+	}
+	fd := int(m.fd)
+	pageSize := os.Getpagesize()
+
+	consumerPage, err := unix.Mmap(fd, 0, pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to mmap ringbuf consumer page")
+	}
+	producerPages, err := unix.Mmap(fd, int64(pageSize), pageSize+2*m.MaxEntries, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Munmap(consumerPage)
+		return nil, errors.Wrap(err, "failed to mmap ringbuf data pages")
+	}
+	epollFD, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err == nil {
+		err = unix.EpollCtl(epollFD, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)})
+		if err != nil {
+			_ = unix.Close(epollFD)
+		}
+	}
+	if err != nil {
+		_ = unix.Munmap(consumerPage)
+		_ = unix.Munmap(producerPages)
+		return nil, errors.Wrap(err, "failed to set up epoll for ringbuf")
+	}
+
+	events := make([]unix.EpollEvent, 1)
+	return &RingBuf{
+		consumerPos: (*uint64)(unsafe.Pointer(&consumerPage[0])),
+		producerPos: (*uint64)(unsafe.Pointer(&producerPages[0])),
+		data:        producerPages[pageSize:],
+		mask:        uint64(m.MaxEntries - 1),
+		wait: func(timeoutMS int) error {
+			_, err := unix.EpollWait(epollFD, events, timeoutMS)
+			if err == unix.EINTR {
+				return nil
+			}
+			return err
+		},
+		close: func() error {
+			_ = unix.Munmap(consumerPage)
+			_ = unix.Munmap(producerPages)
+			return unix.Close(epollFD)
+		},
+	}, nil
+}
+
+// Close releases the ringbuf's mappings and epoll FD.  It must not be called while Stream is
+// running.
+func (r *RingBuf) Close() error {
+	return r.close()
+}
+
+// next returns a copy of the next committed record without consuming it, along with the
+// consumer position that follows it.  ok is false if no committed record is available.
+// Discarded records are skipped (and consumed) transparently.
+func (r *RingBuf) next() (record []byte, nextPos uint64, ok bool) {
+	cons := atomic.LoadUint64(r.consumerPos)
+	for cons < atomic.LoadUint64(r.producerPos) {
+		off := cons & r.mask
+		hdr := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[off])))
+		if hdr&ringbufBusyBit != 0 {
+			// The producer has reserved this record but not yet committed it.
+			return nil, 0, false
+		}
+		length := uint64(hdr &^ (ringbufBusyBit | ringbufDiscardBit))
+		nextPos = cons + (length+ringbufHdrSize+7)&^7
+		if hdr&ringbufDiscardBit != 0 {
+			cons = nextPos
+			atomic.StoreUint64(r.consumerPos, cons)
+			continue
+		}
+		start := off + ringbufHdrSize
+		record = make([]byte, length)
+		copy(record, r.data[start:start+length])
+		return record, nextPos, true
+	}
+	return nil, 0, false
+}
+
+// Stream reads records from the ringbuf and sends them on the returned channel, which has the
+// given buffer size.  Each record is only consumed (i.e. its space released back to the kernel)
+// once it has been sent on the channel, so a slow reader applies backpressure to the ringbuf
+// rather than causing records to be dropped in userspace.
+//
+// Loss semantics: once the kernel's buffer is full, bpf_ringbuf_reserve()/bpf_ringbuf_output()
+// fail in the BPF program and the new record is lost there; the program is responsible for
+// counting such failures.  Nothing is reported to userspace and records that were already
+// committed are never overwritten.
+//
+// Both channels are closed when streaming stops, either because ctx is done or because waiting
+// for data failed, in which case the error is sent on the error channel first.  A RingBuf
+// supports only one Stream at a time.
+func (r *RingBuf) Stream(ctx context.Context, bufSize int) (<-chan []byte, <-chan error) {
+	records := make(chan []byte, bufSize)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(records)
+		for ctx.Err() == nil {
+			record, nextPos, ok := r.next()
+			if !ok {
+				if err := r.wait(ringbufPollTimeoutMS); err != nil {
+					errs <- errors.Wrap(err, "failed to wait for ringbuf data")
+					return
+				}
+				continue
+			}
+			select {
+			case records <- record:
+				atomic.StoreUint64(r.consumerPos, nextPos)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return records, errs
+}
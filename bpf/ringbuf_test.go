@@ -0,0 +1,164 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRoundRingbufSize(t *testing.T) {
+	page := os.Getpagesize()
+	for _, tc := range []struct {
+		in, out int
+	}{
+		{0, page},
+		{1, page},
+		{page, page},
+		{page + 1, 2 * page},
+		{3 * page, 4 * page},
+		{256 * 1024, 256 * 1024},
+	} {
+		if out := RoundRingbufSize(tc.in); out != tc.out {
+			t.Errorf("RoundRingbufSize(%d) = %d, expected %d", tc.in, out, tc.out)
+		}
+	}
+}
+
+func TestRingbufValidation(t *testing.T) {
+	mp := MapParameters{Type: "ringbuf", Name: "cali_rb", MaxEntries: 3 * os.Getpagesize()}
+	if err := mp.validate(); err == nil {
+		t.Error("expected error for non-power-of-two ringbuf size")
+	}
+	mp.MaxEntries = 4 * os.Getpagesize()
+	if err := mp.validate(); err != nil {
+		t.Errorf("unexpected error for valid ringbuf: %v", err)
+	}
+	mp.KeySize = 4
+	if err := mp.validate(); err == nil {
+		t.Error("expected error for ringbuf with non-zero key size")
+	}
+}
+
+// fakeRingbufProducer writes records into memory laid out like a kernel ringbuf, mirroring the
+// data area to mimic the kernel's double mapping.
+type fakeRingbufProducer struct {
+	consumerPos, producerPos uint64
+	data                     []byte
+	size                     uint64
+}
+
+func newFakeRingbuf(size int) (*fakeRingbufProducer, *RingBuf) {
+	backing := make([]uint64, size/4) // 2*size bytes, 8-byte aligned.
+	p := &fakeRingbufProducer{
+		data: (*[1 << 30]byte)(unsafe.Pointer(&backing[0]))[: 2*size : 2*size],
+		size: uint64(size),
+	}
+	r := &RingBuf{
+		consumerPos: &p.consumerPos,
+		producerPos: &p.producerPos,
+		data:        p.data,
+		mask:        uint64(size - 1),
+		wait: func(int) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+		close: func() error { return nil },
+	}
+	return p, r
+}
+
+// produce writes a record, returning false if there isn't room, like bpf_ringbuf_output().
+func (p *fakeRingbufProducer) produce(record []byte, discard bool) bool {
+	prod := atomic.LoadUint64(&p.producerPos)
+	total := (uint64(len(record)) + ringbufHdrSize + 7) &^ 7
+	if prod+total-atomic.LoadUint64(&p.consumerPos) > p.size {
+		return false
+	}
+	buf := make([]byte, total)
+	hdr := uint32(len(record))
+	if discard {
+		hdr |= ringbufDiscardBit
+	}
+	binary.LittleEndian.PutUint32(buf, hdr)
+	copy(buf[ringbufHdrSize:], record)
+	for i, b := range buf {
+		off := (prod + uint64(i)) & (p.size - 1)
+		p.data[off] = b
+		p.data[off+p.size] = b
+	}
+	atomic.StoreUint64(&p.producerPos, prod+total)
+	return true
+}
+
+func TestRingBufStream(t *testing.T) {
+	p, r := newFakeRingbuf(64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nobody reads the channel yet: one record fits in the channel and the second is held by
+	// the stream, unconsumed, so the producer eventually runs out of room.
+	records, errs := r.Stream(ctx, 1)
+	record := func(i int) []byte {
+		return []byte{byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	}
+	for i := 0; i < 2; i++ {
+		if !p.produce(record(i), false) {
+			t.Fatalf("Failed to produce record %d", i)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&p.consumerPos) != 24 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !p.produce(record(2), false) {
+		t.Fatal("Expected room for a third record once the first was consumed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if pos := atomic.LoadUint64(&p.consumerPos); pos != 24 {
+		t.Fatalf("Expected only the first record to be consumed, consumer position is %d", pos)
+	}
+	if p.produce(record(99), false) {
+		t.Fatal("Expected the producer to be blocked by backpressure")
+	}
+
+	// Discarded records are skipped and records that wrap the end of the buffer come out whole.
+	for i := 0; i < 5; i++ {
+		rec := <-records
+		if rec[0] != byte(i) || len(rec) != 12 {
+			t.Fatalf("Unexpected record %d: %v", i, rec)
+		}
+		if i == 0 {
+			if !p.produce([]byte{42}, true) {
+				t.Fatal("Failed to produce discarded record")
+			}
+		}
+		for !p.produce(record(i+3), false) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cancel()
+	for range records {
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
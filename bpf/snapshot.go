@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshot is a point-in-time, in-memory copy of a map's contents.  It is unaffected by later
+// changes to the map.
+type Snapshot struct {
+	entries []Entry
+	index   map[string]int
+}
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{
+		index: map[string]int{},
+	}
+}
+
+func (s *Snapshot) add(k, v []byte) {
+	e := Entry{Key: k, Value: v}.Clone()
+	if i, ok := s.index[string(k)]; ok {
+		s.entries[i] = e
+		return
+	}
+	s.index[string(k)] = len(s.entries)
+	s.entries = append(s.entries, e)
+}
+
+// Get returns the value of k at the time of the snapshot, or ErrKeyNotExist.
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	i, ok := s.index[string(k)]
+	if !ok {
+		return nil, ErrKeyNotExist
+	}
+	return s.entries[i].Value, nil
+}
+
+// Iter calls f for each entry in the snapshot, in the order that the entries were read from the
+// map.  It always returns nil; the error return matches Map.Iter.
+func (s *Snapshot) Iter(f MapIter) error {
+	for _, e := range s.entries {
+		f(e.Key, e.Value)
+	}
+	return nil
+}
+
+// Entries returns a copy of the snapshot's entries, in the order that they were read from the map.
+func (s *Snapshot) Entries() []Entry {
+	entries := make([]Entry, len(s.entries))
+	for i, e := range s.entries {
+		entries[i] = e.Clone()
+	}
+	return entries
+}
+
+// Len returns the number of entries in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// Snapshot copies the contents of the map into memory.  The copy isn't atomic with respect to
+// concurrent writers, but the window is kept small by reading the map with batch lookups, falling
+// back to a normal iteration on kernels that don't support them.
+func (b *PinnedMap) Snapshot() (*Snapshot, error) {
+	s := newSnapshot()
+	err := b.IterBatch(s.add)
+	if err == nil {
+		return s, nil
+	}
+	logrus.WithError(err).WithField("name", b.versionedName()).Debug(
+		"Batch lookup failed, falling back to iteration for snapshot")
+	s = newSnapshot()
+	if err := b.Iter(func(k, v []byte) {
+		s.add(k, v)
+	}); err != nil {
+		return nil, errors.WithMessagef(err, "failed to snapshot map %s", b.versionedName())
+	}
+	return s, nil
+}
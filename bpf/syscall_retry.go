@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxEINTRRetries bounds the number of times that bpfSyscallRetryEINTR retries a syscall that
+// was interrupted.
+const maxEINTRRetries = 10
+
+// bpfSyscall makes a BPF syscall.  It is a var so that tests can inject errors.
+var bpfSyscall = func(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, unix.Errno) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	return r, errno
+}
+
+// bpfSyscallRetryEINTR makes a BPF syscall, retrying it if it fails with EINTR because a signal
+// arrived on the thread, as the Go standard library does for its syscalls.  It is only for
+// commands that are safe to repeat, such as element lookups, updates and deletes.
+func bpfSyscallRetryEINTR(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, unix.Errno) {
+	for i := 0; ; i++ {
+		r, errno := bpfSyscall(cmd, attr, size)
+		if errno != unix.EINTR || i >= maxEINTRRetries {
+			return r, errno
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBPFSyscallRetriesEINTR(t *testing.T) {
+	defer func(orig func(int, unsafe.Pointer, uintptr) (uintptr, unix.Errno)) {
+		bpfSyscall = orig
+	}(bpfSyscall)
+
+	calls := 0
+	failures := 0
+	bpfSyscall = func(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, unix.Errno) {
+		calls++
+		if calls <= failures {
+			return 0, unix.EINTR
+		}
+		return 0, 0
+	}
+
+	failures = 3
+	if _, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_LOOKUP_ELEM, nil, 0); errno != 0 || calls != 4 {
+		t.Errorf("Expected success after retries, got %v after %d calls", errno, calls)
+	}
+
+	// Retries are bounded.
+	calls = 0
+	failures = 1000
+	if _, errno := bpfSyscallRetryEINTR(unix.BPF_MAP_LOOKUP_ELEM, nil, 0); errno != unix.EINTR ||
+		calls != maxEINTRRetries+1 {
+		t.Errorf("Expected EINTR after %d calls, got %v after %d calls", maxEINTRRetries+1, errno, calls)
+	}
+
+	// The element operations go through the retry loop.
+	calls = 0
+	failures = 2
+	if _, err := GetMapEntry(0, []byte{1, 2, 3, 4}, 4); err != nil || calls != 3 {
+		t.Errorf("Expected GetMapEntry to retry, got %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TTLMap wraps a Map and adds per-entry expiry for hash maps on kernels that lack BPF timers.
+//
+// Expiry is driven entirely from userspace: the kernel knows nothing about the TTLs, so an
+// expired entry stays visible to BPF programs (and to Get/Iter) until SweepExpired removes it.
+// Expiry times are held in memory only and are lost on restart.
+type TTLMap struct {
+	Map
+
+	lock     sync.Mutex
+	now      func() time.Time
+	expiries map[string]time.Time
+}
+
+// NewTTLMap returns a TTLMap that stores its entries in m.
+func NewTTLMap(m Map) *TTLMap {
+	return &TTLMap{
+		Map:      m,
+		now:      time.Now,
+		expiries: map[string]time.Time{},
+	}
+}
+
+// UpdateWithTTL writes the entry and records that it should be removed once ttl has elapsed.
+func (t *TTLMap) UpdateWithTTL(k, v []byte, ttl time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.Map.Update(k, v); err != nil {
+		return err
+	}
+	t.expiries[string(k)] = t.now().Add(ttl)
+	return nil
+}
+
+// Update writes the entry without a TTL, clearing any TTL previously set for the key.
+func (t *TTLMap) Update(k, v []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.Map.Update(k, v); err != nil {
+		return err
+	}
+	delete(t.expiries, string(k))
+	return nil
+}
+
+// UpdateBatch writes the entries without TTLs, clearing any TTLs previously set for the keys.
+func (t *TTLMap) UpdateBatch(keys, values [][]byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.Map.UpdateBatch(keys, values); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		delete(t.expiries, string(k))
+	}
+	return nil
+}
+
+// Delete removes the entry and its TTL.
+func (t *TTLMap) Delete(k []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := t.Map.Delete(k)
+	if err == nil || IsNotExists(errors.Cause(err)) {
+		delete(t.expiries, string(k))
+	}
+	return err
+}
+
+// SweepExpired deletes all entries whose TTL has passed.  Entries that were already removed from
+// the map by someone else are forgotten without being counted.  It returns the number of entries
+// removed and the first error encountered; sweeping continues past errors and the failed
+// entries are retried on the next sweep.
+func (t *TTLMap) SweepExpired() (removed int, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	for k, expiry := range t.expiries {
+		if now.Before(expiry) {
+			continue
+		}
+		delErr := t.Map.Delete([]byte(k))
+		if delErr != nil && !IsNotExists(errors.Cause(delErr)) {
+			if err == nil {
+				err = errors.WithMessagef(delErr, "failed to delete expired entry from %s", t.GetName())
+			}
+			continue
+		}
+		if delErr == nil {
+			removed++
+		}
+		delete(t.expiries, k)
+	}
+	return removed, err
+}
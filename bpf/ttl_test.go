@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/projectcalico/felix/bpf"
+)
+
+func TestTTLMapSweepExpired(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	ttlMap := bpf.NewTTLMap(m)
+
+	short := []byte{10, 0, 0, 0}
+	long := []byte{11, 0, 0, 0}
+	cleared := []byte{12, 0, 0, 0}
+	for _, k := range [][]byte{short, cleared} {
+		if err := ttlMap.UpdateWithTTL(k, []byte{1, 2, 3, 4}, 10*time.Millisecond); err != nil {
+			t.Fatalf("UpdateWithTTL failed: %v", err)
+		}
+	}
+	if err := ttlMap.UpdateWithTTL(long, []byte{1, 2, 3, 4}, time.Hour); err != nil {
+		t.Fatalf("UpdateWithTTL failed: %v", err)
+	}
+	// A plain Update clears the TTL.
+	if err := ttlMap.Update(cleared, []byte{5, 6, 7, 8}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	removed, err := ttlMap.SweepExpired()
+	if err != nil || removed != 0 {
+		t.Fatalf("Expected nothing to expire yet, removed %d, err %v", removed, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	removed, err = ttlMap.SweepExpired()
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected one entry to expire, removed %d, err %v", removed, err)
+	}
+	if _, ok := m.Contents[string(short)]; ok {
+		t.Error("Expired entry still present")
+	}
+	for _, k := range [][]byte{long, cleared, {0, 0, 0, 0}} {
+		if _, ok := m.Contents[string(k)]; !ok {
+			t.Errorf("Entry %v was removed unexpectedly", k)
+		}
+	}
+
+	removed, err = ttlMap.SweepExpired()
+	if err != nil || removed != 0 {
+		t.Errorf("Expected the expired entry to be forgotten, removed %d, err %v", removed, err)
+	}
+}
@@ -15,13 +15,22 @@
 package ut_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 
+	"github.com/projectcalico/felix/bpf"
 	"github.com/projectcalico/felix/bpf/conntrack"
 )
 
@@ -71,3 +80,1829 @@ func setUpMapTestWithSingleKV(t *testing.T) (conntrack.Key, error) {
 	err1 := ctMap.Update(k.AsBytes(), v[:])
 	return k, err1
 }
+
+func newTestArrayMap(name string, valueSize, maxEntries int) *bpf.PinnedMap {
+	m, err := (&bpf.MapContext{}).NewPinnedMapE(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/" + name,
+		Type:       "array",
+		KeySize:    4,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+		Name:       name,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	return m.(*bpf.PinnedMap)
+}
+
+func removeTestMap(m *bpf.PinnedMap) {
+	_ = m.Close()
+	_ = os.Remove(m.Path())
+}
+
+func TestUpdateRange(t *testing.T) {
+	RegisterTestingT(t)
+	for _, flags := range []int{0, 0x400 /* BPF_F_MMAPABLE */} {
+		m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+			Filename:   "/sys/fs/bpf/tc/globals/cali_test_range",
+			Type:       "array",
+			KeySize:    4,
+			ValueSize:  12,
+			MaxEntries: 1000,
+			Name:       "cali_test_range",
+			Flags:      flags,
+		}).(*bpf.PinnedMap)
+		Expect(m.EnsureExists()).NotTo(HaveOccurred())
+
+		// Values that aren't a multiple of 8 bytes, across a page boundary.
+		values := make([][]byte, 300)
+		for i := range values {
+			values[i] = []byte{byte(i), byte(i >> 8), 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+		}
+		Expect(m.UpdateRange(350, values)).NotTo(HaveOccurred())
+		k := make([]byte, 4)
+		for _, i := range []uint32{349, 350, 500, 649, 650} {
+			binary.LittleEndian.PutUint32(k, i)
+			v, err := m.Get(k)
+			Expect(err).NotTo(HaveOccurred())
+			if i < 350 || i >= 650 {
+				Expect(v).To(Equal(make([]byte, 12)), "index %d outside the range was written", i)
+			} else {
+				Expect(v).To(Equal(values[i-350]), "index %d", i)
+			}
+		}
+		Expect(m.UpdateRange(990, values)).To(HaveOccurred(), "range past max entries")
+		removeTestMap(m)
+	}
+
+	hash := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_rangeh",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_rangeh",
+	}).(*bpf.PinnedMap)
+	Expect(hash.UpdateRange(0, [][]byte{{1, 2, 3, 4}})).To(HaveOccurred(), "hash map with 4-byte keys")
+}
+
+func BenchmarkArrayUpdateRange(b *testing.B) {
+	RegisterTestingT(b)
+	m := newTestArrayMap("cali_bench_arr", 8, 256)
+	defer removeTestMap(m)
+
+	values := make([][]byte, 256)
+	for i := range values {
+		values[i] = make([]byte, 8)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err := m.UpdateRange(0, values)
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func BenchmarkArrayUpdatePerIndex(b *testing.B) {
+	RegisterTestingT(b)
+	m := newTestArrayMap("cali_bench_arr", 8, 256)
+	defer removeTestMap(m)
+
+	v := make([]byte, 8)
+	k := make([]byte, 4)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < 256; i++ {
+			k[0] = byte(i)
+			err := m.Update(k, v)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+}
+
+func benchmarkGetKeys(b *testing.B) (*bpf.PinnedMap, [][]byte) {
+	RegisterTestingT(b)
+	m := newTestArrayMap("cali_bench_get", 8, 256)
+	keys := make([][]byte, 256)
+	for i := range keys {
+		keys[i] = []byte{byte(i), 0, 0, 0}
+	}
+	return m, keys
+}
+
+func BenchmarkGetBatch(b *testing.B) {
+	m, keys := benchmarkGetKeys(b)
+	defer removeTestMap(m)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _, err := m.GetBatch(keys)
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func BenchmarkGetPerKey(b *testing.B) {
+	m, keys := benchmarkGetKeys(b)
+	defer removeTestMap(m)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, k := range keys {
+			_, err := m.Get(k)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+}
+
+func TestLazyCreateMap(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_lazy",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_lazy",
+		LazyCreate: true,
+	}).(*bpf.PinnedMap)
+	defer removeTestMap(m)
+
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	_, err := os.Stat(m.Path())
+	Expect(os.IsNotExist(err)).To(BeTrue(), "Lazy map shouldn't exist before first use")
+
+	err = m.Update([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+	Expect(err).NotTo(HaveOccurred())
+	_, err = os.Stat(m.Path())
+	Expect(err).NotTo(HaveOccurred(), "Lazy map should exist after first use")
+
+	v, err := m.Get([]byte{1, 2, 3, 4})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{5, 6, 7, 8}))
+}
+
+func TestLazyCreateMapExistingPin(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_lazy2",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_lazy2",
+	}
+	existing := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(existing.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(existing)
+	Expect(existing.Update([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})).NotTo(HaveOccurred())
+
+	// Opening the existing pin on first use must not deadlock on the lazy-creation lock.
+	params.LazyCreate = true
+	m := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	defer m.Close()
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	done := make(chan []byte)
+	go func() {
+		v, _ := m.Get([]byte{1, 2, 3, 4})
+		done <- v
+	}()
+	Eventually(done, 5*time.Second).Should(Receive(Equal([]byte{5, 6, 7, 8})))
+}
+
+func TestPerCPUUpdateAllCPUsRoundTrip(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_pcpu",
+		Type:       "percpu_array",
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 4,
+		Name:       "cali_test_pcpu",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{2, 0, 0, 0}
+	v := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	Expect(m.UpdateAllCPUs(k, v)).NotTo(HaveOccurred())
+
+	values, err := m.GetPerCPU(k)
+	Expect(err).NotTo(HaveOccurred())
+	numCPUs, err := bpf.NumPossibleCPUs()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(values).To(HaveLen(numCPUs))
+	for _, cpuVal := range values {
+		Expect(cpuVal).To(Equal(v))
+	}
+
+	Expect(m.UpdateAllCPUs(k, []byte{1})).To(HaveOccurred(), "Short value should be rejected")
+}
+
+func TestMapContextCloseAll(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{}
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_close",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_close",
+	})
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer os.Remove(m.Path())
+	fd := m.MapFD()
+
+	Expect(mc.CloseAll()).NotTo(HaveOccurred())
+
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	Expect(err).To(Equal(unix.EBADF), "FD should be closed after CloseAll")
+}
+
+func TestMapReopen(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_reopen", 4, 4)
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	Expect(m.Close()).NotTo(HaveOccurred())
+
+	Expect(m.Reopen()).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 2, 3, 4}))
+
+	Expect(m.Close()).NotTo(HaveOccurred())
+	Expect(os.Remove(m.Path())).NotTo(HaveOccurred())
+	Expect(m.Reopen()).To(Equal(bpf.ErrMapNotFound))
+}
+
+func TestMapAddUint64(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_ctr",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+		Name:       "cali_test_ctr",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.AddUint64(k, 5)).NotTo(HaveOccurred(), "Add to missing key should create it")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Expect(m.AddUint64(k, 1)).NotTo(HaveOccurred())
+		}()
+	}
+	wg.Wait()
+
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(binary.LittleEndian.Uint64(v)).To(Equal(uint64(15)))
+}
+
+func TestLRUMapTouch(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_lru",
+		Type:       "lru_hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 64,
+		Name:       "cali_test_lru",
+	}).(*bpf.PinnedMap)
+	if err := m.EnsureExists(); err != nil {
+		t.Skipf("LRU maps not supported: %v", err)
+	}
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Touch(k)).To(HaveOccurred(), "Touching a missing key should fail")
+
+	Expect(m.Update(k, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	Expect(m.Touch(k)).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 2, 3, 4}), "Touch shouldn't change the value")
+}
+
+func TestCreateInnerMaps(t *testing.T) {
+	RegisterTestingT(t)
+	// Production runs with repinning enabled; inner maps, which all share a name, must not be
+	// repinned from one another.
+	mc := &bpf.MapContext{RepinningEnabled: true}
+	outer := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_outer",
+		Type:       "hash_of_maps",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+		Name:       "cali_test_outer",
+		InnerMap: &bpf.MapParameters{
+			Type:       "hash",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+			Name:       "cali_test_inner",
+		},
+	}).(*bpf.PinnedMap)
+	Expect(outer.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(outer)
+
+	innerIDs := map[int]bool{}
+	for i := byte(1); i <= 2; i++ {
+		inner, err := outer.CreateInnerMap([]byte{i, 0, 0, 0})
+		Expect(err).NotTo(HaveOccurred())
+		defer removeTestMap(inner)
+
+		Expect(inner.Update([]byte{1, 2, 3, 4}, []byte{i, i, i, i})).NotTo(HaveOccurred())
+		info, err := inner.GetInfo()
+		Expect(err).NotTo(HaveOccurred())
+		innerIDs[info.ID] = true
+
+		// Looking up an outer map from userspace gives the inner map's ID.
+		v, err := outer.Get([]byte{i, 0, 0, 0})
+		Expect(err).NotTo(HaveOccurred(), "Inner map should be stored in outer map")
+		Expect(int(binary.LittleEndian.Uint32(v))).To(Equal(info.ID))
+	}
+	Expect(innerIDs).To(HaveLen(2), "Each key should get its own inner map")
+}
+
+func TestRepinFilter(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_repin",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_repin",
+	}
+	old := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(old.EnsureExists()).NotTo(HaveOccurred())
+	defer old.Close()
+	for i := byte(0); i < 10; i++ {
+		Expect(old.Update([]byte{i, 0, 0, 0}, []byte{i, 0, 0, 0})).NotTo(HaveOccurred())
+	}
+	// Remove the pin; our open FD keeps the old map alive, as a loaded program would.
+	Expect(os.Remove(params.Filename)).NotTo(HaveOccurred())
+
+	params.RepinFilter = func(k, v []byte) bool {
+		return k[0]%2 == 0
+	}
+	m := (&bpf.MapContext{RepinningEnabled: true}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	var keys []byte
+	Expect(m.Iter(func(k, v []byte) {
+		keys = append(keys, k[0])
+	})).NotTo(HaveOccurred())
+	Expect(keys).To(ConsistOf(byte(0), byte(2), byte(4), byte(6), byte(8)))
+}
+
+func TestPinByName(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_byname_own",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_byname",
+	}
+	// The map that owns the name, pinned somewhere else, as if by another program.
+	owner := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(owner.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(owner)
+	Expect(owner.Update([]byte{1, 0, 0, 0}, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+
+	// A different map occupies our pin path.
+	staleParams := params
+	staleParams.Filename = "/sys/fs/bpf/tc/globals/cali_test_byname"
+	staleParams.Name = "cali_test_stale"
+	stale := (&bpf.MapContext{}).NewPinnedMap(staleParams).(*bpf.PinnedMap)
+	Expect(stale.EnsureExists()).NotTo(HaveOccurred())
+	defer stale.Close()
+
+	params.Filename = "/sys/fs/bpf/tc/globals/cali_test_byname"
+	params.PinByName = true
+	m := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	same, err := m.SameAs(owner)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(same).To(BeTrue(), "Map should have been found by name")
+	v, err := m.Get([]byte{1, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 2, 3, 4}))
+
+	// The pin path should now refer to the map with our name.
+	fd, err := bpf.GetMapFDByPin(params.Filename)
+	Expect(err).NotTo(HaveOccurred())
+	defer fd.Close()
+	info, err := bpf.GetMapInfo(fd)
+	Expect(err).NotTo(HaveOccurred())
+	ownerID, err := owner.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(info.ID).To(Equal(ownerID))
+}
+
+func TestMapKeys(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_keys", 4, 8)
+	defer removeTestMap(m)
+
+	keys, err := m.Keys()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(keys).To(HaveLen(8), "Array maps always contain all their keys")
+}
+
+func setUpWideValueMap(b *testing.B) *bpf.PinnedMap {
+	RegisterTestingT(b)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_bench_wide",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  1024,
+		MaxEntries: 1000,
+		Name:       "cali_bench_wide",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	v := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		k := make([]byte, 4)
+		binary.LittleEndian.PutUint32(k, uint32(i))
+		Expect(m.Update(k, v)).NotTo(HaveOccurred())
+	}
+	return m
+}
+
+func BenchmarkWideMapKeys(b *testing.B) {
+	m := setUpWideValueMap(b)
+	defer removeTestMap(m)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := m.Keys()
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func BenchmarkWideMapIterKeys(b *testing.B) {
+	m := setUpWideValueMap(b)
+	defer removeTestMap(m)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var keys [][]byte
+		err := m.Iter(func(k, v []byte) {
+			keys = append(keys, k)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func TestMapFull(t *testing.T) {
+	RegisterTestingT(t)
+	var fullMaps []string
+	ctx := &bpf.MapContext{OnMapFull: func(name string) { fullMaps = append(fullMaps, name) }}
+	m := ctx.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_full",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 2,
+		Name:       "cali_test_full",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	v := []byte{1, 2, 3, 4}
+	Expect(m.Update([]byte{1, 0, 0, 0}, v)).NotTo(HaveOccurred())
+	Expect(m.Update([]byte{2, 0, 0, 0}, v)).NotTo(HaveOccurred())
+	err := m.Update([]byte{3, 0, 0, 0}, v)
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFull))
+	Expect(fullMaps).To(Equal([]string{"cali_test_full"}))
+
+	// Updating an existing key doesn't need a new slot.
+	Expect(m.Update([]byte{1, 0, 0, 0}, v)).NotTo(HaveOccurred())
+}
+
+func TestNativeMapCreate(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_native", 12, 16)
+	defer removeTestMap(m)
+
+	info, err := m.GetInfo()
+	Expect(err).NotTo(HaveOccurred())
+	typeID, _ := bpf.MapTypeID("array")
+	Expect(info.Type).To(Equal(int(typeID)))
+	Expect(info.KeySize).To(Equal(4))
+	Expect(info.ValueSize).To(Equal(12))
+	Expect(info.MaxEntries).To(Equal(16))
+}
+
+// BenchmarkEnsureExistsManyMaps simulates start-of-day, when we create all our maps in turn.
+func BenchmarkEnsureExistsManyMaps(b *testing.B) {
+	RegisterTestingT(b)
+	const numMaps = 50
+	for n := 0; n < b.N; n++ {
+		var maps []*bpf.PinnedMap
+		for i := 0; i < numMaps; i++ {
+			name := fmt.Sprintf("cali_bench_%d", i)
+			m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+				Filename:   "/sys/fs/bpf/tc/globals/" + name,
+				Type:       "hash",
+				KeySize:    8,
+				ValueSize:  8,
+				MaxEntries: 1024,
+				Name:       name,
+			}).(*bpf.PinnedMap)
+			Expect(m.EnsureExists()).NotTo(HaveOccurred())
+			maps = append(maps, m)
+		}
+		b.StopTimer()
+		for _, m := range maps {
+			removeTestMap(m)
+		}
+		b.StartTimer()
+	}
+}
+
+func TestMapGetOrCreate(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_goc",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_goc",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	_, err := m.GetOrCreate([]byte{1, 0, 0, 0}, []byte{1})
+	Expect(err).To(HaveOccurred(), "Short initial value should be rejected")
+
+	// Two goroutines race to initialise the same key; both must see the value that won.
+	k := []byte{2, 0, 0, 0}
+	var wg sync.WaitGroup
+	results := make([][]byte, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := m.GetOrCreate(k, []byte{byte(i + 1), 0, 0, 0})
+			Expect(err).NotTo(HaveOccurred())
+			results[i] = v
+		}(i)
+	}
+	wg.Wait()
+
+	stored, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(results[0]).To(Equal(stored))
+	Expect(results[1]).To(Equal(stored))
+
+	v, err := m.GetOrCreate(k, []byte{9, 9, 9, 9})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal(stored), "Existing value should not be overwritten")
+}
+
+func TestMapAdoptDifferentSize(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_size", 4, 16)
+	defer removeTestMap(m)
+
+	params := m.MapParameters
+	params.MaxEntries = 32
+	adopted := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(adopted.EnsureExists()).NotTo(HaveOccurred())
+	defer adopted.Close()
+
+	maxEntries, err := adopted.MaxEntriesConfigured()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(maxEntries).To(Equal(uint32(16)))
+	Expect(adopted.MaxEntries).To(Equal(32), "Parameters should be left as requested")
+}
+
+func TestMapIterPage(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_page", 4, 5)
+	defer removeTestMap(m)
+
+	var token []byte
+	var keys []uint32
+	for pages := 0; ; pages++ {
+		Expect(pages).To(BeNumerically("<", 3))
+		entries, next, err := m.IterPage(token, 2)
+		Expect(err).NotTo(HaveOccurred())
+		for _, e := range entries {
+			keys = append(keys, binary.LittleEndian.Uint32(e.Key))
+		}
+		if next == nil {
+			break
+		}
+		token = next
+	}
+	Expect(keys).To(Equal([]uint32{0, 1, 2, 3, 4}))
+}
+
+func TestMapIterPageBypassesReadCache(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_pagec", 4, 2)
+	defer removeTestMap(m)
+	m.SetReadCache(16, time.Hour)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	_, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+
+	// A write that m's cache doesn't see.
+	other := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+	Expect(other.EnsureExists()).NotTo(HaveOccurred())
+	defer other.Close()
+	Expect(other.Update(k, []byte{2, 2, 2, 2})).NotTo(HaveOccurred())
+
+	entries, _, err := m.IterPage(nil, 2)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(2))
+	Expect(entries[1].Value).To(Equal([]byte{2, 2, 2, 2}))
+}
+
+func TestMapIterLimit(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_limit", 4, 5)
+	defer removeTestMap(m)
+
+	var keys []uint32
+	err := m.IterLimit(2, func(k, v []byte) {
+		keys = append(keys, binary.LittleEndian.Uint32(k))
+	})
+	Expect(keys).To(Equal([]uint32{0, 1}))
+	Expect(err).To(BeAssignableToTypeOf(&bpf.IterLimitError{}))
+	lastKey := err.(*bpf.IterLimitError).LastKey
+	Expect(binary.LittleEndian.Uint32(lastKey)).To(Equal(uint32(1)))
+
+	entries, next, err := m.IterPage(lastKey, 5)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(entries).To(HaveLen(3))
+	Expect(next).To(BeNil())
+
+	Expect(m.IterLimit(5, func(k, v []byte) {})).To(Succeed())
+}
+
+func TestMapVerifyAgainst(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_verify", 4, 3)
+	defer removeTestMap(m)
+
+	expected := map[string][]byte{}
+	for i := uint32(0); i < 3; i++ {
+		k := make([]byte, 4)
+		binary.LittleEndian.PutUint32(k, i)
+		v := []byte{byte(i), 0, 0, 0}
+		Expect(m.Update(k, v)).NotTo(HaveOccurred())
+		expected[string(k)] = v
+	}
+	mismatches, err := m.VerifyAgainst(expected)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(mismatches).To(BeEmpty())
+
+	drifted := []byte{1, 0, 0, 0}
+	Expect(m.Update(drifted, []byte{42, 0, 0, 0})).NotTo(HaveOccurred())
+	mismatches, err = m.VerifyAgainst(expected)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(mismatches).To(Equal([]bpf.Entry{{Key: drifted, Value: []byte{42, 0, 0, 0}}}))
+}
+
+func TestMapIterOrdered(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_ord",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 64,
+		Name:       "cali_test_ord",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	for _, i := range []byte{7, 3, 42, 1, 19} {
+		Expect(m.Update([]byte{0, 0, 0, i}, []byte{i, 0, 0, 0})).NotTo(HaveOccurred())
+	}
+	var seen []byte
+	err := m.IterOrdered(func(k, v []byte) {
+		Expect(v[0]).To(Equal(k[3]))
+		seen = append(seen, k[3])
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(seen).To(Equal([]byte{1, 3, 7, 19, 42}))
+}
+
+func TestMapSwap(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_swap",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_swap",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	old, err := m.Swap(k, []byte{1, 1, 1, 1})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(old).To(BeNil(), "Absent key should give nil")
+
+	old, err = m.Swap(k, []byte{2, 2, 2, 2})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(old).To(Equal([]byte{1, 1, 1, 1}))
+
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{2, 2, 2, 2}))
+
+	_, err = m.Swap(k, []byte{3})
+	Expect(err).To(HaveOccurred(), "Short value should be rejected")
+}
+
+func TestMapExists(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_sig",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  1,
+		MaxEntries: 16,
+		Name:       "cali_test_sig",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	exists, err := m.Exists(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(exists).To(BeFalse())
+
+	Expect(m.Update(k, []byte{0})).NotTo(HaveOccurred())
+	exists, err = m.Exists(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(exists).To(BeTrue())
+}
+
+func TestMapContextOpenFDCount(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{FDSoftLimit: 1}
+	var maps []*bpf.PinnedMap
+	for _, name := range []string{"cali_test_fd1", "cali_test_fd2"} {
+		m := mc.NewPinnedMap(bpf.MapParameters{
+			Filename:   "/sys/fs/bpf/tc/globals/" + name,
+			Type:       "hash",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+			Name:       name,
+		}).(*bpf.PinnedMap)
+		Expect(m.EnsureExists()).NotTo(HaveOccurred())
+		defer removeTestMap(m)
+		maps = append(maps, m)
+	}
+	Expect(mc.OpenFDCount()).To(Equal(2))
+
+	Expect(maps[0].Close()).NotTo(HaveOccurred())
+	Expect(maps[0].Close()).NotTo(HaveOccurred(), "Second close should be a no-op")
+	Expect(mc.OpenFDCount()).To(Equal(1))
+
+	Expect(maps[0].Reopen()).NotTo(HaveOccurred())
+	Expect(mc.OpenFDCount()).To(Equal(2))
+
+	Expect(mc.CloseAll()).NotTo(HaveOccurred())
+	Expect(mc.OpenFDCount()).To(Equal(0))
+}
+
+func TestMapCompact(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_cmp",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 256,
+		Name:       "cali_test_cmp",
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	for i := 0; i < 200; i++ {
+		Expect(m.Update([]byte{byte(i), 0, 0, 0}, []byte{byte(i), 1, 2, 3})).NotTo(HaveOccurred())
+	}
+	for i := 0; i < 200; i += 2 {
+		Expect(m.Delete([]byte{byte(i), 0, 0, 0})).NotTo(HaveOccurred())
+	}
+	idBefore, err := m.ID()
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(m.Compact()).NotTo(HaveOccurred())
+
+	idAfter, err := m.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(idAfter).NotTo(Equal(idBefore), "Map should have been replaced")
+	keys, err := m.Keys()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(keys).To(HaveLen(100))
+	for i := 1; i < 200; i += 2 {
+		v, err := m.Get([]byte{byte(i), 0, 0, 0})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal([]byte{byte(i), 1, 2, 3}))
+	}
+
+	// The pin should refer to the new map too.
+	reopened := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+	Expect(reopened.EnsureExists()).NotTo(HaveOccurred())
+	defer reopened.Close()
+	idPinned, err := reopened.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(idPinned).To(Equal(idAfter))
+}
+
+func TestMapIterTimeout(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_ito", 4, 256)
+	defer removeTestMap(m)
+
+	// The map is read a page at a time, so an expired deadline stops the read early rather than
+	// only the callbacks.
+	seen := 0
+	err := bpf.IterTimeout(m, 0, func(k, v []byte) { seen++ })
+	Expect(err).To(Equal(bpf.ErrIterTimeout))
+	Expect(seen).To(BeNumerically("<", 256))
+
+	seen = 0
+	Expect(bpf.IterTimeout(m, time.Hour, func(k, v []byte) { seen++ })).NotTo(HaveOccurred())
+	Expect(seen).To(Equal(256))
+}
+
+func TestMapCompactResetsCacheAndFrozen(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_cmpc",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_cmpc",
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	}
+	m := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+	m.SetReadCache(16, time.Hour)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	_, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+
+	// A write that m's cache doesn't see, then freeze the old map.
+	other := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(other.EnsureExists()).NotTo(HaveOccurred())
+	defer other.Close()
+	Expect(other.Update(k, []byte{2, 2, 2, 2})).NotTo(HaveOccurred())
+	Expect(m.Freeze()).NotTo(HaveOccurred())
+
+	Expect(m.Compact()).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{2, 2, 2, 2}), "Cached value from the old map survived compaction")
+	Expect(m.Update(k, []byte{3, 3, 3, 3})).NotTo(HaveOccurred(), "New map shouldn't be frozen")
+}
+
+func TestMapCompactConcurrentWrites(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_cmpw",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 256,
+		Name:       "cali_test_cmpw",
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	// Writes that don't go through Update must not land in the old map while it is replaced.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_, err := m.GetOrCreate([]byte{byte(i), 0, 0, 0}, []byte{byte(i), 0, 0, 0})
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = m.IterPage(nil, 10)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		Expect(m.Compact()).NotTo(HaveOccurred())
+	}
+	wg.Wait()
+
+	keys, err := m.Keys()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(keys).To(HaveLen(200))
+}
+
+func TestMapReadCache(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_rc", 4, 4)
+	defer removeTestMap(m)
+	other := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+	Expect(other.EnsureExists()).NotTo(HaveOccurred())
+	defer other.Close()
+
+	m.SetReadCache(16, time.Hour)
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 1, 1, 1}))
+
+	// A write through a different handle isn't seen until the cache is invalidated.
+	Expect(other.Update(k, []byte{2, 2, 2, 2})).NotTo(HaveOccurred())
+	v, _ = m.Get(k)
+	Expect(v).To(Equal([]byte{1, 1, 1, 1}))
+	m.InvalidateCache(k)
+	v, _ = m.Get(k)
+	Expect(v).To(Equal([]byte{2, 2, 2, 2}))
+
+	// Writes through the caching handle invalidate the key.
+	Expect(m.Update(k, []byte{3, 3, 3, 3})).NotTo(HaveOccurred())
+	v, _ = m.Get(k)
+	Expect(v).To(Equal([]byte{3, 3, 3, 3}))
+}
+
+func TestMapAssertType(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_type", 4, 4)
+	defer removeTestMap(m)
+
+	Expect(m.AssertType("array")).NotTo(HaveOccurred())
+	err := m.AssertType("hash")
+	Expect(err).To(HaveOccurred())
+	Expect(err.Error()).To(ContainSubstring("is of type array, expected hash"))
+}
+
+func TestMapGoMapRoundTrip(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_gomap", 4, 4)
+	defer removeTestMap(m)
+
+	in := map[string][]byte{
+		string([]byte{0, 0, 0, 0}): {1, 2, 3, 4},
+		string([]byte{2, 0, 0, 0}): {5, 6, 7, 8},
+	}
+	Expect(m.FromGoMap(in)).NotTo(HaveOccurred())
+	out, err := m.ToGoMap()
+	Expect(err).NotTo(HaveOccurred())
+	// Array maps always contain every index.
+	Expect(out).To(Equal(map[string][]byte{
+		string([]byte{0, 0, 0, 0}): {1, 2, 3, 4},
+		string([]byte{1, 0, 0, 0}): {0, 0, 0, 0},
+		string([]byte{2, 0, 0, 0}): {5, 6, 7, 8},
+		string([]byte{3, 0, 0, 0}): {0, 0, 0, 0},
+	}))
+}
+
+func TestMapCompareAndSwapPair(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_cas",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_cas",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k1, k2 := []byte{1, 0, 0, 0}, []byte{2, 0, 0, 0}
+	a, b, c := []byte{1, 1, 1, 1}, []byte{2, 2, 2, 2}, []byte{3, 3, 3, 3}
+	expectValues := func(v1, v2 []byte) {
+		v, err := m.Get(k1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal(v1))
+		v, err = m.Get(k2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal(v2))
+	}
+
+	// Both keys absent, as expected.
+	swapped, err := m.CompareAndSwapPair(k1, nil, a, k2, nil, a)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(swapped).To(BeTrue())
+	expectValues(a, a)
+
+	// Both match.
+	swapped, err = m.CompareAndSwapPair(k1, a, b, k2, a, b)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(swapped).To(BeTrue())
+	expectValues(b, b)
+
+	// Neither matches.
+	swapped, err = m.CompareAndSwapPair(k1, a, c, k2, a, c)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(swapped).To(BeFalse())
+	expectValues(b, b)
+
+	// Only one matches, for example because another writer changed k2: nothing is written.
+	Expect(m.Update(k2, c)).NotTo(HaveOccurred())
+	swapped, err = m.CompareAndSwapPair(k1, b, a, k2, b, a)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(swapped).To(BeFalse())
+	expectValues(b, c)
+}
+
+func TestMapSameAs(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_same", 4, 4)
+	defer removeTestMap(m)
+	other := newTestArrayMap("cali_test_same2", 4, 4)
+	defer removeTestMap(other)
+
+	// Open the same pin again through a separate handle.
+	reopened := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+	Expect(reopened.EnsureExists()).NotTo(HaveOccurred())
+	defer reopened.Close()
+
+	same, err := m.SameAs(reopened)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(same).To(BeTrue())
+
+	same, err = m.SameAs(other)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(same).To(BeFalse())
+}
+
+func TestMapKernelName(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_kname", 4, 1)
+	defer removeTestMap(m)
+
+	name, err := m.KernelName()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(name).To(Equal("cali_test_kname"))
+
+	// Adopting the pin under a different name still reports the name that the map was created with.
+	params := m.MapParameters
+	params.Name = "cali_test_other"
+	adopted := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(adopted.EnsureExists()).NotTo(HaveOccurred())
+	defer adopted.Close()
+	name, err = adopted.KernelName()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(name).To(Equal("cali_test_kname"))
+}
+
+func countOpenFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	Expect(err).NotTo(HaveOccurred())
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	Expect(err).NotTo(HaveOccurred())
+	return len(names)
+}
+
+func TestMapIterCallbackPanic(t *testing.T) {
+	RegisterTestingT(t)
+	for _, backend := range []bpf.Backend{bpf.BackendNative, bpf.BackendBPFTool} {
+		mc := &bpf.MapContext{Backend: backend}
+		m := mc.NewPinnedMap(bpf.MapParameters{
+			Filename:   "/sys/fs/bpf/tc/globals/cali_test_ipanic",
+			Type:       "array",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 4,
+			Name:       "cali_test_ipanic",
+		}).(*bpf.PinnedMap)
+		Expect(m.EnsureExists()).NotTo(HaveOccurred())
+
+		fdsBefore := countOpenFDs()
+		var recovered interface{}
+		func() {
+			defer func() {
+				recovered = recover()
+			}()
+			_ = m.Iter(func(k, v []byte) {
+				panic("boom")
+			})
+		}()
+		Expect(recovered).To(Equal("boom"), "backend %v", backend)
+		Expect(countOpenFDs()).To(Equal(fdsBefore), "backend %v", backend)
+		Expect(mc.OpenFDCount()).To(Equal(1))
+		// The map is still usable, so no locks were left held.
+		Expect(m.Update([]byte{0, 0, 0, 0}, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+
+		mc.RecoverIterPanics = true
+		err := m.Iter(func(k, v []byte) {
+			panic("boom")
+		})
+		Expect(errors.Cause(err)).To(Equal(bpf.ErrIterCallbackPanic))
+		Expect(countOpenFDs()).To(Equal(fdsBefore), "backend %v", backend)
+
+		removeTestMap(m)
+	}
+}
+
+func TestMapFreeze(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_frz", 4, 2)
+	defer removeTestMap(m)
+
+	frozen, err := m.IsFrozen()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(frozen).To(BeFalse())
+	info, err := m.GetInfo()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(info.Frozen).To(BeFalse())
+	Expect(info.Flags).To(Equal(uint32(0)))
+
+	// Opened before freezing, so it doesn't know that the map is frozen.
+	other := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+	Expect(other.EnsureExists()).NotTo(HaveOccurred())
+	defer other.Close()
+
+	Expect(m.Update([]byte{0, 0, 0, 0}, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	Expect(m.Freeze()).NotTo(HaveOccurred())
+
+	frozen, err = m.IsFrozen()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(frozen).To(BeTrue())
+	info, err = m.GetInfo()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(info.Frozen).To(BeTrue())
+
+	err = m.Update([]byte{0, 0, 0, 0}, []byte{5, 6, 7, 8})
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFrozen))
+	err = other.Update([]byte{0, 0, 0, 0}, []byte{5, 6, 7, 8})
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFrozen))
+
+	// Still readable.
+	v, err := m.Get([]byte{0, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 2, 3, 4}))
+}
+
+func TestMapExistsBatch(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_exb",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_exb",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	Expect(m.Update([]byte{1, 0, 0, 0}, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	exists, err := m.ExistsBatch([][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(exists).To(Equal([]bool{true, false}))
+
+	_, err = m.ExistsBatch([][]byte{{1, 0, 0, 0}, {2, 0}})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestMapGetBatch(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_getb",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_getb",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	Expect(m.Update([]byte{1, 0, 0, 0}, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	Expect(m.Update([]byte{3, 0, 0, 0}, []byte{3, 3, 3, 3})).NotTo(HaveOccurred())
+	values, missing, err := m.GetBatch([][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}, {3, 0, 0, 0}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(values).To(Equal([][]byte{{1, 1, 1, 1}, nil, {3, 3, 3, 3}}))
+	Expect(missing).To(Equal([]bool{false, true, false}))
+
+	_, _, err = m.GetBatch([][]byte{{1, 0, 0, 0}, {2, 0}})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestMapUpdateKeyedBy(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_keyed",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+		Name:       "cali_test_keyed",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	keyFn := func(v []byte) []byte {
+		h := fnv.New32a()
+		_, _ = h.Write(v)
+		return h.Sum(nil)
+	}
+	v := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	Expect(m.UpdateKeyedBy(v, keyFn)).NotTo(HaveOccurred())
+	got, err := m.Get(keyFn(v))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(got).To(Equal(v))
+
+	Expect(m.DeleteKeyedBy(v, keyFn)).NotTo(HaveOccurred())
+	_, err = m.Get(keyFn(v))
+	Expect(bpf.IsNotExists(err)).To(BeTrue())
+
+	err = m.UpdateKeyedBy(v, func(v []byte) []byte { return v })
+	Expect(err).To(HaveOccurred(), "Key of the wrong size should be rejected")
+}
+
+func TestMapContextRevalidateAll(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{}
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_reval",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_reval",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+	k, v := []byte{1, 0, 0, 0}, []byte{1, 1, 1, 1}
+	Expect(m.Update(k, v)).NotTo(HaveOccurred())
+	pinnedID := func() int {
+		other := (&bpf.MapContext{}).NewPinnedMap(m.MapParameters).(*bpf.PinnedMap)
+		Expect(other.EnsureExists()).NotTo(HaveOccurred())
+		defer other.Close()
+		id, err := other.ID()
+		Expect(err).NotTo(HaveOccurred())
+		return id
+	}
+
+	// A healthy map is left alone.
+	idBefore, err := m.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(mc.RevalidateAll()).NotTo(HaveOccurred())
+	id, err := m.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(id).To(Equal(idBefore))
+
+	// Simulate our FD going stale by closing it behind the map's back.  It should be reopened
+	// from the pin, keeping the contents.
+	Expect(unix.Close(int(m.MapFD()))).NotTo(HaveOccurred())
+	Expect(mc.RevalidateAll()).NotTo(HaveOccurred())
+	id, err = m.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(id).To(Equal(idBefore))
+	got, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(got).To(Equal(v))
+	Expect(mc.OpenFDCount()).To(Equal(1))
+
+	// Simulate a remount losing the pin: the map should be recreated and pinned again.
+	Expect(os.Remove(m.Path())).NotTo(HaveOccurred())
+	Expect(mc.RevalidateAll()).NotTo(HaveOccurred())
+	id, err = m.ID()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(id).NotTo(Equal(idBefore))
+	Expect(pinnedID()).To(Equal(id))
+	Expect(mc.OpenFDCount()).To(Equal(1))
+}
+
+func TestMapContextAutoFlush(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{}
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_flush",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_flush",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	_, err := mc.StartAutoFlush(0)
+	Expect(err).To(HaveOccurred(), "A zero interval should be rejected")
+
+	stop, err := mc.StartAutoFlush(50 * time.Millisecond)
+	Expect(err).NotTo(HaveOccurred())
+	defer stop()
+
+	k1, k2 := []byte{1, 0, 0, 0}, []byte{2, 0, 0, 0}
+	Expect(m.UpdateCoalesced(k1, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	Expect(m.UpdateCoalesced(k1, []byte{2, 2, 2, 2})).NotTo(HaveOccurred())
+	Eventually(func() ([]byte, error) {
+		return m.Get(k1)
+	}, "1s", "10ms").Should(Equal([]byte{2, 2, 2, 2}))
+
+	// Stopping flushes anything that is still pending.
+	stop, err = mc.StartAutoFlush(time.Hour)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(m.UpdateCoalesced(k2, []byte{3, 3, 3, 3})).NotTo(HaveOccurred())
+	stop()
+	v, err := m.Get(k2)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{3, 3, 3, 3}))
+}
+
+func TestUpdateCoalescedRejectsPerCPU(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_cpcpu",
+		Type:       "percpu_hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_cpcpu",
+	}).(*bpf.PinnedMap)
+	Expect(m.UpdateCoalesced([]byte{1, 0, 0, 0}, []byte{1, 1, 1, 1})).To(HaveOccurred())
+	// Nothing was queued, so flushing doesn't reach the per-CPU Update.
+	Expect(m.Flush()).NotTo(HaveOccurred())
+}
+
+func TestMapContextOnMutate(t *testing.T) {
+	RegisterTestingT(t)
+	type mutation struct {
+		mapName, op   string
+		key, old, new []byte
+	}
+	var mutations []mutation
+	mc := &bpf.MapContext{
+		OnMutate: func(mapName, op string, key, oldValue, newValue []byte) {
+			mutations = append(mutations, mutation{mapName, op, key, oldValue, newValue})
+		},
+	}
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_mutate",
+		Type:       "lru_hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_mutate",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	Expect(m.Update(k, []byte{2, 2, 2, 2})).NotTo(HaveOccurred())
+	Expect(m.Delete(k)).NotTo(HaveOccurred())
+	// Failed mutations aren't reported.
+	Expect(m.Delete(k)).To(HaveOccurred())
+
+	// Nor are writes made by the other methods missed.
+	k2 := []byte{2, 0, 0, 0}
+	_, err := m.GetOrCreate(k2, []byte{3, 3, 3, 3})
+	Expect(err).NotTo(HaveOccurred())
+	_, err = m.GetOrCreate(k2, []byte{4, 4, 4, 4})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(m.Touch(k2)).NotTo(HaveOccurred())
+
+	perCPU := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_mutpc",
+		Type:       "percpu_hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_mutpc",
+	}).(*bpf.PinnedMap)
+	Expect(perCPU.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(perCPU)
+	Expect(perCPU.UpdateAllCPUs(k, []byte{5, 5, 5, 5})).NotTo(HaveOccurred())
+
+	Expect(mutations).To(Equal([]mutation{
+		{"cali_test_mutate", "update", k, nil, []byte{1, 1, 1, 1}},
+		{"cali_test_mutate", "update", k, []byte{1, 1, 1, 1}, []byte{2, 2, 2, 2}},
+		{"cali_test_mutate", "delete", k, []byte{2, 2, 2, 2}, nil},
+		{"cali_test_mutate", "update", k2, nil, []byte{3, 3, 3, 3}},
+		{"cali_test_mutate", "update", k2, []byte{3, 3, 3, 3}, []byte{3, 3, 3, 3}},
+		// The previous value of a per-CPU entry isn't looked up.
+		{"cali_test_mutpc", "update", k, nil, []byte{5, 5, 5, 5}},
+	}))
+}
+
+func TestMapContextHistory(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{}
+	mc.SetHistorySize(10)
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_hist",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_hist",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 1, 1, 1})).NotTo(HaveOccurred())
+	Expect(m.Iter(func(k, v []byte) {})).NotTo(HaveOccurred())
+	Expect(m.Delete(k)).NotTo(HaveOccurred())
+	Expect(m.Delete(k)).To(HaveOccurred())
+
+	var ops []string
+	var errs []bool
+	for _, r := range mc.DumpHistory() {
+		Expect(r.Map).To(Equal("cali_test_hist"))
+		ops = append(ops, r.Op)
+		errs = append(errs, r.Err != nil)
+	}
+	Expect(ops).To(Equal([]string{"update", "iter", "delete", "delete"}))
+	Expect(errs).To(Equal([]bool{false, false, false, true}))
+}
+
+func TestSnapshotUnaffectedByMutation(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_snap", 4, 8)
+	defer removeTestMap(m)
+
+	for i := 0; i < 8; i++ {
+		Expect(m.Update([]byte{byte(i), 0, 0, 0}, []byte{byte(i), 1, 1, 1})).NotTo(HaveOccurred())
+	}
+	snap, err := m.Snapshot()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(snap.Len()).To(Equal(8))
+
+	for i := 0; i < 8; i++ {
+		Expect(m.Update([]byte{byte(i), 0, 0, 0}, []byte{9, 9, 9, 9})).NotTo(HaveOccurred())
+	}
+
+	v, err := snap.Get([]byte{3, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{3, 1, 1, 1}))
+	_, err = snap.Get([]byte{42, 0, 0, 0})
+	Expect(err).To(Equal(bpf.ErrKeyNotExist))
+
+	seen := 0
+	Expect(snap.Iter(func(k, v []byte) {
+		Expect(v).To(Equal([]byte{k[0], 1, 1, 1}))
+		seen++
+	})).NotTo(HaveOccurred())
+	Expect(seen).To(Equal(8))
+
+	entries := snap.Entries()
+	Expect(entries).To(HaveLen(8))
+	Expect(entries[3].Equal(bpf.Entry{Key: []byte{3, 0, 0, 0}, Value: []byte{3, 1, 1, 1}})).To(BeTrue())
+	// The entries are copies, so modifying them doesn't affect the snapshot.
+	entries[3].Value[0] = 42
+	v, err = snap.Get([]byte{3, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{3, 1, 1, 1}))
+}
+
+func TestMapContextWarmAll(t *testing.T) {
+	RegisterTestingT(t)
+	mc := &bpf.MapContext{}
+	var maps []*bpf.PinnedMap
+	for _, name := range []string{"cali_test_warm1", "cali_test_warm2", "cali_test_warm3"} {
+		m := mc.NewPinnedMap(bpf.MapParameters{
+			Filename:   "/sys/fs/bpf/tc/globals/" + name,
+			Type:       "hash",
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+			Name:       name,
+			LazyCreate: true,
+		}).(*bpf.PinnedMap)
+		Expect(m.EnsureExists()).NotTo(HaveOccurred())
+		defer removeTestMap(m)
+		maps = append(maps, m)
+	}
+	Expect(mc.OpenFDCount()).To(Equal(0))
+
+	Expect(mc.WarmAll()).NotTo(HaveOccurred())
+	Expect(mc.OpenFDCount()).To(Equal(3))
+	for _, m := range maps {
+		_, err := os.Stat(m.Path())
+		Expect(err).NotTo(HaveOccurred(), "Map should have been created by WarmAll")
+	}
+
+	// Warming again is a no-op.
+	Expect(mc.WarmAll()).NotTo(HaveOccurred())
+	Expect(mc.OpenFDCount()).To(Equal(3))
+}
+
+func TestGetDecoded(t *testing.T) {
+	RegisterTestingT(t)
+	decoders := bpf.NewDecoderRegistry()
+	decoders.Register("cali_test_decode", func(v []byte) (interface{}, error) {
+		return binary.LittleEndian.Uint32(v), nil
+	})
+	m := (&bpf.MapContext{Decoders: decoders}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_decode",
+		Type:       "array",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+		Name:       "cali_test_decode",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	Expect(m.Update([]byte{1, 0, 0, 0}, []byte{0, 1, 0, 0})).NotTo(HaveOccurred())
+	v, err := m.GetDecoded([]byte{1, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal(uint32(256)))
+
+	// Without a decoder, the raw value is returned.
+	other := newTestArrayMap("cali_test_nodec", 4, 4)
+	defer removeTestMap(other)
+	v, err = other.GetDecoded([]byte{1, 0, 0, 0})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{0, 0, 0, 0}))
+}
+
+func TestUpdateMasked(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_mask", 8, 4)
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	// The "kernel" owns the second half of the value.
+	Expect(m.Update(k, []byte{1, 2, 3, 4, 5, 6, 7, 8})).NotTo(HaveOccurred())
+
+	mask := []byte{0xff, 0xff, 0xff, 0x0f, 0, 0, 0, 0}
+	Expect(m.UpdateMasked(k, []byte{9, 9, 9, 0xff, 9, 9, 9, 9}, mask)).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{9, 9, 9, 0x0f, 5, 6, 7, 8}))
+
+	Expect(m.UpdateMasked(k, []byte{1}, mask)).To(HaveOccurred(), "Expected error for short value")
+}
+
+func TestUpdateMaskedUsesWritePath(t *testing.T) {
+	RegisterTestingT(t)
+	var ops []string
+	mc := &bpf.MapContext{
+		OnMutate: func(mapName, op string, key, oldValue, newValue []byte) {
+			ops = append(ops, op)
+			Expect(newValue).To(Equal([]byte{9, 0, 0, 0}))
+		},
+	}
+	mc.SetHistorySize(10)
+	m := mc.NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_maskw",
+		Type:       "array",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+		Name:       "cali_test_maskw",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	k := []byte{1, 0, 0, 0}
+	mask := []byte{0xff, 0, 0, 0}
+	Expect(m.UpdateMasked(k, []byte{9, 9, 9, 9}, mask)).NotTo(HaveOccurred())
+	Expect(ops).To(Equal([]string{"update"}))
+	Expect(mc.DumpHistory()).To(HaveLen(1))
+
+	Expect(m.Freeze()).NotTo(HaveOccurred())
+	err := m.UpdateMasked(k, []byte{1, 1, 1, 1}, mask)
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFrozen))
+}
+
+func TestUpdateBatch(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_upd_batch",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1000,
+		Name:       "cali_test_upd_batch",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	var keys, values [][]byte
+	for i := 0; i < 500; i++ {
+		keys = append(keys, []byte{byte(i), byte(i >> 8), 0, 0})
+		values = append(values, []byte{byte(i), 1, 2, 3})
+	}
+	Expect(m.UpdateBatch(keys, values)).NotTo(HaveOccurred())
+
+	count := 0
+	Expect(m.Iter(func(k, v []byte) {
+		Expect(v).To(Equal([]byte{k[0], 1, 2, 3}))
+		count++
+	})).NotTo(HaveOccurred())
+	Expect(count).To(Equal(500))
+
+	Expect(m.UpdateBatch(keys, values[:1])).To(HaveOccurred())
+	Expect(m.UpdateBatch([][]byte{{1}}, [][]byte{{1, 2, 3, 4}})).To(HaveOccurred())
+}
+
+func TestUpdateBatchFrozenAndHistory(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_upd_bfz",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_upd_bfz",
+	}
+	keys := [][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}, {3, 0, 0, 0}}
+	values := [][]byte{{1, 1, 1, 1}, {2, 2, 2, 2}, {3, 3, 3, 3}}
+
+	// With history enabled, each entry is recorded.
+	mc := &bpf.MapContext{}
+	mc.SetHistorySize(10)
+	m := mc.NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+	Expect(m.UpdateBatch(keys, values)).NotTo(HaveOccurred())
+	Expect(mc.DumpHistory()).To(HaveLen(3))
+
+	// The batch path reports a frozen map in the same way as Update.
+	Expect(m.Close()).NotTo(HaveOccurred())
+	m = (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	Expect(m.Freeze()).NotTo(HaveOccurred())
+	err := m.UpdateBatch(keys, values)
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFrozen))
+}
+
+func TestDeleteAsync(t *testing.T) {
+	RegisterTestingT(t)
+	m := (&bpf.MapContext{}).NewPinnedMap(bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_del_async",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 3000,
+		Name:       "cali_test_del_async",
+	}).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+
+	// Enough keys to need more than one batch, and some that don't exist.
+	var toDelete [][]byte
+	for i := 0; i < 2500; i++ {
+		k := []byte{byte(i), byte(i >> 8), 0, 0}
+		Expect(m.Update(k, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+		if i%2 == 0 {
+			toDelete = append(toDelete, k)
+		}
+	}
+	toDelete = append(toDelete, []byte{0xff, 0xff, 0, 0})
+
+	done := m.DeleteAsync(toDelete)
+	Eventually(done, "5s").Should(Receive(BeNil()))
+	Expect(done).To(BeClosed())
+
+	count := 0
+	Expect(m.Iter(func(k, v []byte) {
+		Expect(k[0] % 2).To(Equal(byte(1)))
+		count++
+	})).NotTo(HaveOccurred())
+	Expect(count).To(Equal(1250))
+}
+
+func TestDeleteAsyncFrozenAndHistory(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Filename:   "/sys/fs/bpf/tc/globals/cali_test_del_afz",
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_del_afz",
+	}
+	keys := [][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}}
+
+	mc := &bpf.MapContext{}
+	m := mc.NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(m)
+	for _, k := range keys {
+		Expect(m.Update(k, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	}
+
+	// With history enabled, each delete is recorded.
+	mc.SetHistorySize(10)
+	Eventually(m.DeleteAsync(keys), "5s").Should(Receive(BeNil()))
+	Expect(mc.DumpHistory()).To(HaveLen(2))
+	mc.SetHistorySize(0)
+
+	// Deleting from a frozen map fails, as Delete does.
+	Expect(m.Update(keys[0], []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	Expect(m.Freeze()).NotTo(HaveOccurred())
+	var err error
+	Eventually(m.DeleteAsync(keys), "5s").Should(Receive(&err))
+	Expect(errors.Cause(err)).To(Equal(bpf.ErrMapFrozen))
+}
+
+func TestWriteProm(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_prom", 8, 2)
+	defer removeTestMap(m)
+
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, 1234)
+	Expect(m.Update([]byte{1, 0, 0, 0}, v)).NotTo(HaveOccurred())
+
+	var buf bytes.Buffer
+	err := m.WriteProm(&buf, "felix_test_packets", func(k []byte) map[string]string {
+		return map[string]string{"index": fmt.Sprint(k[0])}
+	}, func(v []byte) float64 {
+		return float64(binary.LittleEndian.Uint64(v))
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(buf.String()).To(Equal(`# TYPE felix_test_packets gauge
+felix_test_packets{index="0"} 0
+felix_test_packets{index="1"} 1234
+`))
+}
+
+func TestFDMap(t *testing.T) {
+	RegisterTestingT(t)
+	params := bpf.MapParameters{
+		Type:       "hash",
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 16,
+		Name:       "cali_test_fdmap",
+	}
+	// An unpinned map, as if loaded by another program.
+	fd, err := bpf.CreateMap(params)
+	Expect(err).NotTo(HaveOccurred())
+	defer fd.Close()
+
+	m := bpf.NewFDMap(fd, params)
+	Expect(m.EnsureExists()).NotTo(HaveOccurred())
+	Expect(m.Path()).To(Equal(""))
+	Expect(m.AssertType("hash")).NotTo(HaveOccurred())
+
+	k := []byte{1, 0, 0, 0}
+	Expect(m.Update(k, []byte{1, 2, 3, 4})).NotTo(HaveOccurred())
+	v, err := m.Get(k)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(v).To(Equal([]byte{1, 2, 3, 4}))
+
+	entries := map[string][]byte{}
+	Expect(m.Iter(func(k, v []byte) {
+		entries[string(k)] = v
+	})).NotTo(HaveOccurred())
+	Expect(entries).To(Equal(map[string][]byte{string(k): {1, 2, 3, 4}}))
+
+	Expect(m.Delete(k)).NotTo(HaveOccurred())
+	Expect(m.Delete(k)).To(Equal(bpf.ErrKeyNotExist))
+
+	wrongParams := params
+	wrongParams.ValueSize = 8
+	Expect(bpf.NewFDMap(fd, wrongParams).EnsureExists()).To(HaveOccurred())
+
+	// A PinnedMap can be compared with an FDMap by kernel ID.
+	params.Filename = "/sys/fs/bpf/tc/globals/cali_test_fdmap"
+	pinned := (&bpf.MapContext{}).NewPinnedMap(params).(*bpf.PinnedMap)
+	Expect(pinned.EnsureExists()).NotTo(HaveOccurred())
+	defer removeTestMap(pinned)
+	same, err := pinned.SameAs(bpf.NewFDMap(pinned.MapFD(), params))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(same).To(BeTrue())
+	same, err = pinned.SameAs(m)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(same).To(BeFalse())
+}
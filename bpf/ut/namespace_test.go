@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build nstests
+
+// These tests enter mount namespaces, which needs CAP_SYS_ADMIN and CAP_SYS_CHROOT, and start a
+// helper process with unshare(1), so they're only built with the nstests tag.
+
+package ut_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/bpf"
+)
+
+func TestOpenInNamespace(t *testing.T) {
+	RegisterTestingT(t)
+	m := newTestArrayMap("cali_test_ns", 4, 1)
+	defer removeTestMap(m)
+	want, err := bpf.GetMapInfo(m.MapFD())
+	Expect(err).NotTo(HaveOccurred())
+
+	origNS, err := os.Readlink("/proc/thread-self/ns/mnt")
+	Expect(err).NotTo(HaveOccurred())
+
+	expectOpens := func(nsPath string) {
+		fd, err := bpf.OpenInNamespace(nsPath, m.Path())
+		Expect(err).NotTo(HaveOccurred())
+		defer fd.Close()
+		got, err := bpf.GetMapInfo(fd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.ID).To(Equal(want.ID))
+	}
+
+	// Our own namespace.
+	expectOpens("/proc/self/ns/mnt")
+
+	// A copy of our namespace, which shares the BPF filesystem mount and so the pin.
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare(1) not available")
+	}
+	cmd := exec.Command("unshare", "--mount", "sleep", "60")
+	Expect(cmd.Start()).To(Succeed())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	nsPath := fmt.Sprintf("/proc/%d/ns/mnt", cmd.Process.Pid)
+	Eventually(func() string {
+		ns, _ := os.Readlink(nsPath)
+		return ns
+	}, time.Second).ShouldNot(Equal(origNS))
+	expectOpens(nsPath)
+
+	_, err = bpf.OpenInNamespace(nsPath, "/sys/fs/bpf/tc/globals/cali_test_ns_missing")
+	Expect(err).To(HaveOccurred())
+
+	// The caller's thread is never moved.
+	ns, err := os.Readlink("/proc/thread-self/ns/mnt")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(ns).To(Equal(origNS))
+}
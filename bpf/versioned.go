@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTornRead is the cause of the error returned by GetVersioned when the value's version field
+// kept changing between reads.  Use errors.Cause() to check for it.
+var ErrTornRead = errors.New("value changed while being read")
+
+const (
+	// versionFieldSize is the size of the version field used by GetVersioned; a uint32.
+	versionFieldSize = 4
+	// maxVersionedReadAttempts bounds the number of pairs of reads that GetVersioned makes
+	// before giving up.
+	maxVersionedReadAttempts = 5
+)
+
+// GetVersioned looks up k, like Get, but checks that the value wasn't modified part way through
+// the read.  The kernel copies large values without a lock, so a lookup that races with an
+// update from a BPF program can return a mix of the old and new values.  GetVersioned relies on
+// the program incrementing a uint32 version field, at versionOffset in the value, on every
+// update: it reads the value twice and, if the version field differs between the two reads,
+// tries again, up to a bounded number of times, before returning ErrTornRead.
+//
+// The check can only detect updates that bump the version, and an update that completes entirely
+// between the two reads without a version change is indistinguishable from no update.  The read
+// cache is bypassed.
+func (b *PinnedMap) GetVersioned(k []byte, versionOffset int) ([]byte, error) {
+	if versionOffset < 0 || versionOffset+versionFieldSize > b.ValueSize {
+		return nil, errors.Errorf("version field at offset %d doesn't fit in value of size %d",
+			versionOffset, b.ValueSize)
+	}
+	v, err := getVersioned(func() ([]byte, error) {
+		return b.getUncached(k)
+	}, versionOffset)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "map %s", b.versionedName())
+	}
+	return v, nil
+}
+
+// getVersioned implements GetVersioned using read to fetch the value.
+func getVersioned(read func() ([]byte, error), versionOffset int) ([]byte, error) {
+	for attempt := 0; attempt < maxVersionedReadAttempts; attempt++ {
+		first, err := read()
+		if err != nil {
+			return nil, err
+		}
+		second, err := read()
+		if err != nil {
+			return nil, err
+		}
+		version := versionOffset + versionFieldSize
+		if bytes.Equal(first[versionOffset:version], second[versionOffset:version]) {
+			return second, nil
+		}
+	}
+	return nil, ErrTornRead
+}
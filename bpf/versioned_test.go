@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// versionedReader returns a reader that bumps the version field at offset 4 of an 8-byte value on
+// each of the first "bumps" reads.
+func versionedReader(bumps int) (read func() ([]byte, error), reads *int) {
+	var version uint32
+	reads = new(int)
+	read = func() ([]byte, error) {
+		*reads++
+		if *reads <= bumps {
+			version++
+		}
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint32(v[0:4], 42)
+		binary.LittleEndian.PutUint32(v[4:8], version)
+		return v, nil
+	}
+	return
+}
+
+func TestGetVersioned(t *testing.T) {
+	// Stable from the start.
+	read, reads := versionedReader(0)
+	v, err := getVersioned(read, 4)
+	if err != nil || *reads != 2 || binary.LittleEndian.Uint32(v) != 42 {
+		t.Errorf("Unexpected result for a stable value: %v, %v after %d reads", v, err, *reads)
+	}
+
+	// Changing for the first few reads, then settles down.
+	read, reads = versionedReader(3)
+	v, err = getVersioned(read, 4)
+	if err != nil || binary.LittleEndian.Uint32(v[4:]) != 3 {
+		t.Errorf("Expected the settled value, got %v, %v after %d reads", v, err, *reads)
+	}
+
+	// Never settles.
+	read, reads = versionedReader(1000)
+	_, err = getVersioned(read, 4)
+	if errors.Cause(err) != ErrTornRead {
+		t.Errorf("Expected ErrTornRead, got %v", err)
+	}
+	if *reads != 2*maxVersionedReadAttempts {
+		t.Errorf("Expected %d reads, got %d", 2*maxVersionedReadAttempts, *reads)
+	}
+}
+
+func TestGetVersionedBadOffset(t *testing.T) {
+	m := (&MapContext{}).newPinnedMap(MapParameters{Type: "hash", KeySize: 4, ValueSize: 8, Name: "cali_test"})
+	for _, offset := range []int{-1, 5, 8} {
+		if _, err := m.GetVersioned([]byte{0, 0, 0, 0}, offset); err == nil {
+			t.Errorf("Expected an error for version offset %d", offset)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type WatchEventType int
+
+const (
+	WatchAdded WatchEventType = iota
+	WatchRemoved
+	WatchChanged
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case WatchAdded:
+		return "Added"
+	case WatchRemoved:
+		return "Removed"
+	case WatchChanged:
+		return "Changed"
+	}
+	return "Unknown"
+}
+
+// WatchEvent describes a change to a single entry.  For WatchRemoved, Entry holds the value that
+// was removed; for WatchChanged, it holds the new value and PrevValue the old one.
+type WatchEvent struct {
+	Type      WatchEventType
+	Entry     Entry
+	PrevValue []byte
+}
+
+// Watcher reports changes to the entries of a map.  It is polling-based, not event-driven: it
+// compares periodic snapshots of the map, so changes that are undone within one poll interval
+// are not seen, and each poll costs a full iteration of the map (two if the map has changed).  It
+// is best suited to small maps that change infrequently.
+type Watcher struct {
+	m        Map
+	interval time.Duration
+
+	primed   bool
+	lastHash uint64
+	last     map[string]Entry
+}
+
+func NewWatcher(m Map, interval time.Duration) *Watcher {
+	return &Watcher{
+		m:        m,
+		interval: interval,
+	}
+}
+
+// Start polls the map in a background goroutine and sends the changes on the returned channel.
+// The contents of the map at the first poll are the baseline and don't generate events.  The
+// channel is closed once ctx is cancelled.  It returns an error, without starting the goroutine,
+// if the watcher's interval isn't positive.
+func (w *Watcher) Start(ctx context.Context) (<-chan WatchEvent, error) {
+	if w.interval <= 0 {
+		return nil, errors.Errorf("invalid poll interval %v for map %s", w.interval, w.m.GetName())
+	}
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			evts, err := w.Poll()
+			if err != nil {
+				logrus.WithError(err).WithField("name", w.m.GetName()).Warn(
+					"Failed to poll map for changes, will retry.")
+			}
+			for _, e := range evts {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Poll takes one snapshot of the map and returns the changes since the previous one.  It is
+// called by the goroutine started by Start; use it directly to drive a Watcher synchronously.
+func (w *Watcher) Poll() ([]WatchEvent, error) {
+	hash, err := ContentHash(w.m)
+	if err != nil {
+		return nil, err
+	}
+	if w.primed && hash == w.lastHash {
+		return nil, nil
+	}
+	contents, err := readContents(w.m)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []WatchEvent
+	if w.primed {
+		added, removed, changed := diffContents(contents, w.last)
+		for _, e := range added {
+			events = append(events, WatchEvent{Type: WatchAdded, Entry: e})
+		}
+		for _, e := range removed {
+			events = append(events, WatchEvent{Type: WatchRemoved, Entry: e})
+		}
+		for _, e := range changed {
+			events = append(events, WatchEvent{
+				Type:      WatchChanged,
+				Entry:     e,
+				PrevValue: w.last[string(e.Key)].Value,
+			})
+		}
+	}
+	w.primed = true
+	w.lastHash = hash
+	w.last = contents
+	return events, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/projectcalico/felix/bpf"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	w := bpf.NewWatcher(m, time.Second)
+
+	events, err := w.Poll()
+	if err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events from first poll, got %v, %v", events, err)
+	}
+	events, err = w.Poll()
+	if err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events from unchanged map, got %v, %v", events, err)
+	}
+
+	_ = m.Delete([]byte{0, 0, 0, 0})
+	_ = m.Update([]byte{1, 0, 0, 0}, []byte{1, 1, 1, 1})
+	_ = m.Update([]byte{7, 0, 0, 0}, []byte{7, 7, 7, 7})
+
+	events, err = w.Poll()
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Type < events[j].Type })
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+	if events[0].Type != bpf.WatchAdded || events[0].Entry.Key[0] != 7 {
+		t.Errorf("Unexpected add event: %+v", events[0])
+	}
+	if events[1].Type != bpf.WatchRemoved || events[1].Entry.Key[0] != 0 || events[1].Entry.Value[1] != 1 {
+		t.Errorf("Unexpected remove event: %+v", events[1])
+	}
+	if events[2].Type != bpf.WatchChanged || events[2].Entry.Key[0] != 1 ||
+		events[2].Entry.Value[1] != 1 || events[2].PrevValue[1] != 1 || events[2].PrevValue[3] != 3 {
+		t.Errorf("Unexpected change event: %+v", events[2])
+	}
+}
+
+func TestWatcherStopsOnCancel(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := bpf.NewWatcher(m, time.Millisecond).Start(ctx)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("Expected no events from an unchanged map")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the event channel to be closed")
+	}
+}
+
+func TestWatcherRejectsInvalidInterval(t *testing.T) {
+	m := newTestMockMap(t, 3)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := bpf.NewWatcher(m, interval).Start(context.Background()); err == nil {
+			t.Errorf("Expected an error for interval %v", interval)
+		}
+	}
+}